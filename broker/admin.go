@@ -0,0 +1,225 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// AdminClient is the connected client which admin API returns
+type AdminClient struct {
+	ClientId        string `json:"client_id"`
+	Username        string `json:"username"`
+	RemoteAddr      string `json:"remote_addr"`
+	ProtocolVersion uint8  `json:"protocol_version"`
+	KeepAlive       uint16 `json:"keepalive"`
+	InFlight        int    `json:"inflight"`
+}
+
+type AdminSubscription struct {
+	TopicName string           `json:"topic"`
+	QoS       message.QoSLevel `json:"qos"`
+	NoLocal   bool             `json:"no_local"`
+	RAP       bool             `json:"retain_as_published"`
+}
+
+// AdminSession is the session state of the client
+type AdminSession struct {
+	AdminClient
+	Subscriptions []AdminSubscription `json:"subscriptions"`
+	// Number of QoS2 messages which are received and waiting for PUBREL
+	Stored int `json:"stored"`
+	// Number of messages which are waiting in the delivery queue, including spilled messages
+	Queued int `json:"queued"`
+	// Number of messages which overflowed the delivery queue and are kept in the session
+	Spilled int `json:"spilled"`
+}
+
+type AdminRetainMessage struct {
+	TopicName    string            `json:"topic"`
+	QoS          message.QoSLevel  `json:"qos"`
+	Payload      string            `json:"payload"`
+	UserProperty map[string]string `json:"user_property,omitempty"`
+}
+
+// AdminPublish is the request body of publishing test message
+type AdminPublish struct {
+	TopicName string           `json:"topic"`
+	QoS       message.QoSLevel `json:"qos"`
+	Payload   string           `json:"payload"`
+	Retain    bool             `json:"retain"`
+}
+
+// AdminHandler returns http.Handler which serves admin REST API:
+//
+//	GET    /clients              list connected clients
+//	GET    /clients/<id>         inspect client session, subscriptions and queue
+//	DELETE /clients/<id>         kick client with DISCONNECT AdministrativeAction
+//	GET    /retained?filter=<f>  list retain messages which match to the filter, default is "#"
+//	DELETE /retained?filter=<f>  delete retain messages which match to the filter
+//	POST   /publish              publish test message
+//
+// The handler doesn't have any authentication, so don't expose it to the public network.
+func (b *Broker) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", b.adminClients)
+	mux.HandleFunc("/clients/", b.adminClient)
+	mux.HandleFunc("/retained", b.adminRetained)
+	mux.HandleFunc("/publish", b.adminPublish)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug("failed to encode admin response: ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (b *Broker) adminClientOf(c *Client) AdminClient {
+	info := c.Info()
+	return AdminClient{
+		ClientId:        info.ClientId,
+		Username:        info.Username,
+		RemoteAddr:      info.RemoteAddr,
+		ProtocolVersion: c.info.ProtocolVersion,
+		KeepAlive:       c.info.KeepAlive,
+		InFlight:        len(c.session.Inflights()),
+	}
+}
+
+func (b *Broker) adminClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	b.mu.Lock()
+	clients := []AdminClient{}
+	for _, c := range b.clients {
+		clients = append(clients, b.adminClientOf(c))
+	}
+	b.mu.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientId < clients[j].ClientId
+	})
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func (b *Broker) adminClient(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/clients/")
+	switch r.Method {
+	case http.MethodGet:
+		b.mu.Lock()
+		c, ok := b.clients[id]
+		b.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "client not found: "+id)
+			return
+		}
+		session := AdminSession{
+			AdminClient:   b.adminClientOf(c),
+			Subscriptions: []AdminSubscription{},
+			Stored:        c.session.Stored(),
+			Queued:        c.queue.depth(),
+			Spilled:       c.session.Spilled(),
+		}
+		for _, t := range b.subscription.ClientSubscriptions(id) {
+			session.Subscriptions = append(session.Subscriptions, AdminSubscription{
+				TopicName: t.TopicName,
+				QoS:       t.QoS,
+				NoLocal:   t.NoLocal,
+				RAP:       t.RAP,
+			})
+		}
+		sort.Slice(session.Subscriptions, func(i, j int) bool {
+			return session.Subscriptions[i].TopicName < session.Subscriptions[j].TopicName
+		})
+		writeJSON(w, http.StatusOK, session)
+	case http.MethodDelete:
+		if !b.disconnectClient(id, message.AdministrativeAction) {
+			writeError(w, http.StatusNotFound, "client not found: "+id)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (b *Broker) adminRetained(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+	matched := []*message.Publish{}
+	for _, pb := range b.subscription.RetainMessages() {
+		if message.MatchTopic(filter, pb.TopicName) {
+			matched = append(matched, pb)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].TopicName < matched[j].TopicName
+	})
+
+	switch r.Method {
+	case http.MethodGet:
+		messages := []AdminRetainMessage{}
+		for _, pb := range matched {
+			m := AdminRetainMessage{
+				TopicName: pb.TopicName,
+				QoS:       pb.QoS,
+				Payload:   string(pb.Body),
+			}
+			if pb.Property != nil {
+				m.UserProperty = pb.Property.UserProperty
+			}
+			messages = append(messages, m)
+		}
+		writeJSON(w, http.StatusOK, messages)
+	case http.MethodDelete:
+		deleted := []string{}
+		for _, pb := range matched {
+			b.deleteRetainMessage(pb.TopicName)
+			deleted = append(deleted, pb.TopicName)
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"deleted": deleted})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (b *Broker) adminPublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req AdminPublish
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if !message.IsQoSAvaliable(uint8(req.QoS)) {
+		writeError(w, http.StatusBadRequest, "invalid QoS")
+		return
+	}
+	opts := []PublishOption{WithQoS(req.QoS)}
+	if req.Retain {
+		opts = append(opts, WithRetain())
+	}
+	if err := b.Publish(context.Background(), req.TopicName, []byte(req.Payload), opts...); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
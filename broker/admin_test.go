@@ -0,0 +1,92 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func adminRequest(t *testing.T, server *httptest.Server, method, path, body string, v interface{}) int {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	assert.NoError(t, err)
+	resp, err := server.Client().Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	if v != nil {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func TestAdminHandler(t *testing.T) {
+	b := broker.NewBroker(":21141", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+	server := httptest.NewServer(b.AdminHandler())
+	defer server.Close()
+
+	c := client.NewClient("mqtt://localhost:21141")
+	assert.NoError(t, c.Connect(context.Background(), client.WithClientId("admin-client")))
+	assert.NoError(t, c.Subscribe("foo/#", nil, client.WithQoS(message.QoS1), client.WithNoLocal()))
+
+	t.Run("list clients", func(t *testing.T) {
+		var clients []broker.AdminClient
+		assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/clients", "", &clients))
+		assert.Equal(t, 1, len(clients))
+		assert.Equal(t, "admin-client", clients[0].ClientId)
+		assert.Equal(t, uint8(5), clients[0].ProtocolVersion)
+	})
+
+	t.Run("inspect session", func(t *testing.T) {
+		var session broker.AdminSession
+		assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/clients/admin-client", "", &session))
+		assert.Equal(t, "admin-client", session.ClientId)
+		assert.Equal(t, []broker.AdminSubscription{
+			{TopicName: "foo/#", QoS: message.QoS1, NoLocal: true},
+		}, session.Subscriptions)
+
+		assert.Equal(t, http.StatusNotFound, adminRequest(t, server, http.MethodGet, "/clients/unknown", "", nil))
+	})
+
+	t.Run("publish and retained messages", func(t *testing.T) {
+		body := `{"topic":"foo/bar","payload":"hello","qos":1,"retain":true}`
+		assert.Equal(t, http.StatusNoContent, adminRequest(t, server, http.MethodPost, "/publish", body, nil))
+		select {
+		case pb := <-c.Message:
+			assert.Equal(t, "foo/bar", pb.TopicName)
+			assert.Equal(t, []byte("hello"), pb.Body)
+		case <-time.After(3 * time.Second):
+			t.Fatal("published message is not received")
+		}
+
+		var retained []broker.AdminRetainMessage
+		assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/retained?filter=foo/%2B", "", &retained))
+		assert.Equal(t, []broker.AdminRetainMessage{
+			{TopicName: "foo/bar", QoS: message.QoS1, Payload: "hello"},
+		}, retained)
+
+		var deleted map[string][]string
+		assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodDelete, "/retained?filter=foo/%23", "", &deleted))
+		assert.Equal(t, []string{"foo/bar"}, deleted["deleted"])
+		assert.Equal(t, http.StatusOK, adminRequest(t, server, http.MethodGet, "/retained", "", &retained))
+		assert.Equal(t, 0, len(retained))
+	})
+
+	t.Run("kick client", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, adminRequest(t, server, http.MethodDelete, "/clients/admin-client", "", nil))
+		select {
+		case <-c.Closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("client is not disconnected")
+		}
+	})
+}
@@ -2,7 +2,6 @@ package broker
 
 import (
 	"bytes"
-	"net"
 
 	"encoding/base64"
 
@@ -17,7 +16,7 @@ const (
 )
 
 // Do basic authentication on AUTH phase
-func doBasicAuth(conn net.Conn, cp *message.ConnectProperty) error {
+func doBasicAuth(w *message.PacketWriter, cp *message.ConnectProperty) error {
 	dec, err := base64.StdEncoding.DecodeString(string(cp.AuthenticationData))
 	if err != nil {
 		return errors.Wrap(err, "failed to decode basic auth string")
@@ -28,21 +27,21 @@ func doBasicAuth(conn net.Conn, cp *message.ConnectProperty) error {
 		return errors.New("authentication failed for supplied user/pass")
 	}
 	log.Debug("[BASIC] username/password matched. Authentication success")
-	if err := message.WriteFrame(conn, message.NewAuth(message.Success)); err != nil {
+	if err := w.WriteFrame(message.NewAuth(message.Success)); err != nil {
 		return errors.Wrap(err, "failed to write auth challenge frame")
 	}
 	return nil
 }
 
 // Do user / password authentication on AUTH phase
-func doLoginAuth(conn net.Conn, cp *message.ConnectProperty) error {
+func doLoginAuth(r *message.PacketReader, w *message.PacketWriter, cp *message.ConnectProperty) error {
 	user := string(cp.AuthenticationData)
 	log.Debugf("[LOGIN] user: %s", user)
 	auth := message.NewAuth(message.ContinueAuthentication)
-	if err := message.WriteFrame(conn, auth); err != nil {
+	if err := w.WriteFrame(auth); err != nil {
 		return errors.Wrap(err, "failed to write auth challenge frame")
 	}
-	frame, payload, err := message.ReceiveFrame(conn)
+	frame, payload, err := r.ReadFrame()
 	if err != nil {
 		return errors.Wrap(err, "failed to receive frame")
 	} else if frame.Type != message.AUTH {
@@ -60,7 +59,7 @@ func doLoginAuth(conn net.Conn, cp *message.ConnectProperty) error {
 		return errors.New("authentication failed for supplied user/pass")
 	}
 	log.Debug("[LOGIN] username/password matched. Authentication success")
-	if err := message.WriteFrame(conn, message.NewAuth(message.Success)); err != nil {
+	if err := w.WriteFrame(message.NewAuth(message.Success)); err != nil {
 		return errors.Wrap(err, "failed to write auth success packet")
 	}
 	return nil
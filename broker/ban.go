@@ -0,0 +1,275 @@
+package broker
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+type BanType int
+
+const (
+	// Ban by client identifier
+	BanClientId BanType = iota + 1
+	// Ban by username
+	BanUsername
+	// Ban by IP address or CIDR like "192.168.0.0/24"
+	BanNetwork
+)
+
+// Ban is the entry of ban list. Zero ExpiresAt means the ban never expires
+type Ban struct {
+	Type      BanType
+	Value     string
+	ExpiresAt time.Time
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.ExpiresAt.IsZero() && now.After(b.ExpiresAt)
+}
+
+type bannedNetwork struct {
+	Ban
+	network *net.IPNet
+}
+
+type banList struct {
+	clientIds map[string]Ban
+	usernames map[string]Ban
+	networks  []bannedNetwork
+	// If not empty, only connections from these networks are accepted
+	allowed []*net.IPNet
+
+	mu sync.RWMutex
+}
+
+func newBanList() *banList {
+	return &banList{
+		clientIds: make(map[string]Ban),
+		usernames: make(map[string]Ban),
+	}
+}
+
+// Parse IP address or CIDR to network
+func parseNetwork(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, errors.New("invalid IP address: " + v)
+		}
+		if ip.To4() != nil {
+			v += "/32"
+		} else {
+			v += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid CIDR: "+v)
+	}
+	return network, nil
+}
+
+func hostIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+func (l *banList) add(ban Ban) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(time.Now())
+
+	switch ban.Type {
+	case BanClientId:
+		l.clientIds[ban.Value] = ban
+	case BanUsername:
+		l.usernames[ban.Value] = ban
+	case BanNetwork:
+		network, err := parseNetwork(ban.Value)
+		if err != nil {
+			return err
+		}
+		for i, n := range l.networks {
+			if n.network.String() == network.String() {
+				l.networks[i] = bannedNetwork{Ban: ban, network: network}
+				return nil
+			}
+		}
+		l.networks = append(l.networks, bannedNetwork{Ban: ban, network: network})
+	default:
+		return errors.New("unknown ban type")
+	}
+	return nil
+}
+
+// Remove expired bans
+func (l *banList) prune(now time.Time) {
+	for k, b := range l.clientIds {
+		if b.expired(now) {
+			delete(l.clientIds, k)
+		}
+	}
+	for k, b := range l.usernames {
+		if b.expired(now) {
+			delete(l.usernames, k)
+		}
+	}
+	networks := l.networks[:0]
+	for _, n := range l.networks {
+		if !n.expired(now) {
+			networks = append(networks, n)
+		}
+	}
+	l.networks = networks
+}
+
+func (l *banList) remove(t BanType, value string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch t {
+	case BanClientId:
+		delete(l.clientIds, value)
+	case BanUsername:
+		delete(l.usernames, value)
+	case BanNetwork:
+		network, err := parseNetwork(value)
+		if err != nil {
+			return
+		}
+		for i, n := range l.networks {
+			if n.network.String() == network.String() {
+				l.networks = append(l.networks[:i], l.networks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (l *banList) list() []Ban {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	now := time.Now()
+	bans := []Ban{}
+	for _, b := range l.clientIds {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	for _, b := range l.usernames {
+		if !b.expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	for _, n := range l.networks {
+		if !n.expired(now) {
+			bans = append(bans, n.Ban)
+		}
+	}
+	return bans
+}
+
+func (l *banList) allow(cidr string) error {
+	network, err := parseNetwork(cidr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.allowed = append(l.allowed, network)
+	return nil
+}
+
+// Check the IP address is banned or not allowed
+func (l *banList) deniedIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.allowed) > 0 {
+		allowed := false
+		for _, n := range l.allowed {
+			if n.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return true
+		}
+	}
+	now := time.Now()
+	for _, n := range l.networks {
+		if !n.expired(now) && n.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *banList) banned(clientId, username string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	now := time.Now()
+	if b, ok := l.clientIds[clientId]; ok && !b.expired(now) {
+		return true
+	}
+	if username == "" {
+		return false
+	}
+	if b, ok := l.usernames[username]; ok && !b.expired(now) {
+		return true
+	}
+	return false
+}
+
+// Ban client identifier, username or network. Zero ttl means the ban never expires.
+// Connected clients which match to the ban are disconnected with AdministrativeAction.
+func (b *Broker) Ban(t BanType, value string, ttl time.Duration) error {
+	ban := Ban{
+		Type:  t,
+		Value: value,
+	}
+	if ttl > 0 {
+		ban.ExpiresAt = time.Now().Add(ttl)
+	}
+	if err := b.bans.add(ban); err != nil {
+		return errors.Wrap(err, "failed to add ban")
+	}
+
+	targets := []string{}
+	b.mu.Lock()
+	for id, c := range b.clients {
+		if b.bans.banned(id, c.info.Username) || b.bans.deniedIP(hostIP(c.conn.RemoteAddr())) {
+			targets = append(targets, id)
+		}
+	}
+	b.mu.Unlock()
+	for _, id := range targets {
+		b.disconnectClient(id, message.AdministrativeAction)
+	}
+	return nil
+}
+
+// Remove the ban
+func (b *Broker) Unban(t BanType, value string) {
+	b.bans.remove(t, value)
+}
+
+// Get active bans
+func (b *Broker) Bans() []Ban {
+	return b.bans.list()
+}
@@ -0,0 +1,142 @@
+package broker_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Send CONNECT of the protocol version and returns CONNACK which is decoded as the version
+func connectVersion(t *testing.T, addr string, version uint8) *message.ConnAck {
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	cn := message.NewConnect()
+	cn.ProtocolName = "MQTT"
+	cn.ProtocolVersion = version
+	cn.ClientId = "versioned"
+	cn.CleanStart = true
+	assert.NoError(t, message.WriteFrame(conn, cn))
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	frame.SetVersion(version)
+	ack, err := message.ParseConnAck(frame, payload)
+	assert.NoError(t, err)
+	return ack
+}
+
+// Connection is closed without CONNACK
+func assertRefused(t *testing.T, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _, err = message.ReceiveFrame(conn)
+	assert.Error(t, err)
+}
+
+func TestMaxConnections(t *testing.T) {
+	b := broker.NewBroker(":21161", broker.WithSysInterval(0), broker.WithMaxConnections(1))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	first := client.NewClient("mqtt://localhost:21161")
+	assert.NoError(t, first.Connect(context.Background()))
+	defer func() {
+		go first.Disconnect()
+		<-first.Closed
+	}()
+
+	second := client.NewClient("mqtt://localhost:21161")
+	assert.Error(t, second.Connect(context.Background()))
+
+	assertRefused(t, "localhost:21161")
+}
+
+func TestBanClientId(t *testing.T) {
+	b := broker.NewBroker(":21162", broker.WithSysInterval(0), broker.WithBans(
+		broker.Ban{Type: broker.BanClientId, Value: "banned-client"},
+		broker.Ban{Type: broker.BanClientId, Value: "versioned"},
+	))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Run("banned on connect", func(t *testing.T) {
+		c := client.NewClient("mqtt://localhost:21162")
+		assert.Error(t, c.Connect(context.Background(), client.WithClientId("banned-client")))
+	})
+
+	t.Run("CONNACK is encoded for the protocol version", func(t *testing.T) {
+		assert.Equal(t, message.Banned, connectVersion(t, "localhost:21162", message.Version5).ReasonCode)
+		assert.Equal(t, message.NotAuthorized, connectVersion(t, "localhost:21162", message.Version311).ReasonCode)
+	})
+
+	t.Run("ban at runtime disconnects client", func(t *testing.T) {
+		c := client.NewClient("mqtt://localhost:21162")
+		assert.NoError(t, c.Connect(context.Background(), client.WithClientId("runtime-client")))
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, b.Ban(broker.BanClientId, "runtime-client", 200*time.Millisecond))
+		select {
+		case <-c.Closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("client is not disconnected")
+		}
+		assert.Equal(t, 3, len(b.Bans()))
+
+		// Ban expires
+		time.Sleep(300 * time.Millisecond)
+		assert.Equal(t, 2, len(b.Bans()))
+		c = client.NewClient("mqtt://localhost:21162")
+		assert.NoError(t, c.Connect(context.Background(), client.WithClientId("runtime-client")))
+		go c.Disconnect()
+		<-c.Closed
+	})
+}
+
+func TestBanNetwork(t *testing.T) {
+	b := broker.NewBroker(":21163", broker.WithSysInterval(0), broker.WithAllowedNetworks("127.0.0.0/8", "::1"))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.NewClient("mqtt://127.0.0.1:21163")
+	assert.NoError(t, c.Connect(context.Background()))
+	go c.Disconnect()
+	<-c.Closed
+
+	assert.NoError(t, b.Ban(broker.BanNetwork, "127.0.0.1", 0))
+	c = client.NewClient("mqtt://127.0.0.1:21163")
+	assert.Error(t, c.Connect(context.Background()))
+	assertRefused(t, "127.0.0.1:21163")
+
+	b.Unban(broker.BanNetwork, "127.0.0.1/32")
+	c = client.NewClient("mqtt://127.0.0.1:21163")
+	assert.NoError(t, c.Connect(context.Background()))
+	go c.Disconnect()
+	<-c.Closed
+
+	assert.Error(t, b.Ban(broker.BanNetwork, "invalid", 0))
+}
+
+func TestSlowHandshakeDoesNotBlockAccept(t *testing.T) {
+	b := broker.NewBroker(":21164", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	// Peer which never sends CONNECT
+	idle, err := net.Dial("tcp", "localhost:21164")
+	assert.NoError(t, err)
+	defer idle.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	c := client.NewClient("mqtt://localhost:21164")
+	assert.NoError(t, c.Connect(ctx))
+	go c.Disconnect()
+	<-c.Closed
+}
@@ -0,0 +1,288 @@
+package broker
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+const (
+	// User property key which records bridges that the message has passed through
+	bridgeMarkerKey = "gqtt-bridge"
+
+	defaultBridgeMinBackoff = time.Second
+	defaultBridgeMaxBackoff = time.Minute
+	bridgeQueueSize         = 1000
+)
+
+type BridgeDirection int
+
+const (
+	// Forward remote messages to the local broker
+	BridgeIn BridgeDirection = iota + 1
+	// Forward local messages to the remote broker
+	BridgeOut
+	// Forward messages both directions
+	BridgeBoth
+)
+
+// BridgeTopic is the pattern of topics which are forwarded by bridge.
+// Pattern is the topic filter without prefix, the prefix is replaced on forwarding
+// e.g. Pattern: "sensors/#", LocalPrefix: "edge/", RemotePrefix: "site1/" forwards "edge/sensors/temp" to "site1/sensors/temp".
+type BridgeTopic struct {
+	Pattern      string
+	Direction    BridgeDirection
+	LocalPrefix  string
+	RemotePrefix string
+	// Maximum QoS for inbound (remote -> local) messages
+	InQoS message.QoSLevel
+	// Maximum QoS for outbound (local -> remote) messages
+	OutQoS message.QoSLevel
+}
+
+func (t BridgeTopic) isInbound() bool {
+	return t.Direction == BridgeIn || t.Direction == BridgeBoth
+}
+
+func (t BridgeTopic) isOutbound() bool {
+	return t.Direction == BridgeOut || t.Direction == BridgeBoth
+}
+
+type BridgeConfig struct {
+	// Name of the bridge, it's used as client identifier and loop prevention marker
+	Name string
+	// Remote broker URL like mqtt://example.com:1883
+	URL string
+	// Options for connecting to the remote broker e.g. authentication
+	Options []client.ClientOption
+	Topics  []BridgeTopic
+	// Reconnect backoff range, default is 1 second to 1 minute
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+type bridge struct {
+	config   BridgeConfig
+	broker   *Broker
+	outbound chan outboundMessage
+}
+
+type outboundMessage struct {
+	topic BridgeTopic
+	pb    *message.Publish
+}
+
+func newBridge(b *Broker, config BridgeConfig) *bridge {
+	if config.MinBackoff == 0 {
+		config.MinBackoff = defaultBridgeMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = defaultBridgeMaxBackoff
+	}
+	return &bridge{
+		config:   config,
+		broker:   b,
+		outbound: make(chan outboundMessage, bridgeQueueSize),
+	}
+}
+
+// Check the message has already passed through this bridge
+func (br *bridge) hasPassed(pb *message.Publish) bool {
+	if pb.Property == nil || pb.Property.UserProperty == nil {
+		return false
+	}
+	marker, ok := pb.Property.UserProperty[bridgeMarkerKey]
+	if !ok {
+		return false
+	}
+	for _, name := range strings.Split(marker, ",") {
+		if name == br.config.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy message property and append bridge marker
+func (br *bridge) markProperty(pb *message.Publish) *message.PublishProperty {
+	prop := &message.PublishProperty{}
+	if pb.Property != nil {
+		*prop = *pb.Property
+		// Subscription identifier is meaningful only in the connection
+		prop.SubscriptionIdentifier = 0
+		prop.TopicAlias = 0
+	}
+	up := make(map[string]string)
+	for k, v := range prop.UserProperty {
+		up[k] = v
+	}
+	if marker, ok := up[bridgeMarkerKey]; ok && marker != "" {
+		up[bridgeMarkerKey] = marker + "," + br.config.Name
+	} else {
+		up[bridgeMarkerKey] = br.config.Name
+	}
+	prop.UserProperty = up
+	return prop
+}
+
+func minQoS(a, b message.QoSLevel) message.QoSLevel {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Run bridge until context is canceled
+func (br *bridge) run(ctx context.Context) {
+	// Local subscriptions are kept while bridge is running, messages are queued during disconnection
+	for _, t := range br.config.Topics {
+		if !t.isOutbound() {
+			continue
+		}
+		topic := t
+		cancel, err := br.broker.Subscribe(topic.LocalPrefix+topic.Pattern, func(pb *message.Publish) {
+			if br.hasPassed(pb) {
+				return
+			}
+			select {
+			case br.outbound <- outboundMessage{topic: topic, pb: pb}:
+			default:
+				log.Debugf("[bridge:%s] outbound queue is full, drop message for %s", br.config.Name, pb.TopicName)
+			}
+		})
+		if err != nil {
+			log.Debugf("[bridge:%s] failed to subscribe local topic: %s", br.config.Name, err)
+			continue
+		}
+		defer cancel()
+	}
+
+	backoff := br.config.MinBackoff
+	var pending *outboundMessage
+	for {
+		connected, err := br.connect(ctx, &pending)
+		if err != nil {
+			log.Debugf("[bridge:%s] connection error: %s", br.config.Name, err)
+		}
+		// Reset backoff if connection was established
+		if connected {
+			backoff = br.config.MinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > br.config.MaxBackoff {
+			backoff = br.config.MaxBackoff
+		}
+	}
+}
+
+// Connect to the remote broker and forward messages until connection is closed.
+// pending holds outbound message which failed to forward, it will be sent at the next connection.
+func (br *bridge) connect(ctx context.Context, pending **outboundMessage) (bool, error) {
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	opts := append([]client.ClientOption{client.WithClientId(br.config.Name)}, br.config.Options...)
+	cl := client.NewClient(br.config.URL)
+	if err := cl.Connect(cctx, opts...); err != nil {
+		return false, errors.Wrap(err, "failed to connect to remote broker")
+	}
+	log.Debugf("[bridge:%s] connected to %s", br.config.Name, br.config.URL)
+
+	closed := false
+	defer func() {
+		if !closed {
+			go cl.Disconnect()
+			<-cl.Closed
+		}
+	}()
+
+	// Receive remote messages in another goroutine.
+	// Client blocks its main loop until the message is received, so we have to drain it even while subscribing.
+	go func() {
+		for {
+			select {
+			case <-cctx.Done():
+				return
+			case pb := <-cl.Message:
+				br.receive(cctx, pb)
+			}
+		}
+	}()
+
+	for _, t := range br.config.Topics {
+		if !t.isInbound() {
+			continue
+		}
+		// NoLocal prevents to receive messages which bridge itself forwarded
+		if err := cl.Subscribe(t.RemotePrefix+t.Pattern, nil, client.WithQoS(t.InQoS), client.WithNoLocal(), client.WithRetainAsPublished()); err != nil {
+			return true, errors.Wrap(err, "failed to subscribe remote topic")
+		}
+	}
+
+	for {
+		if *pending != nil {
+			if err := br.forward(cl, **pending); err != nil {
+				return true, errors.Wrap(err, "failed to forward message to remote")
+			}
+			*pending = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case <-cl.Closed:
+			closed = true
+			return true, errors.New("remote connection closed")
+		case m := <-br.outbound:
+			*pending = &m
+		}
+	}
+}
+
+// Forward local message to the remote broker
+func (br *bridge) forward(cl *client.Client, m outboundMessage) error {
+	topic := m.topic.RemotePrefix + strings.TrimPrefix(m.pb.TopicName, m.topic.LocalPrefix)
+	opts := []client.ClientOption{
+		client.WithQoS(minQoS(m.pb.QoS, m.topic.OutQoS)),
+		client.WithProperty(br.markProperty(m.pb)),
+	}
+	if m.pb.RETAIN {
+		opts = append(opts, client.WithRetain())
+	}
+	log.Debugf("[bridge:%s] forward %s -> %s", br.config.Name, m.pb.TopicName, topic)
+	return cl.Publish(topic, m.pb.Body, opts...)
+}
+
+// Publish remote message to the local broker
+func (br *bridge) receive(ctx context.Context, pb *message.Publish) {
+	if br.hasPassed(pb) {
+		return
+	}
+	for _, t := range br.config.Topics {
+		if !t.isInbound() || !message.MatchTopic(t.RemotePrefix+t.Pattern, pb.TopicName) {
+			continue
+		}
+		topic := t.LocalPrefix + strings.TrimPrefix(pb.TopicName, t.RemotePrefix)
+		opts := []PublishOption{
+			WithQoS(minQoS(pb.QoS, t.InQoS)),
+			WithProperty(br.markProperty(pb)),
+		}
+		if pb.RETAIN {
+			opts = append(opts, WithRetain())
+		}
+		log.Debugf("[bridge:%s] receive %s -> %s", br.config.Name, pb.TopicName, topic)
+		if err := br.broker.Publish(ctx, topic, pb.Body, opts...); err != nil {
+			log.Debugf("[bridge:%s] failed to publish to local: %s", br.config.Name, err)
+		}
+		return
+	}
+}
@@ -0,0 +1,158 @@
+package broker_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+type subscribeNotifier struct {
+	broker.NopHooks
+	subscribed chan string
+}
+
+func (s subscribeNotifier) OnSubscribe(info broker.ClientInfo, t message.SubscribeTopic) (message.SubscribeTopic, error) {
+	select {
+	case s.subscribed <- t.TopicName:
+	default:
+	}
+	return t, nil
+}
+
+func receiveTopic(t *testing.T, ch chan *message.Publish) string {
+	select {
+	case pb := <-ch:
+		return pb.TopicName
+	case <-time.After(3 * time.Second):
+		t.Fatal("message is not received")
+	}
+	return ""
+}
+
+// Start broker and return the function which stops it and waits for the listener to be closed
+func serveBroker(b *broker.Broker) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.ListenAndServe(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestBridgeRemapsTopicsBothDirections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notifier := subscribeNotifier{subscribed: make(chan string, 1)}
+	remote := broker.NewBroker(":21101", broker.WithHooks(notifier))
+	defer serveBroker(remote)()
+	time.Sleep(100 * time.Millisecond)
+
+	local := broker.NewBroker(":21102", broker.WithBridge(broker.BridgeConfig{
+		Name: "edge-bridge",
+		URL:  "mqtt://localhost:21101",
+		Topics: []broker.BridgeTopic{
+			{
+				Pattern:      "sensors/#",
+				Direction:    broker.BridgeBoth,
+				LocalPrefix:  "edge/",
+				RemotePrefix: "site/",
+				InQoS:        message.QoS1,
+				OutQoS:       message.QoS1,
+			},
+		},
+	}))
+	defer serveBroker(local)()
+
+	select {
+	case topic := <-notifier.subscribed:
+		assert.Equal(t, "site/sensors/#", topic)
+	case <-time.After(3 * time.Second):
+		t.Fatal("bridge didn't subscribe remote topic")
+	}
+
+	remoteReceived := make(chan *message.Publish, 10)
+	stop, err := remote.Subscribe("site/sensors/#", func(pb *message.Publish) {
+		remoteReceived <- pb
+	})
+	assert.NoError(t, err)
+	defer stop()
+	localReceived := make(chan *message.Publish, 10)
+	stop, err = local.Subscribe("edge/sensors/#", func(pb *message.Publish) {
+		localReceived <- pb
+	})
+	assert.NoError(t, err)
+	defer stop()
+
+	// local -> remote
+	assert.NoError(t, local.Publish(ctx, "edge/sensors/out", []byte("out")))
+	assert.Equal(t, "edge/sensors/out", receiveTopic(t, localReceived))
+	assert.Equal(t, "site/sensors/out", receiveTopic(t, remoteReceived))
+
+	// remote -> local
+	assert.NoError(t, remote.Publish(ctx, "site/sensors/in", []byte("in")))
+	assert.Equal(t, "site/sensors/in", receiveTopic(t, remoteReceived))
+	assert.Equal(t, "edge/sensors/in", receiveTopic(t, localReceived))
+
+	// Forwarded messages must not come back
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, len(localReceived))
+	assert.Equal(t, 0, len(remoteReceived))
+}
+
+func TestBridgeForwardsRetainedMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notifier := subscribeNotifier{subscribed: make(chan string, 1)}
+	remote := broker.NewBroker(":21103", broker.WithSysInterval(0), broker.WithHooks(notifier))
+	defer serveBroker(remote)()
+	time.Sleep(100 * time.Millisecond)
+
+	local := broker.NewBroker(":21104", broker.WithSysInterval(0), broker.WithBridge(broker.BridgeConfig{
+		Name: "retain-bridge",
+		URL:  "mqtt://localhost:21103",
+		Topics: []broker.BridgeTopic{
+			{
+				Pattern:      "status/#",
+				Direction:    broker.BridgeOut,
+				RemotePrefix: "site/",
+				OutQoS:       message.QoS1,
+			},
+		},
+	}))
+	defer serveBroker(local)()
+	time.Sleep(100 * time.Millisecond)
+
+	remoteReceived := make(chan *message.Publish, 10)
+	stop, err := remote.Subscribe("site/status/#", func(pb *message.Publish) {
+		remoteReceived <- pb
+	})
+	assert.NoError(t, err)
+	defer stop()
+
+	assert.NoError(t, local.Publish(ctx, "status/device", []byte("online"), broker.WithQoS(message.QoS1), broker.WithRetain()))
+	assert.Equal(t, "site/status/device", receiveTopic(t, remoteReceived))
+
+	// Remote broker keeps the forwarded message as retained, then later subscriber receives it
+	c := client.NewClient("mqtt://localhost:21103")
+	assert.NoError(t, c.Connect(ctx))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+	assert.NoError(t, c.Subscribe("site/status/device", nil, client.WithQoS(message.QoS1)))
+	pb := receiveMessage(t, c)
+	assert.Equal(t, "site/status/device", pb.TopicName)
+	assert.Equal(t, "online", string(pb.Body))
+	assert.True(t, pb.RETAIN)
+}
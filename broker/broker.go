@@ -6,41 +6,116 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
 	"github.com/ysugimoto/gqtt/internal/log"
 	"github.com/ysugimoto/gqtt/message"
 )
 
 const (
-	capEventSize = 100
+	capEventSize               = 100
+	defaultResponseInformation = "gqtt/response"
 )
 
 func formatTopicPath(path string) string {
 	return "/" + strings.Trim(path, "/")
 }
 
-var clients = make(map[string]chan *message.Publish)
-
 type Broker struct {
 	addr         string
 	subscription *Subscription
-	willPacketId uint16
+	clients      map[string]*Client
+	// Sessions of disconnected clients which may be resumed
+	sessions    map[string]*storedSession
+	handlers    map[string]Handler
+	packetId    uint16
+	localId     uint64
+	hooks       Hooks
+	bridges     []*bridge
+	cluster     *cluster
+	stats       *stats
+	sysInterval time.Duration
+	rateLimiter *rateLimiter
+	bans        *banList
+	// Maximum number of concurrent connections, zero means unlimited
+	maxConnections int
+	// Number of connections which have finished handshake, including ones which are not added to clients yet
+	active int64
+	// Keepalive seconds which overrides client's one, zero means the broker accepts client's value
+	serverKeepAlive uint16
+	// Delivery queue setting for each subscriber
+	slowConsumer SlowConsumerConfig
+
+	// Deprecated: MessageEvent drops events when the channel is full. Use Hooks instead.
 	MessageEvent chan interface{}
 
+	responseInformation string
+
 	mu sync.Mutex
 }
 
-func NewBroker(addr string) *Broker {
-	return &Broker{
-		addr:         addr,
-		subscription: NewSubscription(),
-		MessageEvent: make(chan interface{}, capEventSize),
+func NewBroker(addr string, opts ...BrokerOption) *Broker {
+	b := &Broker{
+		addr:                addr,
+		subscription:        NewSubscription(),
+		clients:             make(map[string]*Client),
+		sessions:            make(map[string]*storedSession),
+		handlers:            make(map[string]Handler),
+		hooks:               NopHooks{},
+		MessageEvent:        make(chan interface{}, capEventSize),
+		responseInformation: defaultResponseInformation,
+		stats:               newStats(),
+		sysInterval:         defaultSysInterval,
+		rateLimiter:         newRateLimiter(RateLimitConfig{}),
+		bans:                newBanList(),
+		slowConsumer:        SlowConsumerConfig{}.withDefaults(),
+	}
+	for _, o := range opts {
+		switch o.name {
+		case nameResponseInformation:
+			b.responseInformation = o.value.(string)
+		case nameHooks:
+			b.hooks = o.value.(Hooks)
+		case nameBridge:
+			b.bridges = append(b.bridges, newBridge(b, o.value.(BridgeConfig)))
+		case nameCluster:
+			b.cluster = newCluster(b, o.value.(ClusterConfig))
+		case nameSysInterval:
+			b.sysInterval = o.value.(time.Duration)
+		case nameRateLimit:
+			b.rateLimiter = newRateLimiter(o.value.(RateLimitConfig))
+		case nameServerKeepAlive:
+			b.serverKeepAlive = o.value.(uint16)
+		case nameSlowConsumer:
+			b.slowConsumer = o.value.(SlowConsumerConfig).withDefaults()
+		case nameMaxConnections:
+			b.maxConnections = o.value.(int)
+		case nameBans:
+			for _, ban := range o.value.([]Ban) {
+				if err := b.bans.add(ban); err != nil {
+					log.Debug("invalid ban is ignored: ", err)
+				}
+			}
+		case nameAllowedNetworks:
+			for _, cidr := range o.value.([]string) {
+				if err := b.bans.allow(cidr); err != nil {
+					log.Debug("invalid allowed network is ignored: ", err)
+				}
+			}
+		}
 	}
+	return b
 }
 
 func (b *Broker) ListenAndServe(ctx context.Context) error {
+	if b.cluster != nil {
+		if err := b.cluster.config.validate(); err != nil {
+			return errors.Wrap(err, "invalid cluster setting")
+		}
+	}
 	listener, err := net.Listen("tcp", b.addr)
 	if err != nil {
 		return errors.Wrap(err, "failed to listen TCP socket")
@@ -49,34 +124,80 @@ func (b *Broker) ListenAndServe(ctx context.Context) error {
 	defer listener.Close()
 	log.Debugf("Broker server started at %s", b.addr)
 
+	for _, br := range b.bridges {
+		go br.run(ctx)
+	}
+	if b.cluster != nil {
+		go func() {
+			if err := b.cluster.run(ctx); err != nil {
+				log.Debug("cluster stopped: ", err)
+			}
+		}()
+	}
+	if b.sysInterval > 0 {
+		go b.publishSys(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
 	for {
 		s, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			log.Debug(err)
 			continue
 		}
-
-		info, err := b.handshake(s, 10*time.Second)
-		if err != nil {
-			log.Debug("Failed to MQTT handshake: ", err.Error())
+		// Denied address and too many connections are refused before reading CONNECT
+		if b.bans.deniedIP(hostIP(s.RemoteAddr())) {
+			log.Debug("connection from denied address: ", s.RemoteAddr())
+			s.Close()
+			continue
+		}
+		// Connections during the handshake are counted, otherwise concurrent handshakes exceed the limit
+		if active := atomic.AddInt64(&b.active, 1); b.maxConnections > 0 && active > int64(b.maxConnections) {
+			atomic.AddInt64(&b.active, -1)
+			log.Debug("too many connections, server busy")
 			s.Close()
 			continue
 		}
-		client := NewClient(s, *info, ctx, b)
-		go b.handleConnection(client)
+		// Handshake runs on its own goroutine so that slow CONNECT doesn't block accepting other connections
+		go b.serve(ctx, &countingConn{Conn: s, stats: b.stats})
+	}
+}
+
+func (b *Broker) serve(ctx context.Context, s net.Conn) {
+	// Reader and writer are kept for the connection lifetime, packets which are pipelined after CONNECT may be already buffered
+	r := message.NewPacketReader(s)
+	w := message.NewPacketWriter(s)
+	info, err := b.handshake(s, r, w, 10*time.Second)
+	if err != nil {
+		log.Debug("Failed to MQTT handshake: ", err.Error())
+		atomic.AddInt64(&b.active, -1)
+		s.Close()
+		r.Release()
+		w.Close()
+		return
 	}
+	atomic.AddInt64(&b.stats.connections, 1)
+	client := NewClient(s, r, w, *info, ctx, b)
+	b.handleConnection(client)
 }
 
 func (b *Broker) sendEvent(msg interface{}) {
 	// Check overflow channel buffer
-	if len(b.MessageEvent) >= capEventSize {
+	select {
+	case b.MessageEvent <- msg:
+	default:
 		log.Debug("Event channle overflow. You have to drain message")
-	} else {
-		b.MessageEvent <- msg
+		atomic.AddInt64(&b.stats.eventsDropped, 1)
 	}
 }
 
-func (b *Broker) handshake(conn net.Conn, timeout time.Duration) (*message.Connect, error) {
+func (b *Broker) handshake(conn net.Conn, r *message.PacketReader, w *message.PacketWriter, timeout time.Duration) (*message.Connect, error) {
 	conn.SetDeadline(time.Now().Add(timeout))
 	var (
 		err     error
@@ -84,54 +205,133 @@ func (b *Broker) handshake(conn net.Conn, timeout time.Duration) (*message.Conne
 		frame   *message.Frame
 		payload []byte
 		cn      *message.Connect
+		prop    *message.ConnAckProperty
+		// Reported only on success
+		sessionPresent bool
 	)
 	defer func() {
 		log.Debug("defer: send CONNACK")
+		b.stats.reasonCode(message.CONNACK, reason)
 		ack := message.NewConnAck(reason)
+		ack.SessionPresentFlag = sessionPresent
+		// Respond CONNACK which client can decode, v3.1.1 client receives return code
+		if cn != nil {
+			ack.SetVersion(cn.ProtocolVersion)
+		}
 		if err != nil {
-			ack.Property = &message.ConnAckProperty{
+			prop = &message.ConnAckProperty{
 				ReasonString: err.Error(),
 			}
 		}
-		if err := message.WriteFrame(conn, ack); err != nil {
+		ack.Property = prop
+		if err := w.WriteFrame(ack); err != nil {
 			log.Debug("failed to send CONNACK: ", err)
 		}
 		conn.SetDeadline(time.Time{})
 	}()
 
-	frame, payload, err = message.ReceiveFrame(conn)
+	frame, payload, err = r.ReadFrame()
 	if err != nil {
 		log.Debug("receive frame error: ", err)
-		reason = message.MalformedPacket
+		reason = message.ReasonCodeOf(err, message.MalformedPacket)
 		return nil, errors.Wrap(err, "failed to receive packet")
 	}
+	b.stats.packetReceived(frame.Type)
+	if frame.Type != message.CONNECT {
+		reason = message.ProtocolError
+		err = errors.New("First packet must be CONNECT")
+		return nil, err
+	}
 	cn, err = message.ParseConnect(frame, payload)
 	if err != nil {
-		reason = message.MalformedPacket
+		reason = message.ReasonCodeOf(err, message.MalformedPacket)
 		log.Debug("frame expects connect package: ", err)
 		return nil, errors.Wrap(err, "Malformed packet received")
 	}
-	if err := b.authConnect(conn, cn.Property); err != nil {
+	if err = cn.ValidateProtocol(); err != nil {
+		reason = message.ReasonCodeOf(err, message.UnsupportedProtocolVersion)
+		log.Debug("unsupported protocol: ", err)
+		return nil, err
+	}
+	prop = &message.ConnAckProperty{}
+	if !b.rateLimiter.allowConnection(conn.RemoteAddr()) {
+		reason = message.ConnectionRateExceeded
+		err = errors.New("Connection rate exceeded")
+		log.Debug("connection rate exceeded: ", conn.RemoteAddr())
+		return nil, err
+	}
+	// Assign client identifier if client doesn't specify
+	if cn.ClientId == "" {
+		// v3.1.1 client must not resume session without client identifier
+		if cn.ProtocolVersion == message.Version311 && !cn.CleanStart {
+			reason = message.ClientIdentifierNotValid
+			err = errors.New("Client identifier is required")
+			return nil, err
+		}
+		cn.ClientId = uuid.NewV4().String()
+		prop.AssignedClientIdentifier = cn.ClientId
+	}
+	info := ClientInfo{
+		ClientId:   cn.ClientId,
+		Username:   cn.Username,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if b.bans.banned(cn.ClientId, cn.Username) {
+		reason = message.Banned
+		err = errors.New("Banned")
+		log.Debug("banned client: ", cn.ClientId)
+		return nil, err
+	}
+	if err = b.hooks.OnConnect(info, cn); err != nil {
+		reason = reasonCodeOf(err, message.UnspecifiedError)
+		log.Debug("connection rejected by hook: ", err)
+		return nil, errors.Wrap(err, "Connection rejected")
+	}
+	if err = b.authConnect(r, w, cn.Property); err != nil {
 		reason = message.NotAuthorized
+		atomic.AddInt64(&b.stats.authFailures, 1)
 		log.Debug("connection not authorized")
 		return nil, errors.Wrap(err, "Not Authorized")
 	}
+	if err = b.hooks.OnAuthenticate(info, cn); err != nil {
+		reason = reasonCodeOf(err, message.BadUsernameOrPassword)
+		atomic.AddInt64(&b.stats.authFailures, 1)
+		log.Debug("authentication rejected by hook: ", err)
+		return nil, errors.Wrap(err, "Not Authorized")
+	}
 	reason = message.Success
+	// Client may have connected to another node of the cluster, then the session is moved to this node
+	if b.cluster != nil {
+		resume := !cn.CleanStart && !b.sessionPresent(cn)
+		if state := b.cluster.takeover(cn.ClientId, resume); state != nil {
+			b.restoreSession(cn, state)
+		}
+	}
+	sessionPresent = b.sessionPresent(cn)
+	// Override client keepalive, then client must use this value instead of its own
+	if b.serverKeepAlive > 0 {
+		cn.KeepAlive = b.serverKeepAlive
+		prop.ServerKeepAlive = b.serverKeepAlive
+	}
+	// Respond response topic prefix if client requests
+	if cn.Property != nil && cn.Property.RequestResponseInformation {
+		prop.ResponseInformation = b.responseInformation + "/" + cn.ClientId
+	}
 	log.Debugf("CONNECT accepted")
 	b.sendEvent(cn)
 	return cn, nil
 }
 
-func (b *Broker) authConnect(conn net.Conn, cp *message.ConnectProperty) error {
+func (b *Broker) authConnect(r *message.PacketReader, w *message.PacketWriter, cp *message.ConnectProperty) error {
 	// TODO: control to need to authneication on broker from setting or someway
-	if cp == nil {
+	if cp == nil || cp.AuthenticationMethod == "" {
 		return nil
 	}
 	switch cp.AuthenticationMethod {
 	case basicAuthentication:
-		return doBasicAuth(conn, cp)
+		return doBasicAuth(w, cp)
 	case loginAuthentication:
-		return doLoginAuth(conn, cp)
+		return doLoginAuth(r, w, cp)
 	default:
 		return fmt.Errorf("%s does not support or unrecognized", cp.AuthenticationMethod)
 	}
@@ -139,11 +339,29 @@ func (b *Broker) authConnect(conn net.Conn, cp *message.ConnectProperty) error {
 
 func (b *Broker) handleConnection(client *Client) {
 	b.addClient(client)
+	b.publishPresence(client.Id(), true)
+	// Start reading packets and delivery after the client is registered,
+	// otherwise pipelined SUBSCRIBE may be cleared by session takeover and PUBLISH may miss the subscriber.
+	// In-flight messages are also taken over from the previous session at the registration
+	go client.loop()
+	go client.deliver()
 
 	defer func() {
 		log.Debug("====== Client closing ======")
-		b.removeClient(client.Id())
 		client.Close(true)
+		atomic.AddInt64(&b.active, -1)
+		// Session which is taken over by another connection doesn't expire here
+		expired := false
+		if subscriptions, ok := b.removeClient(client); ok {
+			b.publishPresence(client.Id(), false)
+			expired = !b.keepSession(client, subscriptions)
+		}
+		b.hooks.OnDisconnect(client.Info(), client.disconnectReason())
+		if expired {
+			// Spilled messages end with the session
+			atomic.AddInt64(&b.stats.dropped, int64(client.session.Spilled()))
+			b.hooks.OnSessionExpired(client.Info())
+		}
 	}()
 
 	for {
@@ -157,99 +375,251 @@ func (b *Broker) handleConnection(client *Client) {
 
 func (b *Broker) addClient(client *Client) {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	clients[client.Id()] = client.Publisher
-}
+	old, ok := b.clients[client.Id()]
+	if ok && client.info.CleanStart {
+		// Subscriptions of existing connection are kept when the session is taken over
+		b.subscription.UnsubscribeAll(client.Id())
+	}
+	discarded := b.resumeSession(client, old)
+	b.clients[client.Id()] = client
+	b.mu.Unlock()
 
-func (b *Broker) removeClient(clientId string) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	if c, ok := clients[clientId]; ok {
-		close(c)
-		delete(clients, clientId)
-		b.subscription.UnsubscribeAll(clientId)
+	if discarded != nil {
+		b.hooks.OnSessionExpired(*discarded)
+	}
+	if ok {
+		log.Debug("session taken over for client: ", client.Id())
+		old.Disconnect(message.SessionTakenOver)
 	}
+	b.cluster.notifyFilters()
 }
 
-func (b *Broker) Publish(pb *message.Publish) {
-	si := b.subscription.GetClientsByTopic(pb.TopicName)
-	if si == nil {
-		return
+// Disconnect the client with reason code, and report client was connected or not
+func (b *Broker) disconnectClient(clientId string, reason message.ReasonCode) bool {
+	b.mu.Lock()
+	client, ok := b.clients[clientId]
+	b.mu.Unlock()
+
+	if !ok {
+		return false
 	}
+	log.Debugf("disconnect client %s by broker: %s", clientId, reason)
+	client.Disconnect(reason)
+	return true
+}
 
+// Remove client and its subscriptions, and report client has been removed or not.
+// Removed subscriptions are returned in order to keep them with the session
+func (b *Broker) removeClient(client *Client) ([]message.SubscribeTopic, bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	// Client may be replaced by another connection which has the same client identifier
+	if c, ok := b.clients[client.Id()]; ok && c == client {
+		delete(b.clients, client.Id())
+		subscriptions := b.subscription.ClientSubscriptions(client.Id())
+		b.subscription.UnsubscribeAll(client.Id())
+		b.cluster.notifyFilters()
+		return subscriptions, true
+	}
+	return nil, false
+}
 
+// Publish message to the subscribers. from is the client identifier of publisher, or empty for in-process publishing.
+// Retain message is saved even if the topic doesn't have any subscribers.
+func (b *Broker) publish(ctx context.Context, from string, pb *message.Publish) error {
 	log.Debug("start to send publish packet")
 	b.sendEvent(pb)
+	start := time.Now()
+	defer func() {
+		b.stats.observeFanout(time.Since(start))
+	}()
 
 	// Save as retain message is RETAIN bit is active
 	if pb.RETAIN {
 		// TODO: persistent save to DB, or some backend
 		log.Debug("Save retian message to topic: ", pb.TopicName)
-		si.RetainMessage = pb
+		retain := pb.Downgrade(pb.QoS)
+		retain.SetRetain(true)
+		b.subscription.SetRetainMessage(pb.TopicName, retain)
 	}
-	// And we always set retain as set in order to distinguish retained message or not in client.
-	pb.SetRetain(false)
+	// Message is shared with all subscribers, and it is copied only when QoS or RETAIN flag changes for the subscriber
+	retained := pb.RETAIN
 
-	for cid, qos := range si.Clients {
-		c, ok := clients[cid]
-		if !ok {
+	type target struct {
+		client  *Client
+		handler Handler
+		topic   message.SubscribeTopic
+	}
+	// Find delivery targets with holding lock, and deliver after the lock is released
+	// because in-process handler may publish message again.
+	targets := []target{}
+	nodes := []string{}
+	b.mu.Lock()
+	for cid, t := range b.subscription.Subscribers(pb.TopicName) {
+		// NoLocal subscription doesn't receive the message which is published by itself
+		if t.NoLocal && cid == from {
+			continue
+		}
+		if isClusterNode(cid) {
+			// Message which is forwarded from another node has already been sent to all nodes
+			if !isClusterNode(from) {
+				nodes = append(nodes, cid)
+			}
+		} else if c, ok := b.clients[cid]; ok {
+			targets = append(targets, target{client: c, topic: t})
+		} else if h, ok := b.handlers[cid]; ok {
+			targets = append(targets, target{handler: h, topic: t})
+		}
+	}
+	b.mu.Unlock()
+
+	// $SYS topics are statistics of each node, so they are not forwarded
+	if !isClusterNode(from) && !isSysTopic(pb.TopicName) {
+		b.cluster.forward(nodes, pb, retained)
+	}
+	for _, t := range targets {
+		if t.handler != nil {
+			// In-process handler receives the message as published, e.g. bridge forwards retained message as retained
+			t.handler(pb)
 			continue
 		}
 
 		// Downgrade QoS if we need
-		if pb.QoS > qos {
-			log.Debugf("send publish message to: %s (downgraded %d -> %d)\n", cid, pb.QoS, qos)
-			c <- pb.Downgrade(qos)
+		msg := pb
+		if pb.QoS > t.topic.QoS {
+			log.Debugf("send publish message to: %s (downgraded %d -> %d)\n", t.client.Id(), pb.QoS, t.topic.QoS)
+			msg = pb.Downgrade(t.topic.QoS)
+			// Keep RETAIN flag for RetainAsPublished subscription
+			msg.SetRetain(retained && t.topic.RAP)
 		} else {
-			log.Debugf("send publish message to: %s with qos: %d", cid, pb.QoS)
-			c <- pb
+			log.Debugf("send publish message to: %s with qos: %d", t.client.Id(), pb.QoS)
+			// RETAIN flag is cleared for the subscription which isn't RetainAsPublished
+			if retained && !t.topic.RAP {
+				msg = withoutRetain(pb)
+			}
+		}
+		// Queue the message without waiting for the subscriber, slow subscriber is handled by the policy
+		select {
+		case <-t.client.Closed():
+			log.Debug("client has already closed: ", t.client.Id())
+			atomic.AddInt64(&b.stats.dropped, 1)
+			continue
+		default:
+		}
+		if !t.client.queue.push(msg) {
+			log.Debug("delivery queue is full, message is dropped: ", t.client.Id())
+			atomic.AddInt64(&b.stats.dropped, 1)
 		}
 	}
+	return nil
+}
+
+// Copy the message without RETAIN flag, body and properties are shared with the original
+func withoutRetain(pb *message.Publish) *message.Publish {
+	frame := *pb.Frame
+	frame.RETAIN = false
+	copied := *pb
+	copied.Frame = &frame
+	return &copied
+}
+
+func (b *Broker) nextPacketId() uint16 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.packetId++
+	if b.packetId == 0 {
+		b.packetId = 1
+	}
+	return b.packetId
 }
 
 func (b *Broker) subscribe(client *Client, ss *message.Subscribe) (message.Encoder, error) {
 	rcs := []message.ReasonCode{}
 	// TODO: confirm subscription settings e.g. max QoS, ...
 	for _, t := range ss.Subscriptions {
+		if err := message.ValidateTopicFilter(t.TopicName); err != nil {
+			log.Debug("invalid topic filter: ", err)
+			rcs = append(rcs, message.TopicFilterInvalid)
+			continue
+		}
+		t, err := b.hooks.OnSubscribe(client.Info(), t)
+		if err != nil {
+			log.Debug("subscription rejected by hook: ", err)
+			rcs = append(rcs, reasonCodeOf(err, message.NotAuthorized))
+			continue
+		}
 		rc, err := b.subscription.Subscribe(client.Id(), t)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to subscribe: "+t.TopicName)
+		} else if rc == message.NoSubscriptionExisted {
+			// Wildcard filter is kept for the topics which will be created later, so it's granted
+			rc = message.ReasonCode(t.QoS)
 		}
 		rcs = append(rcs, rc)
 	}
+	for _, rc := range rcs {
+		b.stats.reasonCode(message.SUBACK, rc)
+	}
 	b.sendEvent(ss)
+	b.cluster.notifyFilters()
 	return message.NewSubAck(ss.PacketId, rcs...), nil
 }
 
-func (b *Broker) will(c message.Connect) {
+func (b *Broker) unsubscribe(client *Client, us *message.Unsubscribe) message.Encoder {
+	rcs := []message.ReasonCode{}
+	for _, t := range us.Topics {
+		b.hooks.OnUnsubscribe(client.Info(), t)
+		if b.subscription.Unsubscribe(client.Id(), t) {
+			rcs = append(rcs, message.Success)
+		} else {
+			rcs = append(rcs, message.NoSubscriptionExisted)
+		}
+	}
+	for _, rc := range rcs {
+		b.stats.reasonCode(message.UNSUBACK, rc)
+	}
+	b.cluster.notifyFilters()
+	ack := message.NewUnsubAck(rcs...)
+	ack.PacketId = us.PacketId
+	return ack
+}
+
+func (b *Broker) will(client *Client) {
+	c := client.info
 	if !c.FlagWill {
 		log.Debug("client didn't want to use will. Skip")
 		return
 	}
 	log.Debugf("client wants to send will message: qos: %d, topic: %s, body: %s", c.WillQoS, c.WillTopic, c.WillPayload)
-	b.willPacketId++
-	pb := message.NewPublish(b.willPacketId, message.WithQoS(c.WillQoS))
+	pb := message.NewPublish(b.nextPacketId(), message.WithQoS(c.WillQoS))
 	pb.SetRetain(c.WillRetain)
 	pb.TopicName = c.WillTopic
 	pb.Body = []byte(c.WillPayload)
 	if c.WillProperty != nil {
 		pb.Property = c.WillProperty.ToPublish()
 	}
-	b.Publish(pb)
+	pb, err := b.hooks.OnWill(client.Info(), pb)
+	if err != nil || pb == nil {
+		log.Debug("will message is dropped by hook: ", err)
+		return
+	}
+	if err := b.publish(context.Background(), client.Id(), pb); err != nil {
+		log.Debug("failed to publish will message: ", err)
+	}
 }
 
 func (b *Broker) getRetainMessage(topicName string) *message.Publish {
-	if si := b.subscription.GetClientsByTopic(topicName); si != nil {
-		return si.RetainMessage
-	}
-	return nil
+	return b.subscription.RetainMessage(topicName)
 }
 
 func (b *Broker) deleteRetainMessage(topicName string) {
-	if si := b.subscription.GetClientsByTopic(topicName); si != nil {
-		// TODO: delete from persistent storage
-		si.RetainMessage = nil
+	// TODO: delete from persistent storage
+	b.subscription.SetRetainMessage(topicName, nil)
+	if isSysTopic(topicName) {
+		return
 	}
+	b.cluster.broadcast(&clusterMessage{
+		Type:  clusterRetainDelete,
+		Topic: topicName,
+	})
 }
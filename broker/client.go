@@ -4,109 +4,137 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/satori/go.uuid"
 	"github.com/ysugimoto/gqtt/internal/log"
 	"github.com/ysugimoto/gqtt/message"
 	"github.com/ysugimoto/gqtt/session"
 )
 
-const defaultKeepAlive = 30
-
 type Client struct {
 	id        string
 	ctx       context.Context
 	conn      net.Conn
+	reader    *message.PacketReader
+	writer    *message.PacketWriter
 	timeout   *time.Timer
-	Publisher chan *message.Publish
+	queue     *deliveryQueue
 	terminate context.CancelFunc
 	session   *session.Session
+	reason    message.ReasonCode
+
+	messageLimit *tokenBucket
+	byteLimit    *tokenBucket
 
-	once         sync.Once
-	info         message.Connect
-	mu           sync.Mutex
-	broker       *Broker
-	pingInterval time.Duration
+	once   sync.Once
+	info   message.Connect
+	mu     sync.Mutex
+	broker *Broker
+	// Duration until keepalive timeout, zero means keepalive is disabled
+	keepAlive time.Duration
 }
 
-func NewClient(conn net.Conn, info message.Connect, ctx context.Context, b *Broker) *Client {
+func NewClient(conn net.Conn, r *message.PacketReader, w *message.PacketWriter, info message.Connect, ctx context.Context, b *Broker) *Client {
 	cctx, terminate := context.WithCancel(ctx)
 	client := &Client{
-		id:        uuid.NewV4().String(),
+		id:        info.ClientId,
 		conn:      conn,
-		Publisher: make(chan *message.Publish),
+		reader:    r,
+		writer:    w,
 		info:      info,
 		broker:    b,
 		ctx:       cctx,
 		terminate: terminate,
-		session:   session.New(conn, cctx),
+		session:   session.New(w, cctx),
+		reason:    message.UnspecifiedError,
+
+		messageLimit: newTokenBucket(b.rateLimiter.config.ClientMessages),
+		byteLimit:    newTokenBucket(b.rateLimiter.config.ClientBytes),
 	}
+	// Broker allows one and a half times of keepalive for network latency. Zero keepalive disables the mechanism
 	if info.KeepAlive > 0 {
-		client.pingInterval = time.Duration(info.KeepAlive) * time.Second
-	} else {
-		client.pingInterval = time.Duration(defaultKeepAlive) * time.Second
+		client.keepAlive = time.Duration(info.KeepAlive) * time.Second * 3 / 2
+		client.timeout = time.AfterFunc(client.keepAlive, func() {
+			log.Debug("keepalive timeout: ", client.Id())
+			client.Disconnect(message.KeepAliveTimeout)
+		})
 	}
-	client.timeout = time.AfterFunc(client.pingInterval, func() {
-		log.Debug("keepalive timeout")
-		client.terminate()
+
+	client.queue = newDeliveryQueue(b.slowConsumer, client.session, func() {
+		log.Debug("slow consumer is disconnected: ", client.Id())
+		client.Disconnect(message.QuotaExceeded)
 	})
 
-	go func() {
-		for {
-			select {
-			case pb := <-client.Publisher:
-				if pb == nil {
-					return
-				}
-				if err := client.publish(pb); err != nil {
-					client.Close(true)
-				}
+	return client
+}
+
+// Deliver queued messages to the client one by one.
+// In-flight messages of the resumed session are resent before the queued messages
+func (c *Client) deliver() {
+	for _, id := range c.session.Resume() {
+		log.Debug("resend in-flight message: ", id)
+		if err := c.session.Send(id); err != nil {
+			if _, ok := err.(*session.ReasonError); ok {
+				log.Debug("resent message is refused by the client: ", err)
+				continue
 			}
+			log.Debug("failed to resend in-flight message: ", err)
+			c.Close(true)
+			return
 		}
-	}()
-	go client.loop()
-
-	return client
+	}
+	// Spilled messages of the resumed session are delivered first
+	c.queue.refill()
+	for {
+		d, ok := c.queue.pop(c.Closed())
+		if !ok {
+			return
+		}
+		if err := c.publish(d.pb); err != nil {
+			c.Close(true)
+			continue
+		}
+		c.broker.stats.observeDeliver(time.Since(d.at))
+	}
 }
 
 func (c *Client) publish(pb *message.Publish) error {
 	log.Debugf("broker publish to client: qos: %d, message: %s\n", pb.QoS, string(pb.Body))
-	switch pb.QoS {
-	case message.QoS0:
-		if err := message.WriteFrame(c.conn, pb); err != nil {
+	// Translate the message to the protocol version of the client
+	pb = pb.ForVersion(c.info.ProtocolVersion)
+	c.broker.hooks.OnDeliver(c.Info(), pb)
+	if pb.QoS > message.QoS0 {
+		atomic.AddInt64(&c.broker.stats.inFlight, 1)
+		defer atomic.AddInt64(&c.broker.stats.inFlight, -1)
+	}
+	if pb.QoS == message.QoS0 {
+		if err := c.writer.WriteFrame(pb); err != nil {
 			return errors.Wrap(err, "failed to write publish packet")
 		}
-	case message.QoS1:
-		if ack, err := c.session.Start(pb.PacketId, message.PUBACK, pb, session.MaxRetries); err != nil {
-			log.Debug("failed to publish session for OoS1: ", err)
-			return errors.Wrap(err, "failed to publish session for QoS1")
-		} else if _, ok := ack.(*message.PubAck); !ok {
-			log.Debug("failed to type conversion for OoS1")
-			return errors.New("failed to type conversion for OoS1")
-		}
-		// TODO: Need to save and delete message for QoS1
-	case message.QoS2:
-		if ack, err := c.session.Start(pb.PacketId, message.PUBREC, pb, session.MaxRetries); err != nil {
-			log.Debug("failed to publish session for OoS2: ", err)
-			return errors.Wrap(err, "failed to publish session for QoS2")
-		} else if _, ok := ack.(*message.PubRec); !ok {
-			log.Debug("failed to type conversion fto PUBREC or OoS2")
-			return errors.New("failed to type conversion fto PUBREC or OoS2")
-		}
-		time.Sleep(10 * time.Millisecond)
-		// On QoS2, need to send more packet for PUBREL
-		pl := message.NewPubRel(pb.PacketId)
-		log.Debug("success to receive PUBREC: ", pl.PacketId)
-		if ack, err := c.session.Start(pb.PacketId, message.PUBCOMP, pl, session.MaxRetries); err != nil {
-			log.Debug("failed to pubrel session for OoS2: ", err)
-			return errors.Wrap(err, "failed to pubrel session for QoS2")
-		} else if _, ok := ack.(*message.PubComp); !ok {
-			log.Debug("failed to type conversion to PUBCOMP for OoS2")
-			return errors.New("failed to type conversion to PUBCOMP for OoS2")
+		atomic.AddInt64(&c.broker.stats.messagesSent, 1)
+		return nil
+	}
+
+	// Send the copy with packet identifier of this client, the message is shared with other subscribers
+	out, err := c.session.Allocate(pb)
+	if err != nil {
+		log.Debug("failed to allocate packet identifier: ", err)
+		atomic.AddInt64(&c.broker.stats.dropped, 1)
+		return nil
+	}
+	if err := c.session.Send(out.PacketId); err != nil {
+		// Client refused the message, but the connection is still available
+		if _, ok := err.(*session.ReasonError); ok {
+			log.Debug("message is refused by the client: ", err)
+			atomic.AddInt64(&c.broker.stats.dropped, 1)
+			return nil
 		}
+		log.Debug("failed to publish session: ", err)
+		return errors.Wrap(err, "failed to publish session")
 	}
+	atomic.AddInt64(&c.broker.stats.messagesSent, 1)
 	return nil
 }
 
@@ -118,78 +146,197 @@ func (c *Client) Id() string {
 	return c.id
 }
 
+func (c *Client) Info() ClientInfo {
+	return ClientInfo{
+		ClientId:   c.id,
+		Username:   c.info.Username,
+		RemoteAddr: c.conn.RemoteAddr().String(),
+	}
+}
+
 func (c *Client) Close(isWill bool) {
 	c.once.Do(func() {
 		c.terminate()
-		c.timeout.Stop()
+		if c.timeout != nil {
+			c.timeout.Stop()
+		}
 		c.conn.Close()
+		c.writer.Close()
+		atomic.AddInt64(&c.broker.stats.dropped, int64(c.queue.close()))
 		if isWill {
-			c.broker.will(c.info)
+			c.broker.will(c)
 		}
 	})
 }
 
+// Send DISCONNECT packet with reason code from the broker, and close connection
+func (c *Client) Disconnect(reason message.ReasonCode) {
+	c.mu.Lock()
+	c.reason = reason
+	c.mu.Unlock()
+	// Server can't send DISCONNECT on v3.1.1, just close the connection
+	if c.info.ProtocolVersion != message.Version311 {
+		c.broker.stats.reasonCode(message.DISCONNECT, reason)
+		if err := c.write(message.NewDisconnect(reason)); err != nil {
+			log.Debug("failed to send DISCONNECT: ", err)
+		}
+	}
+	c.Close(true)
+}
+
+// Reason code of disconnection which is set by the broker or DISCONNECT packet
+func (c *Client) disconnectReason() message.ReasonCode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason
+}
+
+// Write packet which is encoded by the protocol version of the client
+func (c *Client) write(m message.Encoder) error {
+	m.SetVersion(c.info.ProtocolVersion)
+	return c.writer.WriteFrame(m)
+}
+
 func (c *Client) loop() {
-	defer c.terminate()
+	defer func() {
+		c.terminate()
+		c.reader.Release()
+	}()
 
 	for {
-		frame, payload, err := message.ReceiveFrame(c.conn)
+		frame, payload, err := c.reader.ReadFrame()
 		if err != nil {
-			log.Debug("client packet receive failed")
+			log.Debug("client packet receive failed: ", err)
+			if message.ReasonCodeOf(err, message.Success) != message.Success {
+				c.violate(err)
+			}
 			return
 		}
 		if frame == nil {
 			log.Debug("Received empty frame packet")
 			continue
 		}
+		frame.SetVersion(c.info.ProtocolVersion)
+		c.broker.stats.packetReceived(frame.Type)
+		// Any control packet extends keepalive, not only PINGREQ
+		if c.timeout != nil {
+			c.timeout.Reset(c.keepAlive)
+		}
 		var ack message.Encoder
 		switch frame.Type {
 		case message.DISCONNECT:
-			c.Close(false)
+			dc, err := message.ParseDisconnect(frame, payload)
+			if err != nil {
+				c.violate(err)
+				return
+			}
+			c.mu.Lock()
+			c.reason = dc.ReasonCode
+			c.mu.Unlock()
+			c.broker.stats.reasonCode(message.DISCONNECT, dc.ReasonCode)
+			c.Close(dc.ReasonCode == message.DisconnectWithWillMessage)
 			return
 		case message.PINGREQ:
 			if _, err := message.ParsePingReq(frame, payload); err != nil {
-				log.Debugf("failed to parse packet to PINGREQ: %s\n", err.Error())
+				c.violate(err)
 				return
 			}
-			// Extend expiration and respond PINGRESP
-			c.timeout.Reset(c.pingInterval)
-			if err := message.WriteFrame(c.conn, message.NewPingResp()); err != nil {
+			if err := c.write(message.NewPingResp()); err != nil {
 				log.Debug("failed to send PINGRESP: ", err)
 				return
 			}
 		case message.SUBSCRIBE:
 			ss, err := message.ParseSubscribe(frame, payload)
 			if err != nil {
-				log.Debugf("failed to parse packet to SUBSCRIBE: %s\n", err.Error())
+				c.violate(err)
 				return
 			}
 			log.Debug("client SUBSCRIBE received")
 			if ack, err = c.broker.subscribe(c, ss); err != nil {
 				log.Debugf("failed to add subscribe: %s\n", err.Error())
 				return
-			} else if err := message.WriteFrame(c.conn, ack); err != nil {
+			} else if err := c.write(ack); err != nil {
 				log.Debug("failed to send SUBACK: ", err)
 				return
 			}
-			// Send retain message if exists
+			// Send retain message if exists. Retain message is shared, so queue the copy for delivery
 			for _, s := range ss.Subscriptions {
 				retain := c.broker.getRetainMessage(s.TopicName)
 				if retain != nil {
 					log.Debug("Send retain message for topic: ", s.TopicName)
-					retain.SetRetain(true)
-					if err := message.WriteFrame(c.conn, retain); err != nil {
-						log.Debug("failed to send retain message: ", err)
+					qos := retain.QoS
+					if qos > s.QoS {
+						qos = s.QoS
+					}
+					msg := retain.Downgrade(qos)
+					msg.SetRetain(true)
+					if !c.queue.push(msg) {
+						log.Debug("delivery queue is full, retain message is dropped: ", c.Id())
+						atomic.AddInt64(&c.broker.stats.dropped, 1)
 					}
 				}
 			}
+		case message.UNSUBSCRIBE:
+			us, err := message.ParseUnsubscribe(frame, payload)
+			if err != nil {
+				c.violate(err)
+				return
+			}
+			log.Debug("client UNSUBSCRIBE received")
+			if err := c.write(c.broker.unsubscribe(c, us)); err != nil {
+				log.Debug("failed to send UNSUBACK: ", err)
+				return
+			}
 		case message.PUBLISH:
 			pb, err := message.ParsePublish(frame, payload)
 			if err != nil {
-				log.Debugf("failed to parse packet to PUBLISH: %s\n", err.Error())
+				c.violate(err)
+				return
+			}
+			// Broker doesn't accept Topic Alias because CONNACK doesn't advertise Topic Alias Maximum
+			if pb.Property != nil && pb.Property.TopicAlias > 0 {
+				log.Debug("topic alias is not supported: ", c.Id())
+				c.Disconnect(message.TopicAliasInvalid)
 				return
 			}
 			log.Debugf("Publish message received with QoS: %d from: %s, body: %s\n", pb.QoS, c.Id(), string(pb.Body))
+			atomic.AddInt64(&c.broker.stats.messagesReceived, 1)
+
+			switch c.limitPublish(frame.Size) {
+			case message.MessageRateTooHigh:
+				log.Debug("message rate too high: ", c.Id())
+				atomic.AddInt64(&c.broker.stats.dropped, 1)
+				c.Disconnect(message.MessageRateTooHigh)
+				return
+			case message.QuotaExceeded:
+				log.Debug("quota exceeded: ", c.Id())
+				atomic.AddInt64(&c.broker.stats.dropped, 1)
+				if err := c.rejectPublish(pb.PacketId, pb.QoS, message.QuotaExceeded); err != nil {
+					log.Debug("failed to send reject acknowledgment: ", err)
+					return
+				}
+				continue
+			}
+
+			// Pass to the hook, it may reject or modify the message
+			packetId, qos := pb.PacketId, pb.QoS
+			if pb, err = c.broker.hooks.OnPublish(c.Info(), pb); err != nil {
+				log.Debug("publish rejected by hook: ", err)
+				atomic.AddInt64(&c.broker.stats.dropped, 1)
+				if err := c.rejectPublish(packetId, qos, reasonCodeOf(err, message.NotAuthorized)); err != nil {
+					log.Debug("failed to send reject acknowledgment: ", err)
+					return
+				}
+				continue
+			} else if pb == nil {
+				log.Debug("publish dropped by hook")
+				atomic.AddInt64(&c.broker.stats.dropped, 1)
+				if err := c.rejectPublish(packetId, qos, message.NoMatchingSubscribers); err != nil {
+					log.Debug("failed to send acknowledgment: ", err)
+					return
+				}
+				continue
+			}
 
 			// Check retain message deletion
 			// If RETAIN flag is on and message size is zero, then we delete retain message
@@ -201,36 +348,46 @@ func (c *Client) loop() {
 			switch pb.QoS {
 			case message.QoS0:
 				// QoS0 publishes message immediately
-				c.broker.Publish(pb)
+				c.broker.publish(context.Background(), c.Id(), pb)
 			case message.QoS1:
 				// QoS1 publishes message and respond PUBACK
-				if err := message.WriteFrame(c.conn, message.NewPubAck(pb.PacketId)); err != nil {
+				if err := c.write(message.NewPubAck(pb.PacketId)); err != nil {
 					log.Debug("failed to send PUBACK: ", err)
 					return
 				}
-				c.broker.Publish(pb)
+				c.broker.publish(context.Background(), c.Id(), pb)
 			case message.QoS2:
-				// QoS2 stores message and publish after PUBREL packet received
-				c.session.StoreMessage(pb)
-				if err := message.WriteFrame(c.conn, message.NewPubRec(pb.PacketId)); err != nil {
+				// QoS2 stores message and publish after PUBREL packet received.
+				// Retransmitted PUBLISH is only acknowledged again, stored message isn't replaced
+				if reason := c.session.Receive(pb); reason != message.Success {
+					log.Debug("packet identifier is in use: ", pb.PacketId)
+					atomic.AddInt64(&c.broker.stats.dropped, 1)
+					if err := c.rejectPublish(pb.PacketId, pb.QoS, reason); err != nil {
+						log.Debug("failed to send reject acknowledgment: ", err)
+						return
+					}
+					continue
+				}
+				if err := c.write(message.NewPubRec(pb.PacketId)); err != nil {
 					log.Debug("failed to send PUBREC: ", err)
 				}
 			}
 		case message.PUBACK:
 			pa, err := message.ParsePubAck(frame, payload)
 			if err != nil {
-				log.Debug("malformed packet: failed to decode to PUBACK packet: ", err)
-				continue
+				c.violate(err)
+				return
 			}
 			if err := c.session.Meet(pa.PacketId, message.PUBACK, pa); err != nil {
 				log.Debug("malformed packet: unexpected packet identifier received: ", err)
 				continue
 			}
+			c.broker.hooks.OnAcked(c.Info(), pa.PacketId)
 		case message.PUBREC:
 			pr, err := message.ParsePubRec(frame, payload)
 			if err != nil {
-				log.Debug("malformed packet: failed to decode to PUBREC packet: ", err)
-				continue
+				c.violate(err)
+				return
 			}
 			if err := c.session.Meet(pr.PacketId, message.PUBREC, pr); err != nil {
 				log.Debug("malformed packet: unexpected packet identifier received: ", err)
@@ -239,33 +396,71 @@ func (c *Client) loop() {
 		case message.PUBREL:
 			pl, err := message.ParsePubRel(frame, payload)
 			if err != nil {
-				log.Debug("malformed packet: failed to decode to PUBREL packet: ", err)
-				continue
+				c.violate(err)
+				return
 			}
-			pb, ok := c.session.LoadMessage(pl.PacketId)
+			// Message is nil for retransmitted PUBREL, then respond PUBCOMP again without publishing
+			pb, ok := c.session.Release(pl.PacketId)
 			if !ok {
 				log.Debug("Broker recevied PUBREL packet, but message didn't exist")
+				pc := message.NewPubComp(pl.PacketId)
+				pc.ReasonCode = message.PacketIdentifierNotFound
+				c.broker.stats.reasonCode(message.PUBCOMP, pc.ReasonCode)
+				if err := c.write(pc); err != nil {
+					log.Debug("failed to send PUBCOMP pakcet: ", err)
+				}
 				continue
 			}
-			if err := message.WriteFrame(c.conn, message.NewPubComp(pl.PacketId)); err != nil {
+			if err := c.write(message.NewPubComp(pl.PacketId)); err != nil {
 				log.Debug("failed to send PUBCOMP pakcet: ", err)
 				continue
 			}
-			c.session.DeleteMessage(pl.PacketId)
-			c.broker.Publish(pb)
+			if pb != nil {
+				c.broker.publish(context.Background(), c.Id(), pb)
+			}
 		case message.PUBCOMP:
 			pc, err := message.ParsePubComp(frame, payload)
 			if err != nil {
-				log.Debug("malformed packet: failed to decode to PUBCOMP packet: ", err)
-				continue
+				c.violate(err)
+				return
 			}
 			if err := c.session.Meet(pc.PacketId, message.PUBCOMP, pc); err != nil {
 				log.Debug("malformed packet: unexpected packet identifier received: ", err)
 				continue
 			}
+			c.broker.hooks.OnAcked(c.Info(), pc.PacketId)
+		case message.CONNECT, message.CONNACK, message.SUBACK, message.UNSUBACK, message.PINGRESP:
+			// CONNECT is accepted only once, and others are sent only by the server
+			log.Debug("unexpected packet received: ", frame.Type)
+			c.Disconnect(message.ProtocolError)
+			return
 		default:
 			log.Debugf("not implement packet type: %d\n", frame.Type)
 			continue
 		}
 	}
 }
+
+// Disconnect the client which sent invalid packet with the reason code of the error.
+// Error which doesn't have reason code e.g. truncated packet is regarded as MalformedPacket
+func (c *Client) violate(err error) {
+	log.Debug("protocol violation: ", err)
+	c.Disconnect(message.ReasonCodeOf(err, message.MalformedPacket))
+}
+
+// Respond acknowledgment for the PUBLISH which won't be delivered
+func (c *Client) rejectPublish(packetId uint16, qos message.QoSLevel, reason message.ReasonCode) error {
+	switch qos {
+	case message.QoS1:
+		c.broker.stats.reasonCode(message.PUBACK, reason)
+		ack := message.NewPubAck(packetId)
+		ack.ReasonCode = reason
+		return c.write(ack)
+	case message.QoS2:
+		c.broker.stats.reasonCode(message.PUBREC, reason)
+		ack := message.NewPubRec(packetId)
+		ack.ReasonCode = reason
+		return c.write(ack)
+	}
+	return nil
+}
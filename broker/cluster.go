@@ -0,0 +1,614 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/gob"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+const (
+	// Subscriber identifier prefix for the remote nodes
+	clusterNodePrefix = "$cluster/"
+
+	defaultClusterMinBackoff = 500 * time.Millisecond
+	defaultClusterMaxBackoff = 30 * time.Second
+	clusterQueueSize         = 1000
+	// Duration to wait for the session from other nodes on connecting
+	clusterTakeoverTimeout = 3 * time.Second
+	// Duration to exchange hello messages
+	clusterHelloTimeout = 10 * time.Second
+	clusterNonceSize    = 32
+)
+
+// ClusterConfig is the setting of clustering.
+// Nodes connect each other with the static peer list, and forward PUBLISH only to the nodes which have matching subscribers.
+// Note that the message between nodes is delivered at most once, it may be lost while the node is reconnecting.
+// The client which connects to another node disconnects the previous connection, and its session is moved to the node
+// unless the client starts clean session. Session state includes subscriptions, in-flight messages, incoming QoS2 messages
+// which wait for PUBREL and spilled messages.
+// Nodes must be authenticated by Secret or mutual TLS, otherwise cluster doesn't start.
+type ClusterConfig struct {
+	// Unique name of this node in the cluster
+	NodeName string
+	// Address to listen for the connection from other nodes like ":7946"
+	Addr string
+	// Cluster addresses of the other nodes
+	Peers []string
+	// Shared secret of the nodes. The connecting node proves it with HMAC of the random challenge,
+	// but messages aren't encrypted, use TLS on untrusted network
+	Secret string
+	// TLS setting for both listening and connecting. Peers are authenticated when ClientAuth is RequireAndVerifyClientCert
+	TLS *tls.Config
+}
+
+func (c ClusterConfig) validate() error {
+	if c.Secret == "" && (c.TLS == nil || c.TLS.ClientAuth != tls.RequireAndVerifyClientCert) {
+		return errors.New("cluster requires Secret or TLS with client certificate verification")
+	}
+	return nil
+}
+
+type clusterMessageType int
+
+const (
+	clusterHello clusterMessageType = iota + 1
+	clusterFilters
+	clusterPublish
+	clusterRetainDelete
+	clusterTakeover
+	clusterSession
+)
+
+// clusterMessage is exchanged between nodes with gob encoding
+type clusterMessage struct {
+	Type clusterMessageType
+	Node string
+	// Challenge of hello from the listening node, and the token which is signed with the secret by the connecting node
+	Nonce    []byte
+	Token    []byte
+	Filters  []string
+	Packet   []byte
+	Retain   bool
+	Topic    string
+	ClientId string
+	// Takeover requests the session state, and it is replied with clusterSession message
+	Resume  bool
+	Session *sessionState
+}
+
+// sessionState is the session which is moved between nodes.
+// Messages are encoded packets, which are decoded with the protocol version of each message
+type sessionState struct {
+	Subscriptions []message.SubscribeTopic
+	Inflight      []sessionPacket
+	Received      []sessionPacket
+	Spilled       []sessionPacket
+}
+
+type sessionPacket struct {
+	Version uint8
+	Packet  []byte
+	State   session.State
+}
+
+// clusterPeer is the outgoing connection to the other node
+type clusterPeer struct {
+	addr  string
+	queue chan *clusterMessage
+}
+
+type cluster struct {
+	config ClusterConfig
+	broker *Broker
+	notify chan struct{}
+
+	// Connected peers by node name
+	nodes map[string]*clusterPeer
+	// Topic filters which remote nodes subscribe, by node name
+	filters map[string]map[string]struct{}
+	// Incoming connections by node name
+	inbound map[string]net.Conn
+	// Replies of takeover which are waited by client identifier
+	takeovers map[string]chan *clusterMessage
+
+	mu sync.Mutex
+}
+
+func newCluster(b *Broker, config ClusterConfig) *cluster {
+	return &cluster{
+		config:  config,
+		broker:  b,
+		notify:  make(chan struct{}, 1),
+		nodes:   make(map[string]*clusterPeer),
+		filters: make(map[string]map[string]struct{}),
+		inbound: make(map[string]net.Conn),
+
+		takeovers: make(map[string]chan *clusterMessage),
+	}
+}
+
+func isClusterNode(clientId string) bool {
+	return strings.HasPrefix(clientId, clusterNodePrefix)
+}
+
+// Run cluster until context is canceled
+func (c *cluster) run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", c.config.Addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen cluster TCP socket")
+	}
+	if c.config.TLS != nil {
+		listener = tls.NewListener(listener, c.config.TLS)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	log.Debugf("[cluster:%s] started at %s", c.config.NodeName, c.config.Addr)
+
+	for _, addr := range c.config.Peers {
+		go c.dial(ctx, &clusterPeer{
+			addr:  addr,
+			queue: make(chan *clusterMessage, clusterQueueSize),
+		})
+	}
+	go c.syncFilters(ctx)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Debug(err)
+			continue
+		}
+		go c.accept(ctx, conn)
+	}
+}
+
+// Get number of queued messages for each connected node
+func (c *cluster) queueDepths() map[string]int {
+	depths := make(map[string]int)
+	if c == nil {
+		return depths
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, p := range c.nodes {
+		depths[name] = len(p.queue)
+	}
+	return depths
+}
+
+// Notify that local subscriptions have been changed
+func (c *cluster) notifyFilters() {
+	if c == nil {
+		return
+	}
+	select {
+	case c.notify <- struct{}{}:
+	default:
+		// Already notified, filters will be sent with the latest subscriptions
+	}
+}
+
+func (c *cluster) localFilters() *clusterMessage {
+	return &clusterMessage{
+		Type:    clusterFilters,
+		Node:    c.config.NodeName,
+		Filters: c.broker.subscription.Filters(isClusterNode),
+	}
+}
+
+func (c *cluster) syncFilters(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.notify:
+			c.broadcast(c.localFilters())
+		}
+	}
+}
+
+// Send message to all connected nodes
+func (c *cluster) broadcast(m *clusterMessage) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, p := range c.nodes {
+		c.send(name, p, m)
+	}
+}
+
+func (c *cluster) send(name string, p *clusterPeer, m *clusterMessage) {
+	select {
+	case p.queue <- m:
+	default:
+		log.Debugf("[cluster:%s] queue for node %s is full, drop message", c.config.NodeName, name)
+	}
+}
+
+// Forward published message to the nodes. Retain message is sent to all nodes in order to share it.
+func (c *cluster) forward(nodes []string, pb *message.Publish, retained bool) {
+	if c == nil || (len(nodes) == 0 && !retained) {
+		return
+	}
+	packet, err := pb.ForVersion(message.Version5).Encode()
+	if err != nil {
+		log.Debugf("[cluster:%s] failed to encode publish message: %s", c.config.NodeName, err)
+		return
+	}
+	m := &clusterMessage{
+		Type:   clusterPublish,
+		Node:   c.config.NodeName,
+		Packet: packet,
+		Retain: retained,
+	}
+	if retained {
+		c.broadcast(m)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range nodes {
+		name := strings.TrimPrefix(id, clusterNodePrefix)
+		if p, ok := c.nodes[name]; ok {
+			c.send(name, p, m)
+		}
+	}
+}
+
+// Keep connecting to the peer and send queued messages
+func (c *cluster) dial(ctx context.Context, p *clusterPeer) {
+	backoff := defaultClusterMinBackoff
+	for {
+		connected, err := c.connect(ctx, p)
+		if err != nil {
+			log.Debugf("[cluster:%s] peer %s error: %s", c.config.NodeName, p.addr, err)
+		}
+		if connected {
+			backoff = defaultClusterMinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > defaultClusterMaxBackoff {
+			backoff = defaultClusterMaxBackoff
+		}
+	}
+}
+
+func (c *cluster) dialPeer(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if c.config.TLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", addr, c.config.TLS)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// Sign the challenge with the shared secret
+func (c *cluster) sign(nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(c.config.Secret))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func (c *cluster) connect(ctx context.Context, p *clusterPeer) (bool, error) {
+	conn, err := c.dialPeer(p.addr)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to connect")
+	}
+	defer conn.Close()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	conn.SetDeadline(time.Now().Add(clusterHelloTimeout))
+	var hello clusterMessage
+	if err := dec.Decode(&hello); err != nil || hello.Type != clusterHello {
+		return false, errors.New("failed to receive hello")
+	}
+	if err := enc.Encode(&clusterMessage{
+		Type:  clusterHello,
+		Node:  c.config.NodeName,
+		Token: c.sign(hello.Nonce),
+	}); err != nil {
+		return false, errors.Wrap(err, "failed to send hello")
+	}
+	conn.SetDeadline(time.Time{})
+	name := hello.Node
+	log.Debugf("[cluster:%s] connected to node %s", c.config.NodeName, name)
+
+	// Peer never sends message after hello, so reading returns only when the connection is closed
+	closed := make(chan struct{})
+	go func() {
+		var m clusterMessage
+		dec.Decode(&m)
+		close(closed)
+	}()
+
+	// Discard messages which were queued while disconnected, subscriptions and retain messages are sent again
+	for len(p.queue) > 0 {
+		<-p.queue
+	}
+	c.mu.Lock()
+	c.nodes[name] = p
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.nodes[name] == p {
+			delete(c.nodes, name)
+		}
+		c.mu.Unlock()
+	}()
+
+	if err := enc.Encode(c.localFilters()); err != nil {
+		return true, errors.Wrap(err, "failed to send filters")
+	}
+	for _, pb := range c.broker.subscription.RetainMessages() {
+		if isSysTopic(pb.TopicName) {
+			continue
+		}
+		packet, err := pb.ForVersion(message.Version5).Encode()
+		if err != nil {
+			continue
+		}
+		m := &clusterMessage{Type: clusterPublish, Node: c.config.NodeName, Packet: packet, Retain: true}
+		if err := enc.Encode(m); err != nil {
+			return true, errors.Wrap(err, "failed to send retain message")
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case <-closed:
+			return true, errors.New("connection closed by peer")
+		case m := <-p.queue:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := enc.Encode(m); err != nil {
+				return true, errors.Wrap(err, "failed to send message")
+			}
+		}
+	}
+}
+
+// Check the token of hello is signed for the challenge. Node which has the same name is refused,
+// otherwise the challenge may be signed by this node itself.
+// Without the secret, the node has been authenticated by the client certificate
+func (c *cluster) authenticate(nonce []byte, hello *clusterMessage) bool {
+	if hello.Node == "" || hello.Node == c.config.NodeName {
+		return false
+	}
+	if c.config.Secret == "" {
+		return true
+	}
+	return hmac.Equal(hello.Token, c.sign(nonce))
+}
+
+// Receive messages from the other node
+func (c *cluster) accept(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	nonce := make([]byte, clusterNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Debugf("[cluster:%s] failed to make challenge: %s", c.config.NodeName, err)
+		return
+	}
+	// Node must be authenticated before any other message is taken
+	conn.SetDeadline(time.Now().Add(clusterHelloTimeout))
+	if err := enc.Encode(&clusterMessage{Type: clusterHello, Node: c.config.NodeName, Nonce: nonce}); err != nil {
+		log.Debugf("[cluster:%s] failed to send hello: %s", c.config.NodeName, err)
+		return
+	}
+	var hello clusterMessage
+	if err := dec.Decode(&hello); err != nil || hello.Type != clusterHello {
+		log.Debugf("[cluster:%s] failed to receive hello", c.config.NodeName)
+		return
+	}
+	if !c.authenticate(nonce, &hello) {
+		log.Debugf("[cluster:%s] node %s from %s is not authenticated", c.config.NodeName, hello.Node, conn.RemoteAddr())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	name := hello.Node
+
+	c.mu.Lock()
+	if old, ok := c.inbound[name]; ok {
+		old.Close()
+	}
+	c.inbound[name] = conn
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// Node may have reconnected with another connection
+		if c.inbound[name] == conn {
+			delete(c.inbound, name)
+			delete(c.filters, name)
+			c.broker.subscription.UnsubscribeAll(clusterNodePrefix + name)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	for {
+		var m clusterMessage
+		if err := dec.Decode(&m); err != nil {
+			log.Debugf("[cluster:%s] connection from node %s closed: %s", c.config.NodeName, name, err)
+			return
+		}
+		switch m.Type {
+		case clusterFilters:
+			c.applyFilters(name, m.Filters)
+		case clusterPublish:
+			c.receive(ctx, name, &m)
+		case clusterRetainDelete:
+			c.broker.subscription.SetRetainMessage(m.Topic, nil)
+		case clusterTakeover:
+			// The same client identifier has connected to another node
+			go c.handover(name, m)
+		case clusterSession:
+			c.settle(&m)
+		}
+	}
+}
+
+// Notify other nodes that the client has connected to this node, then the previous connection is closed.
+// When resume is true, the session is moved from the node which has it, otherwise the session is discarded.
+// It waits for replies from all connected nodes until clusterTakeoverTimeout, and returns nil if no node has the session
+func (c *cluster) takeover(clientId string, resume bool) *sessionState {
+	if c == nil {
+		return nil
+	}
+	m := &clusterMessage{
+		Type:     clusterTakeover,
+		Node:     c.config.NodeName,
+		ClientId: clientId,
+		Resume:   resume,
+	}
+
+	c.mu.Lock()
+	waiting := len(c.nodes)
+	var replies chan *clusterMessage
+	if resume && waiting > 0 {
+		replies = make(chan *clusterMessage, waiting)
+		c.takeovers[clientId] = replies
+	}
+	for name, p := range c.nodes {
+		c.send(name, p, m)
+	}
+	c.mu.Unlock()
+	if replies == nil {
+		return nil
+	}
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.takeovers[clientId] == replies {
+			delete(c.takeovers, clientId)
+		}
+	}()
+
+	timeout := time.After(clusterTakeoverTimeout)
+	for i := 0; i < waiting; i++ {
+		select {
+		case reply := <-replies:
+			if reply.Session != nil {
+				return reply.Session
+			}
+		case <-timeout:
+			log.Debugf("[cluster:%s] takeover of client %s timed out", c.config.NodeName, clientId)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Close the connection and remove the session which is taken over by the node, and reply the session if requested
+func (c *cluster) handover(name string, m clusterMessage) {
+	state := c.broker.handoverSession(m.ClientId, m.Resume)
+	if !m.Resume {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.nodes[name]
+	if !ok {
+		log.Debugf("[cluster:%s] node %s is not connected, session of %s is lost", c.config.NodeName, name, m.ClientId)
+		return
+	}
+	c.send(name, p, &clusterMessage{
+		Type:     clusterSession,
+		Node:     c.config.NodeName,
+		ClientId: m.ClientId,
+		Session:  state,
+	})
+}
+
+// Pass the reply of takeover to the waiting connection
+func (c *cluster) settle(m *clusterMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	replies, ok := c.takeovers[m.ClientId]
+	if !ok {
+		log.Debugf("[cluster:%s] takeover of client %s isn't waited", c.config.NodeName, m.ClientId)
+		return
+	}
+	select {
+	case replies <- m:
+	default:
+	}
+}
+
+// Replace subscriptions of the remote node
+func (c *cluster) applyFilters(name string, filters []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := clusterNodePrefix + name
+	current := c.filters[name]
+	next := make(map[string]struct{})
+	for _, f := range filters {
+		next[f] = struct{}{}
+		if _, ok := current[f]; ok {
+			continue
+		}
+		if _, err := c.broker.subscription.Subscribe(id, message.SubscribeTopic{
+			TopicName: f,
+			QoS:       message.QoS2,
+		}); err != nil {
+			log.Debugf("[cluster:%s] failed to subscribe %s for node %s: %s", c.config.NodeName, f, name, err)
+		}
+	}
+	for f := range current {
+		if _, ok := next[f]; !ok {
+			c.broker.subscription.Unsubscribe(id, f)
+		}
+	}
+	c.filters[name] = next
+}
+
+func (c *cluster) receive(ctx context.Context, name string, m *clusterMessage) {
+	frame, payload, err := message.ReceiveFrame(bytes.NewReader(m.Packet))
+	if err != nil {
+		log.Debugf("[cluster:%s] failed to read forwarded message: %s", c.config.NodeName, err)
+		return
+	}
+	pb, err := message.ParsePublish(frame, payload)
+	if err != nil {
+		log.Debugf("[cluster:%s] failed to parse forwarded message: %s", c.config.NodeName, err)
+		return
+	}
+	pb.SetRetain(m.Retain)
+	if err := c.broker.publish(ctx, clusterNodePrefix+name, pb); err != nil {
+		log.Debugf("[cluster:%s] failed to publish forwarded message: %s", c.config.NodeName, err)
+	}
+}
@@ -0,0 +1,214 @@
+package broker_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestClusterRoutesMessagesAcrossNodes(t *testing.T) {
+	ctx := context.Background()
+	nodeA := broker.NewBroker(":21111", broker.WithCluster(broker.ClusterConfig{
+		NodeName: "a",
+		Addr:     ":21112",
+		Peers:    []string{"localhost:21114"},
+		Secret:   "cluster-secret",
+	}))
+	defer serveBroker(nodeA)()
+	nodeB := broker.NewBroker(":21113", broker.WithCluster(broker.ClusterConfig{
+		NodeName: "b",
+		Addr:     ":21114",
+		Peers:    []string{"localhost:21112"},
+		Secret:   "cluster-secret",
+	}))
+	defer serveBroker(nodeB)()
+
+	received := make(chan *message.Publish, 100)
+	stop, err := nodeB.Subscribe("foo/+", func(pb *message.Publish) {
+		received <- pb
+	})
+	assert.NoError(t, err)
+	defer stop()
+
+	// Wait for the subscription to be propagated to node A
+	routed := false
+	for i := 0; i < 50 && !routed; i++ {
+		assert.NoError(t, nodeA.Publish(ctx, "foo/probe", []byte("probe")))
+		select {
+		case <-received:
+			routed = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if !routed {
+		t.Fatal("subscription is not propagated to another node")
+	}
+	for len(received) > 0 {
+		<-received
+	}
+
+	t.Run("publish is forwarded to the node which has subscribers", func(t *testing.T) {
+		assert.NoError(t, nodeA.Publish(ctx, "foo/bar", []byte("hello"), broker.WithQoS(message.QoS1)))
+		assert.Equal(t, "foo/bar", receiveTopic(t, received))
+		assert.NoError(t, nodeA.Publish(ctx, "bar/baz", []byte("not subscribed")))
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, 0, len(received))
+	})
+
+	t.Run("retain message is shared with other nodes", func(t *testing.T) {
+		assert.NoError(t, nodeA.Publish(ctx, "status/a", []byte("online"), broker.WithRetain()))
+		time.Sleep(100 * time.Millisecond)
+
+		c := client.NewClient("mqtt://localhost:21113")
+		assert.NoError(t, c.Connect(ctx))
+		defer func() {
+			go c.Disconnect()
+			<-c.Closed
+		}()
+		go func() {
+			assert.NoError(t, c.Subscribe("status/a", nil))
+		}()
+		select {
+		case pb := <-c.Message:
+			assert.Equal(t, "status/a", pb.TopicName)
+			assert.Equal(t, []byte("online"), pb.Body)
+		case <-time.After(3 * time.Second):
+			t.Fatal("retain message is not received")
+		}
+	})
+
+	t.Run("overlapping filters of the node are kept separately", func(t *testing.T) {
+		explicit := client.NewClient("mqtt://localhost:21113")
+		assert.NoError(t, explicit.Connect(ctx))
+		defer func() {
+			go explicit.Disconnect()
+			<-explicit.Closed
+		}()
+		wildcard := client.NewClient("mqtt://localhost:21113")
+		assert.NoError(t, wildcard.Connect(ctx))
+		defer func() {
+			go wildcard.Disconnect()
+			<-wildcard.Closed
+		}()
+		assert.NoError(t, explicit.Subscribe("a/b", nil))
+		assert.NoError(t, wildcard.Subscribe("a/+", nil))
+
+		// Wait for both filters to be propagated to node A
+		for i := 0; ; i++ {
+			if i > 30 {
+				t.Fatal("filters are not propagated to another node")
+			}
+			assert.NoError(t, nodeA.Publish(ctx, "a/c", []byte("probe")))
+			select {
+			case <-wildcard.Message:
+			case <-time.After(100 * time.Millisecond):
+				continue
+			}
+			break
+		}
+
+		// Node B drops the wildcard filter, then node A still routes the topic of the explicit filter
+		_, err := wildcard.Unsubscribe(ctx, "a/+")
+		assert.NoError(t, err)
+		time.Sleep(200 * time.Millisecond)
+		assert.NoError(t, nodeA.Publish(ctx, "a/b", []byte("explicit")))
+		pb := receiveMessage(t, explicit)
+		assert.Equal(t, "a/b", pb.TopicName)
+		assert.Equal(t, "explicit", string(pb.Body))
+	})
+
+	t.Run("session is moved to another node", func(t *testing.T) {
+		conn, ack := connectSessionAck(t, "localhost:21111", "takeover", false)
+		defer conn.Close()
+		assert.False(t, ack.SessionPresentFlag)
+		ss := message.NewSubscribe()
+		ss.PacketId = 1
+		ss.AddTopic(message.SubscribeTopic{TopicName: "takeover/#", QoS: message.QoS1})
+		assert.NoError(t, message.WriteFrame(conn, ss))
+		frame, _, err := message.ReceiveFrame(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, message.SUBACK, frame.Type)
+		// In-flight message which isn't acknowledged, and incoming QoS2 message which isn't released
+		assert.NoError(t, nodeA.Publish(ctx, "takeover/a", []byte("inflight"), broker.WithQoS(message.QoS1)))
+		first := receivePublish(t, conn)
+		assert.Equal(t, message.Success, publishQoS2(t, conn, 5, false))
+
+		moved, ack := connectSessionAck(t, "localhost:21113", "takeover", false)
+		defer moved.Close()
+		assert.True(t, ack.SessionPresentFlag)
+		assert.Equal(t, message.SessionTakenOver, receiveDisconnect(t, conn).ReasonCode)
+
+		// In-flight message is resent by the node
+		moved.SetReadDeadline(time.Now().Add(3 * time.Second))
+		resent := receivePublish(t, moved)
+		assert.True(t, resent.DUP)
+		assert.Equal(t, first.PacketId, resent.PacketId)
+		assert.Equal(t, []byte("inflight"), resent.Body)
+		assert.NoError(t, message.WriteFrame(moved, message.NewPubAck(resent.PacketId)))
+		// Incoming QoS2 message is released on the node
+		assert.Equal(t, message.Success, releaseQoS2(t, moved, 5))
+		// Subscription is restored on the node
+		assert.NoError(t, nodeB.Publish(ctx, "takeover/b", []byte("subscribed"), broker.WithQoS(message.QoS1)))
+		pb := receivePublish(t, moved)
+		assert.Equal(t, "takeover/b", pb.TopicName)
+		assert.NoError(t, message.WriteFrame(moved, message.NewPubAck(pb.PacketId)))
+		// Session doesn't remain on the previous node
+		waitSubscriptions(t, nodeA, 0)
+
+		// Clean start discards the session on another node
+		clean, ack := connectSessionAck(t, "localhost:21111", "takeover", true)
+		defer clean.Close()
+		assert.False(t, ack.SessionPresentFlag)
+		assert.Equal(t, message.SessionTakenOver, receiveDisconnect(t, moved).ReasonCode)
+		// Only the in-process handler remains
+		waitSubscriptions(t, nodeB, 1)
+	})
+}
+
+func TestClusterRejectsUnauthenticatedNode(t *testing.T) {
+	ctx := context.Background()
+	node := broker.NewBroker(":21115", broker.WithSysInterval(0), broker.WithCluster(broker.ClusterConfig{
+		NodeName: "a",
+		Addr:     ":21116",
+		Peers:    []string{"localhost:21118"},
+		Secret:   "cluster-secret",
+	}))
+	defer serveBroker(node)()
+	intruder := broker.NewBroker(":21117", broker.WithSysInterval(0), broker.WithCluster(broker.ClusterConfig{
+		NodeName: "intruder",
+		Addr:     ":21118",
+		Peers:    []string{"localhost:21116"},
+		Secret:   "wrong-secret",
+	}))
+	defer serveBroker(intruder)()
+
+	received := make(chan *message.Publish, 100)
+	stop, err := intruder.Subscribe("auth/+", func(pb *message.Publish) {
+		received <- pb
+	})
+	assert.NoError(t, err)
+	defer stop()
+
+	// Subscriptions of the node which doesn't know the secret are never applied
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, node.Publish(ctx, "auth/probe", []byte("probe")))
+		select {
+		case <-received:
+			t.Fatal("message is forwarded to unauthenticated node")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.Run("cluster requires authentication", func(t *testing.T) {
+		b := broker.NewBroker(":21119", broker.WithSysInterval(0), broker.WithCluster(broker.ClusterConfig{
+			NodeName: "open",
+			Addr:     ":21120",
+		}))
+		assert.Error(t, b.ListenAndServe(ctx))
+	})
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// ClientInfo is the identity of client which is passed to the hooks
+type ClientInfo struct {
+	ClientId   string
+	Username   string
+	RemoteAddr string
+}
+
+// Hooks receives broker lifecycle events.
+// Callbacks which return an error work as interceptor, the broker rejects the packet with the error.
+// Return RejectError from Reject() in order to respond specific reason code to the client.
+// Note that callbacks are called from multiple goroutines concurrently.
+type Hooks interface {
+	// Called when CONNECT packet is received, before authentication
+	OnConnect(info ClientInfo, cn *message.Connect) error
+	// Called after authentication method succeeded. Check the credentials (e.g. Username and Password) here
+	OnAuthenticate(info ClientInfo, cn *message.Connect) error
+	// Called for each topic filter on SUBSCRIBE. Returned topic is used for the subscription
+	OnSubscribe(info ClientInfo, topic message.SubscribeTopic) (message.SubscribeTopic, error)
+	// Called for each topic filter on UNSUBSCRIBE
+	OnUnsubscribe(info ClientInfo, topic string)
+	// Called when client publishes message. Returned message is delivered to the subscribers, or dropped if nil
+	OnPublish(info ClientInfo, pb *message.Publish) (*message.Publish, error)
+	// Called before message is delivered to the subscriber
+	OnDeliver(info ClientInfo, pb *message.Publish)
+	// Called when the subscriber acknowledged QoS1 or QoS2 message
+	OnAcked(info ClientInfo, packetId uint16)
+	// Called when client connection is closed
+	OnDisconnect(info ClientInfo, reason message.ReasonCode)
+	// Called when client session is discarded
+	OnSessionExpired(info ClientInfo)
+	// Called before will message is published. Returned message is published, or dropped if nil
+	OnWill(info ClientInfo, pb *message.Publish) (*message.Publish, error)
+}
+
+// NopHooks implements Hooks with doing nothing.
+// Embed this struct in order to implement only the callbacks you need.
+type NopHooks struct{}
+
+func (NopHooks) OnConnect(info ClientInfo, cn *message.Connect) error {
+	return nil
+}
+func (NopHooks) OnAuthenticate(info ClientInfo, cn *message.Connect) error {
+	return nil
+}
+func (NopHooks) OnSubscribe(info ClientInfo, topic message.SubscribeTopic) (message.SubscribeTopic, error) {
+	return topic, nil
+}
+func (NopHooks) OnUnsubscribe(info ClientInfo, topic string) {}
+func (NopHooks) OnPublish(info ClientInfo, pb *message.Publish) (*message.Publish, error) {
+	return pb, nil
+}
+func (NopHooks) OnDeliver(info ClientInfo, pb *message.Publish)          {}
+func (NopHooks) OnAcked(info ClientInfo, packetId uint16)                {}
+func (NopHooks) OnDisconnect(info ClientInfo, reason message.ReasonCode) {}
+func (NopHooks) OnSessionExpired(info ClientInfo)                        {}
+func (NopHooks) OnWill(info ClientInfo, pb *message.Publish) (*message.Publish, error) {
+	return pb, nil
+}
+
+// RejectError is returned from hooks to reject packet with specific reason code
+type RejectError struct {
+	Code   message.ReasonCode
+	Reason string
+}
+
+func (r *RejectError) Error() string {
+	return r.Reason
+}
+
+func Reject(code message.ReasonCode, reason string) error {
+	return &RejectError{
+		Code:   code,
+		Reason: reason,
+	}
+}
+
+// Find reason code from error which hooks returned
+func reasonCodeOf(err error, fallback message.ReasonCode) message.ReasonCode {
+	if r, ok := errors.Cause(err).(*RejectError); ok {
+		return r.Code
+	}
+	return fallback
+}
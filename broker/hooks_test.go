@@ -0,0 +1,192 @@
+package broker_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+type hookEvent struct {
+	name  string
+	info  broker.ClientInfo
+	value string
+}
+
+// Hooks which records callbacks, and rejects or modifies packets by the client identifier and topic
+type recordHooks struct {
+	events chan hookEvent
+}
+
+func (h recordHooks) record(name string, info broker.ClientInfo, value string) {
+	h.events <- hookEvent{name: name, info: info, value: value}
+}
+
+func (h recordHooks) OnConnect(info broker.ClientInfo, cn *message.Connect) error {
+	h.record("connect", info, "")
+	if cn.ClientId == "refused" {
+		return broker.Reject(message.ClientIdentifierNotValid, "refused client")
+	}
+	return nil
+}
+func (h recordHooks) OnAuthenticate(info broker.ClientInfo, cn *message.Connect) error {
+	h.record("authenticate", info, "")
+	if cn.Username == "intruder" {
+		return errors.New("unknown user")
+	}
+	return nil
+}
+func (h recordHooks) OnSubscribe(info broker.ClientInfo, t message.SubscribeTopic) (message.SubscribeTopic, error) {
+	h.record("subscribe", info, t.TopicName)
+	if t.TopicName == "alias/#" {
+		t.TopicName = "hooks/#"
+	}
+	return t, nil
+}
+func (h recordHooks) OnUnsubscribe(info broker.ClientInfo, topic string) {
+	h.record("unsubscribe", info, topic)
+}
+func (h recordHooks) OnPublish(info broker.ClientInfo, pb *message.Publish) (*message.Publish, error) {
+	h.record("publish", info, pb.TopicName)
+	if pb.TopicName == "hooks/private" {
+		return nil, broker.Reject(message.NotAuthorized, "private topic")
+	}
+	pb.Body = append(pb.Body, []byte(" (checked)")...)
+	return pb, nil
+}
+func (h recordHooks) OnDeliver(info broker.ClientInfo, pb *message.Publish) {
+	h.record("deliver", info, pb.TopicName)
+}
+func (h recordHooks) OnAcked(info broker.ClientInfo, packetId uint16) {
+	h.record("acked", info, "")
+}
+func (h recordHooks) OnDisconnect(info broker.ClientInfo, reason message.ReasonCode) {
+	h.record("disconnect", info, reason.String())
+}
+func (h recordHooks) OnSessionExpired(info broker.ClientInfo) {
+	h.record("expired", info, "")
+}
+func (h recordHooks) OnWill(info broker.ClientInfo, pb *message.Publish) (*message.Publish, error) {
+	h.record("will", info, pb.TopicName)
+	return pb, nil
+}
+
+// Wait for the callback, events of other callbacks are skipped
+func expectEvent(t *testing.T, h recordHooks, name string) hookEvent {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case e := <-h.events:
+			if e.name == name {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("hook is not called: " + name)
+			return hookEvent{}
+		}
+	}
+}
+
+func connectWithUser(t *testing.T, addr, clientId, username string) (net.Conn, *message.ConnAck) {
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	cn := message.NewConnect()
+	cn.ProtocolName = "MQTT"
+	cn.ProtocolVersion = 5
+	cn.ClientId = clientId
+	cn.CleanStart = true
+	if username != "" {
+		cn.FlagUsername = true
+		cn.Username = username
+	}
+	assert.NoError(t, message.WriteFrame(conn, cn))
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	ack, err := message.ParseConnAck(frame, payload)
+	assert.NoError(t, err)
+	return conn, ack
+}
+
+func TestHooksRejectConnection(t *testing.T) {
+	h := recordHooks{events: make(chan hookEvent, 100)}
+	b := broker.NewBroker(":21291", broker.WithSysInterval(0), broker.WithHooks(h))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	// Reason code of RejectError is responded
+	conn, ack := connectWithUser(t, "localhost:21291", "refused", "")
+	conn.Close()
+	assert.Equal(t, message.ClientIdentifierNotValid, ack.ReasonCode)
+	assert.Equal(t, "refused", expectEvent(t, h, "connect").info.ClientId)
+
+	// Other errors are responded with the default reason code of the callback
+	conn, ack = connectWithUser(t, "localhost:21291", "intruder-client", "intruder")
+	conn.Close()
+	assert.Equal(t, message.BadUsernameOrPassword, ack.ReasonCode)
+	e := expectEvent(t, h, "authenticate")
+	assert.Equal(t, "intruder-client", e.info.ClientId)
+	assert.Equal(t, "intruder", e.info.Username)
+
+	conn, ack = connectWithUser(t, "localhost:21291", "member", "alice")
+	assert.Equal(t, message.Success, ack.ReasonCode)
+	e = expectEvent(t, h, "authenticate")
+	assert.Equal(t, "member", e.info.ClientId)
+	assert.Equal(t, "alice", e.info.Username)
+	assert.NotEmpty(t, e.info.RemoteAddr)
+	conn.Close()
+	e = expectEvent(t, h, "disconnect")
+	assert.Equal(t, "member", e.info.ClientId)
+	assert.Equal(t, "alice", e.info.Username)
+}
+
+func TestHooksInterceptPackets(t *testing.T) {
+	h := recordHooks{events: make(chan hookEvent, 100)}
+	b := broker.NewBroker(":21292", broker.WithSysInterval(0), broker.WithHooks(h))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.NewClient("mqtt://localhost:21292")
+	assert.NoError(t, c.Connect(context.Background(), client.WithClientId("hooked")))
+	e := expectEvent(t, h, "connect")
+	assert.Equal(t, "hooked", e.info.ClientId)
+
+	// Subscription is replaced by the hook
+	assert.NoError(t, c.Subscribe("alias/#", nil, client.WithQoS(message.QoS1)))
+	e = expectEvent(t, h, "subscribe")
+	assert.Equal(t, "hooked", e.info.ClientId)
+	assert.Equal(t, "alias/#", e.value)
+
+	// Message is modified by the hook, then delivered to the replaced subscription
+	assert.NoError(t, c.Publish("hooks/a", []byte("payload"), client.WithQoS(message.QoS1)))
+	e = expectEvent(t, h, "publish")
+	assert.Equal(t, "hooked", e.info.ClientId)
+	assert.Equal(t, "hooks/a", e.value)
+	pb := receiveMessage(t, c)
+	assert.Equal(t, "hooks/a", pb.TopicName)
+	assert.Equal(t, "payload (checked)", string(pb.Body))
+	assert.Equal(t, "hooks/a", expectEvent(t, h, "deliver").value)
+	assert.Equal(t, "hooked", expectEvent(t, h, "acked").info.ClientId)
+
+	// Rejected message is responded with the reason code of RejectError
+	err := c.Publish("hooks/private", []byte("secret"), client.WithQoS(message.QoS1))
+	if assert.IsType(t, &session.ReasonError{}, err) {
+		assert.Equal(t, message.NotAuthorized, err.(*session.ReasonError).Code)
+	}
+
+	_, err = c.Unsubscribe(context.Background(), "alias/#")
+	assert.NoError(t, err)
+	assert.Equal(t, "alias/#", expectEvent(t, h, "unsubscribe").value)
+
+	go c.Disconnect()
+	<-c.Closed
+	e = expectEvent(t, h, "disconnect")
+	assert.Equal(t, "hooked", e.info.ClientId)
+	assert.Equal(t, message.NormalDisconnection.String(), e.value)
+}
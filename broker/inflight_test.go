@@ -0,0 +1,55 @@
+package broker_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestPacketIdentifierPerSubscriber(t *testing.T) {
+	b := broker.NewBroker(":21221", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	sub := subscribeRaw(t, "localhost:21221", "inflight/#")
+	defer sub.Close()
+
+	pub, err := net.Dial("tcp", "localhost:21221")
+	assert.NoError(t, err)
+	defer pub.Close()
+	cn := message.NewConnect()
+	cn.ProtocolName = "MQTT"
+	cn.ProtocolVersion = 5
+	cn.ClientId = "raw-publisher"
+	assert.NoError(t, message.WriteFrame(pub, cn))
+	frame, _, err := message.ReceiveFrame(pub)
+	assert.NoError(t, err)
+	assert.Equal(t, message.CONNACK, frame.Type)
+
+	// Publisher uses the same packet identifier for both messages
+	ids := []uint16{}
+	for i := 0; i < 2; i++ {
+		pb := message.NewPublish(7, message.WithQoS(message.QoS1))
+		pb.TopicName = "inflight/foo"
+		pb.Body = []byte("message")
+		assert.NoError(t, message.WriteFrame(pub, pb))
+		frame, payload, err := message.ReceiveFrame(pub)
+		assert.NoError(t, err)
+		ack, err := message.ParsePubAck(frame, payload)
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(7), ack.PacketId)
+
+		frame, payload, err = message.ReceiveFrame(sub)
+		assert.NoError(t, err)
+		received, err := message.ParsePublish(frame, payload)
+		assert.NoError(t, err)
+		assert.NotEqual(t, uint16(0), received.PacketId)
+		ids = append(ids, received.PacketId)
+		assert.NoError(t, message.WriteFrame(sub, message.NewPubAck(received.PacketId)))
+	}
+	assert.NotEqual(t, ids[0], ids[1])
+}
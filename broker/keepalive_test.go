@@ -0,0 +1,90 @@
+package broker_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func connectRaw(t *testing.T, addr string, keepAlive uint16) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	cn := message.NewConnect()
+	cn.ProtocolName = "MQTT"
+	cn.ProtocolVersion = 5
+	cn.ClientId = "raw-client"
+	cn.KeepAlive = keepAlive
+	assert.NoError(t, message.WriteFrame(conn, cn))
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	ack, err := message.ParseConnAck(frame, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, message.Success, ack.ReasonCode)
+	return conn
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	b := broker.NewBroker(":21171", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	conn := connectRaw(t, "localhost:21171", 1)
+	defer conn.Close()
+
+	// Any packet extends keepalive
+	for i := 0; i < 3; i++ {
+		time.Sleep(800 * time.Millisecond)
+		pb := message.NewPublish(0, message.WithQoS(message.QoS0))
+		pb.TopicName = "foo/bar"
+		assert.NoError(t, message.WriteFrame(conn, pb))
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	dc, err := message.ParseDisconnect(frame, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, message.KeepAliveTimeout, dc.ReasonCode)
+	// One and a half times of keepalive is allowed
+	assert.True(t, time.Since(start) >= time.Second)
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	b := broker.NewBroker(":21172", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	conn := connectRaw(t, "localhost:21172", 0)
+	defer conn.Close()
+
+	// Broker never disconnects the client which disables keepalive
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := message.ReceiveFrame(conn)
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), b.Stats().Clients)
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	b := broker.NewBroker(":21173", broker.WithSysInterval(0), broker.WithServerKeepAlive(1))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.NewClient("mqtt://localhost:21173")
+	assert.NoError(t, c.Connect(context.Background(), client.WithKeepAlive(60)))
+	assert.Equal(t, uint16(1), c.ServerInfo.ServerKeepAlive)
+
+	// Client pings by negotiated keepalive, so the broker keeps connection
+	select {
+	case <-c.Closed:
+		t.Fatal("client is disconnected by keepalive timeout")
+	case <-time.After(3 * time.Second):
+	}
+	go c.Disconnect()
+	<-c.Closed
+}
@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Handler receives published message in-process. RETAIN flag reports the message was published as retained.
+// The message is shared with other subscribers without copying, so the handler must treat it as read-only.
+type Handler func(pb *message.Publish)
+
+// Subscribe topic filter in-process without network connection.
+// Returned function cancels the subscription.
+func (b *Broker) Subscribe(filter string, handler Handler) (func(), error) {
+	b.mu.Lock()
+	b.localId++
+	id := fmt.Sprintf("$local/%d", b.localId)
+	b.handlers[id] = handler
+	b.mu.Unlock()
+
+	if _, err := b.subscription.Subscribe(id, message.SubscribeTopic{
+		TopicName: filter,
+		QoS:       message.QoS2,
+	}); err != nil {
+		b.mu.Lock()
+		delete(b.handlers, id)
+		b.mu.Unlock()
+		return nil, errors.Wrap(err, "failed to subscribe: "+filter)
+	}
+	b.cluster.notifyFilters()
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+		b.subscription.UnsubscribeAll(id)
+		b.cluster.notifyFilters()
+	}, nil
+}
+
+// Publish message from the broker in-process.
+// QoS of the message is the maximum QoS for delivery, it's downgraded to the subscription's QoS.
+func (b *Broker) Publish(ctx context.Context, topic string, body []byte, opts ...PublishOption) error {
+	pb := message.NewPublish(0)
+	pb.TopicName = topic
+	pb.Body = body
+	for _, o := range opts {
+		switch o.name {
+		case nameQoS:
+			pb.SetQoS(o.value.(message.QoSLevel))
+		case nameRetain:
+			pb.SetRetain(true)
+		case nameProperty:
+			pb.Property = o.value.(*message.PublishProperty)
+		}
+	}
+	if pb.QoS > message.QoS0 {
+		pb.PacketId = b.nextPacketId()
+	}
+	if err := pb.Validate(); err != nil {
+		return errors.Wrap(err, "invalid publish message")
+	}
+
+	// Same as client publishing, empty retain message deletes retained message
+	if pb.RETAIN && len(pb.Body) == 0 {
+		b.deleteRetainMessage(pb.TopicName)
+		return nil
+	}
+	return b.publish(ctx, "", pb)
+}
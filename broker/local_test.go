@@ -0,0 +1,97 @@
+package broker_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestInProcessPublishSubscribe(t *testing.T) {
+	b := broker.NewBroker(":0")
+	received := []*message.Publish{}
+	cancel, err := b.Subscribe("foo/+", func(pb *message.Publish) {
+		received = append(received, pb)
+	})
+	assert.NoError(t, err)
+
+	err = b.Publish(context.Background(), "foo/bar", []byte("hello"), broker.WithQoS(message.QoS1))
+	assert.NoError(t, err)
+	err = b.Publish(context.Background(), "foo/bar/baz", []byte("not match"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, "foo/bar", received[0].TopicName)
+	assert.Equal(t, []byte("hello"), received[0].Body)
+	assert.Equal(t, message.QoS1, received[0].QoS)
+
+	cancel()
+	err = b.Publish(context.Background(), "foo/bar", []byte("after cancel"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(received))
+}
+
+func TestInProcessPublishRetainWithoutSubscribers(t *testing.T) {
+	b := broker.NewBroker(":21293", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	err := b.Publish(context.Background(), "foo/bar", []byte("retained"), broker.WithQoS(message.QoS1), broker.WithRetain())
+	assert.NoError(t, err)
+
+	// Retained message is delivered to the subscriber which subscribes later
+	c := client.NewClient("mqtt://localhost:21293")
+	assert.NoError(t, c.Connect(context.Background()))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+	assert.NoError(t, c.Subscribe("foo/bar", nil, client.WithQoS(message.QoS1)))
+	pb := receiveMessage(t, c)
+	assert.Equal(t, "foo/bar", pb.TopicName)
+	assert.Equal(t, "retained", string(pb.Body))
+	assert.True(t, pb.RETAIN)
+
+	received := []*message.Publish{}
+	_, err = b.Subscribe("foo/#", func(pb *message.Publish) {
+		received = append(received, pb)
+	})
+	assert.NoError(t, err)
+	err = b.Publish(context.Background(), "foo/bar", []byte("next"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(received))
+	assert.False(t, received[0].RETAIN)
+	assert.Equal(t, "next", string(receiveMessage(t, c).Body))
+
+	// Handler receives the message as retained, but RETAIN flag is cleared for the subscriber without RetainAsPublished
+	err = b.Publish(context.Background(), "foo/bar", []byte("again"), broker.WithQoS(message.QoS1), broker.WithRetain())
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(received)) {
+		assert.True(t, received[1].RETAIN)
+	}
+	pb = receiveMessage(t, c)
+	assert.Equal(t, "again", string(pb.Body))
+	assert.False(t, pb.RETAIN)
+}
+
+func TestInProcessHandlersShareMessage(t *testing.T) {
+	b := broker.NewBroker(":0")
+	received := []*message.Publish{}
+	for i := 0; i < 2; i++ {
+		_, err := b.Subscribe("foo/bar", func(pb *message.Publish) {
+			received = append(received, pb)
+		})
+		assert.NoError(t, err)
+	}
+	err := b.Publish(context.Background(), "foo/bar", []byte("hello"), broker.WithRetain())
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(received)) {
+		// Message isn't copied for each handler
+		assert.True(t, received[0] == received[1])
+		assert.True(t, received[0].RETAIN)
+		assert.Equal(t, []byte("hello"), received[0].Body)
+	}
+}
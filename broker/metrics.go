@@ -0,0 +1,178 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Upper bounds of fan-out latency histogram in seconds
+var fanoutBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type histogram struct {
+	buckets []float64
+	counts  []int64
+	sum     float64
+	count   int64
+}
+
+func newHistogram(buckets []float64) histogram {
+	return histogram{
+		buckets: buckets,
+		counts:  make([]int64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type reasonCodeKey struct {
+	packet message.MessageType
+	code   message.ReasonCode
+}
+
+func (s *stats) packetReceived(mt message.MessageType) {
+	if int(mt) < len(s.packetsReceived) {
+		atomic.AddInt64(&s.packetsReceived[mt], 1)
+	}
+}
+
+func (s *stats) packetSent(mt message.MessageType) {
+	if int(mt) < len(s.packetsSent) {
+		atomic.AddInt64(&s.packetsSent[mt], 1)
+	}
+}
+
+// Count reason code which the broker sent or received in the packet
+func (s *stats) reasonCode(packet message.MessageType, code message.ReasonCode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reasonCodes[reasonCodeKey{packet: packet, code: code}]++
+}
+
+func (s *stats) observeFanout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fanout.observe(d.Seconds())
+}
+
+func (s *stats) observeDeliver(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliver.observe(d.Seconds())
+}
+
+// MetricsHandler returns http.Handler which serves broker metrics in Prometheus text format
+func (b *Broker) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(b.metrics())
+	})
+}
+
+func (b *Broker) metrics() []byte {
+	var buf bytes.Buffer
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	st := b.Stats()
+
+	metric("gqtt_connections", "gauge", "Number of connected clients.")
+	fmt.Fprintf(&buf, "gqtt_connections %d\n", st.Clients)
+	metric("gqtt_connections_total", "counter", "Total number of accepted connections.")
+	fmt.Fprintf(&buf, "gqtt_connections_total %d\n", atomic.LoadInt64(&b.stats.connections))
+	metric("gqtt_auth_failures_total", "counter", "Total number of authentication failures.")
+	fmt.Fprintf(&buf, "gqtt_auth_failures_total %d\n", atomic.LoadInt64(&b.stats.authFailures))
+
+	metric("gqtt_packets_received_total", "counter", "Total number of packets received by type.")
+	for mt := message.CONNECT; mt <= message.AUTH; mt++ {
+		fmt.Fprintf(&buf, "gqtt_packets_received_total{type=%q} %d\n", mt.String(), atomic.LoadInt64(&b.stats.packetsReceived[mt]))
+	}
+	metric("gqtt_packets_sent_total", "counter", "Total number of packets sent by type.")
+	for mt := message.CONNECT; mt <= message.AUTH; mt++ {
+		fmt.Fprintf(&buf, "gqtt_packets_sent_total{type=%q} %d\n", mt.String(), atomic.LoadInt64(&b.stats.packetsSent[mt]))
+	}
+
+	metric("gqtt_messages_received_total", "counter", "Total number of PUBLISH which clients sent.")
+	fmt.Fprintf(&buf, "gqtt_messages_received_total %d\n", st.MessagesReceived)
+	metric("gqtt_messages_sent_total", "counter", "Total number of PUBLISH which the broker delivered.")
+	fmt.Fprintf(&buf, "gqtt_messages_sent_total %d\n", st.MessagesSent)
+	metric("gqtt_messages_dropped_total", "counter", "Total number of messages which were not delivered.")
+	fmt.Fprintf(&buf, "gqtt_messages_dropped_total %d\n", st.Dropped)
+	metric("gqtt_bytes_received_total", "counter", "Total bytes received.")
+	fmt.Fprintf(&buf, "gqtt_bytes_received_total %d\n", st.BytesReceived)
+	metric("gqtt_bytes_sent_total", "counter", "Total bytes sent.")
+	fmt.Fprintf(&buf, "gqtt_bytes_sent_total %d\n", st.BytesSent)
+
+	metric("gqtt_sessions", "gauge", "Number of client sessions.")
+	fmt.Fprintf(&buf, "gqtt_sessions %d\n", st.Clients)
+	metric("gqtt_subscriptions", "gauge", "Number of subscriptions.")
+	fmt.Fprintf(&buf, "gqtt_subscriptions %d\n", st.Subscriptions)
+	metric("gqtt_retained_messages", "gauge", "Number of retain messages.")
+	fmt.Fprintf(&buf, "gqtt_retained_messages %d\n", st.Retained)
+	metric("gqtt_inflight_messages", "gauge", "Number of QoS1 and QoS2 messages waiting for acknowledgment.")
+	fmt.Fprintf(&buf, "gqtt_inflight_messages %d\n", st.InFlight)
+
+	metric("gqtt_queue_depth", "gauge", "Number of messages in the queue.")
+	fmt.Fprintf(&buf, "gqtt_queue_depth{queue=\"events\"} %d\n", len(b.MessageEvent))
+	fmt.Fprintf(&buf, "gqtt_queue_depth{queue=\"clients\"} %d\n", st.Queued)
+	for _, br := range b.bridges {
+		fmt.Fprintf(&buf, "gqtt_queue_depth{queue=%q} %d\n", "bridge/"+br.config.Name, len(br.outbound))
+	}
+	for name, depth := range b.cluster.queueDepths() {
+		fmt.Fprintf(&buf, "gqtt_queue_depth{queue=%q} %d\n", "cluster/"+name, depth)
+	}
+	metric("gqtt_events_dropped_total", "counter", "Total number of events which were dropped because MessageEvent channel is full.")
+	fmt.Fprintf(&buf, "gqtt_events_dropped_total %d\n", atomic.LoadInt64(&b.stats.eventsDropped))
+
+	b.stats.mu.Lock()
+	defer b.stats.mu.Unlock()
+
+	metric("gqtt_reason_codes_total", "counter", "Total number of reason codes by packet type.")
+	keys := []reasonCodeKey{}
+	for k := range b.stats.reasonCodes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].packet != keys[j].packet {
+			return keys[i].packet < keys[j].packet
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "gqtt_reason_codes_total{packet=%q,code=%q} %d\n", k.packet.String(), k.code.String(), b.stats.reasonCodes[k])
+	}
+
+	metric("gqtt_publish_fanout_seconds", "histogram", "Latency of delivering PUBLISH to all subscribers.")
+	h := b.stats.fanout
+	for i, bound := range h.buckets {
+		fmt.Fprintf(&buf, "gqtt_publish_fanout_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(&buf, "gqtt_publish_fanout_seconds_bucket{le=\"+Inf\"} %d\n", h.count)
+	fmt.Fprintf(&buf, "gqtt_publish_fanout_seconds_sum %s\n", strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(&buf, "gqtt_publish_fanout_seconds_count %d\n", h.count)
+
+	metric("gqtt_publish_deliver_seconds", "histogram", "Latency from publishing to delivering PUBLISH to the subscriber, including acknowledgment of QoS1 and QoS2.")
+	h = b.stats.deliver
+	for i, bound := range h.buckets {
+		fmt.Fprintf(&buf, "gqtt_publish_deliver_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(&buf, "gqtt_publish_deliver_seconds_bucket{le=\"+Inf\"} %d\n", h.count)
+	fmt.Fprintf(&buf, "gqtt_publish_deliver_seconds_sum %s\n", strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(&buf, "gqtt_publish_deliver_seconds_count %d\n", h.count)
+
+	return buf.Bytes()
+}
@@ -0,0 +1,52 @@
+package broker_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	b := broker.NewBroker(":21131", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.NewClient("mqtt://localhost:21131")
+	assert.NoError(t, c.Connect(context.Background()))
+	assert.NoError(t, c.Subscribe("foo/bar", nil, client.WithQoS(message.QoS1)))
+	assert.NoError(t, b.Publish(context.Background(), "foo/bar", []byte("hello")))
+	<-c.Message
+	time.Sleep(100 * time.Millisecond)
+
+	server := httptest.NewServer(b.MetricsHandler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	metrics := string(body)
+
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	assert.Contains(t, metrics, "# TYPE gqtt_connections gauge\n")
+	assert.Contains(t, metrics, "gqtt_connections 1\n")
+	assert.Contains(t, metrics, `gqtt_packets_received_total{type="CONNECT"} 1`)
+	assert.Contains(t, metrics, `gqtt_packets_received_total{type="SUBSCRIBE"} 1`)
+	assert.Contains(t, metrics, `gqtt_packets_sent_total{type="PUBLISH"} 1`)
+	assert.Contains(t, metrics, `gqtt_reason_codes_total{packet="CONNACK",code="Success"} 1`)
+	assert.Contains(t, metrics, `gqtt_reason_codes_total{packet="SUBACK",code="GrantedQoS1"} 1`)
+	assert.Contains(t, metrics, `gqtt_publish_fanout_seconds_count 1`)
+	assert.Contains(t, metrics, `gqtt_publish_fanout_seconds_bucket{le="+Inf"} 1`)
+	assert.Contains(t, metrics, `gqtt_queue_depth{queue="events"}`)
+	assert.Contains(t, metrics, "gqtt_subscriptions 1\n")
+
+	go c.Disconnect()
+	<-c.Closed
+}
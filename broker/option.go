@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/ysugimoto/gqtt/message"
+)
+
+type optionName string
+
+const (
+	nameResponseInformation optionName = "responseInformation"
+	nameHooks               optionName = "hooks"
+	nameBridge              optionName = "bridge"
+	nameCluster             optionName = "cluster"
+	nameSysInterval         optionName = "sysInterval"
+	nameRateLimit           optionName = "rateLimit"
+	nameMaxConnections      optionName = "maxConnections"
+	nameBans                optionName = "bans"
+	nameAllowedNetworks     optionName = "allowedNetworks"
+	nameServerKeepAlive     optionName = "serverKeepAlive"
+	nameSlowConsumer        optionName = "slowConsumer"
+
+	nameQoS      optionName = "qos"
+	nameRetain   optionName = "retain"
+	nameProperty optionName = "property"
+)
+
+type BrokerOption struct {
+	name  optionName
+	value interface{}
+}
+
+// Set prefix of ResponseInformation which is returned to the client that requests response information.
+// The client will use "[prefix]/[client id]" as its response topic.
+func WithResponseInformation(prefix string) BrokerOption {
+	return BrokerOption{
+		name:  nameResponseInformation,
+		value: prefix,
+	}
+}
+
+// Set hooks which receive broker lifecycle events
+func WithHooks(hooks Hooks) BrokerOption {
+	return BrokerOption{
+		name:  nameHooks,
+		value: hooks,
+	}
+}
+
+// Add bridge to the remote broker. Bridges start running in ListenAndServe
+func WithBridge(config BridgeConfig) BrokerOption {
+	return BrokerOption{
+		name:  nameBridge,
+		value: config,
+	}
+}
+
+// Join the cluster. Cluster starts running in ListenAndServe
+func WithCluster(config ClusterConfig) BrokerOption {
+	return BrokerOption{
+		name:  nameCluster,
+		value: config,
+	}
+}
+
+// Set interval of publishing statistics to $SYS topics, default is 10 seconds.
+// Zero interval disables $SYS topics
+func WithSysInterval(interval time.Duration) BrokerOption {
+	return BrokerOption{
+		name:  nameSysInterval,
+		value: interval,
+	}
+}
+
+// Limit rate of messages and connections
+func WithRateLimit(config RateLimitConfig) BrokerOption {
+	return BrokerOption{
+		name:  nameRateLimit,
+		value: config,
+	}
+}
+
+// Override client's keepalive by ServerKeepAlive property in CONNACK
+func WithServerKeepAlive(seconds uint16) BrokerOption {
+	return BrokerOption{
+		name:  nameServerKeepAlive,
+		value: seconds,
+	}
+}
+
+// Limit number of concurrent connections. Exceeded connection is closed before CONNECT is read
+func WithMaxConnections(n int) BrokerOption {
+	return BrokerOption{
+		name:  nameMaxConnections,
+		value: n,
+	}
+}
+
+// Set initial ban list. Bans can be added at runtime by Broker.Ban()
+func WithBans(bans ...Ban) BrokerOption {
+	return BrokerOption{
+		name:  nameBans,
+		value: bans,
+	}
+}
+
+// Accept connections only from the IP addresses or CIDRs
+func WithAllowedNetworks(cidrs ...string) BrokerOption {
+	return BrokerOption{
+		name:  nameAllowedNetworks,
+		value: cidrs,
+	}
+}
+
+// Set delivery queue size and policies for slow subscribers
+func WithSlowConsumer(config SlowConsumerConfig) BrokerOption {
+	return BrokerOption{
+		name:  nameSlowConsumer,
+		value: config,
+	}
+}
+
+// PublishOption is an option for in-process publishing
+type PublishOption struct {
+	name  optionName
+	value interface{}
+}
+
+func WithQoS(qos message.QoSLevel) PublishOption {
+	return PublishOption{
+		name:  nameQoS,
+		value: qos,
+	}
+}
+
+func WithRetain() PublishOption {
+	return PublishOption{
+		name:  nameRetain,
+		value: true,
+	}
+}
+
+func WithProperty(property *message.PublishProperty) PublishOption {
+	return PublishOption{
+		name:  nameProperty,
+		value: property,
+	}
+}
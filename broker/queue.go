@@ -0,0 +1,218 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+// SlowConsumerPolicy decides how to handle the message when the delivery queue of the subscriber is full.
+// Policies can be combined, and the message which isn't handled by any policy is dropped.
+type SlowConsumerPolicy uint8
+
+const (
+	// Drop QoS0 message when the queue is full
+	DropQoS0 SlowConsumerPolicy = 1 << iota
+	// Disconnect the subscriber with QuotaExceeded when the backlog continues for DisconnectAfter
+	DisconnectSlow
+	// Keep the message in the session when the queue is full, it is delivered after the queued messages.
+	// QoS1/QoS2 messages which are queued or spilled are kept with the stored session on disconnection,
+	// and delivered when the session is resumed
+	SpillToSession
+)
+
+const (
+	defaultDeliveryQueueSize = 1000
+	defaultSpillSize         = 10000
+	defaultSlowPolicy        = DropQoS0 | SpillToSession
+)
+
+// SlowConsumerConfig is the setting of delivery queue for each subscriber.
+// Publishing never waits for subscribers, the message which can't be queued is handled by the policy.
+type SlowConsumerConfig struct {
+	// Number of messages which are queued for each subscriber, default is 1000
+	QueueSize int
+	// Combination of policies, default is DropQoS0|SpillToSession
+	Policy SlowConsumerPolicy
+	// Duration of backlog until the subscriber is disconnected on DisconnectSlow policy.
+	// Backlog starts when the queue is full, and ends when the subscriber takes all queued and spilled messages.
+	// The subscriber is also disconnected when it takes the message which has waited longer than this duration
+	DisconnectAfter time.Duration
+	// Maximum number of spilled messages on SpillToSession policy, default is 10000
+	SpillSize int
+}
+
+func (c SlowConsumerConfig) withDefaults() SlowConsumerConfig {
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultDeliveryQueueSize
+	}
+	if c.Policy == 0 {
+		c.Policy = defaultSlowPolicy
+	}
+	if c.SpillSize <= 0 {
+		c.SpillSize = defaultSpillSize
+	}
+	return c
+}
+
+type delivery struct {
+	pb *message.Publish
+	// Time when the message was queued, in order to observe publish-to-deliver latency
+	at time.Time
+}
+
+// deliveryQueue is the bounded queue of messages for the subscriber.
+// Broker pushes messages without blocking, and the client goroutine pops them one by one.
+type deliveryQueue struct {
+	ch      chan delivery
+	config  SlowConsumerConfig
+	session *session.Session
+	// Called when the backlog continues for DisconnectAfter
+	onSlow  func()
+	backlog *time.Timer
+	// Messages which have been kept before the connection are waited from this time
+	started time.Time
+	// Set when the connection is closed, then messages are kept in the session instead of the queue
+	closed bool
+	mu     sync.Mutex
+}
+
+func newDeliveryQueue(config SlowConsumerConfig, s *session.Session, onSlow func()) *deliveryQueue {
+	return &deliveryQueue{
+		ch:      make(chan delivery, config.QueueSize),
+		config:  config,
+		session: s,
+		onSlow:  onSlow,
+		started: time.Now(),
+	}
+}
+
+// Queue the message without blocking, and returns false if the message is dropped
+func (q *deliveryQueue) push(pb *message.Publish) bool {
+	d := delivery{pb: pb, at: time.Now()}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// While messages are spilled, following messages are also spilled in order to keep the order
+	if !q.closed && q.session.Spilled() == 0 {
+		select {
+		case q.ch <- d:
+			return true
+		default:
+		}
+	}
+
+	q.startBacklog()
+	if pb.QoS == message.QoS0 && q.config.Policy&DropQoS0 > 0 {
+		return false
+	}
+	if q.config.Policy&SpillToSession > 0 && q.session.Spilled() < q.config.SpillSize {
+		q.session.Spill(pb, d.at)
+		return true
+	}
+	return false
+}
+
+// Take the next message, blocks until the message is queued or done is closed.
+// Messages may be spilled to the resumed session by the previous connection, then they are moved to the queue
+func (q *deliveryQueue) pop(done <-chan struct{}) (delivery, bool) {
+	for {
+		select {
+		case <-done:
+			return delivery{}, false
+		case d := <-q.ch:
+			q.refill()
+			q.checkWaiting(d)
+			return d, true
+		case <-q.session.SpillReady():
+			q.refill()
+		}
+	}
+}
+
+// Move spilled messages to the queue, and finish backlog when the subscriber has taken all messages
+func (q *deliveryQueue) refill() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	for len(q.ch) < cap(q.ch) {
+		pb, at, ok := q.session.Unspill()
+		if !ok {
+			break
+		}
+		q.ch <- delivery{pb: pb, at: at}
+	}
+	if len(q.ch) == 0 && q.session.Spilled() == 0 && q.backlog != nil {
+		q.backlog.Stop()
+		q.backlog = nil
+	}
+}
+
+func (q *deliveryQueue) startBacklog() {
+	if q.backlog != nil || !q.disconnectSlow() {
+		return
+	}
+	q.backlog = time.AfterFunc(q.config.DisconnectAfter, q.onSlow)
+}
+
+// Disconnect the subscriber which takes the message too late, even if it keeps taking messages
+func (q *deliveryQueue) checkWaiting(d delivery) {
+	if !q.disconnectSlow() {
+		return
+	}
+	at := d.at
+	if at.Before(q.started) {
+		at = q.started
+	}
+	if time.Since(at) > q.config.DisconnectAfter {
+		go q.onSlow()
+	}
+}
+
+func (q *deliveryQueue) disconnectSlow() bool {
+	return q.config.Policy&DisconnectSlow > 0 && q.config.DisconnectAfter > 0
+}
+
+// Number of messages which are waiting for delivery, including spilled messages
+func (q *deliveryQueue) depth() int {
+	return len(q.ch) + q.session.Spilled()
+}
+
+// Stop the queue and backlog timer on closing connection, and returns number of dropped messages.
+// On SpillToSession policy, queued QoS1/QoS2 messages are kept in the session ahead of spilled messages
+// in order to deliver them on session resumption. Other messages are dropped
+func (q *deliveryQueue) close() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	if q.backlog != nil {
+		q.backlog.Stop()
+		q.backlog = nil
+	}
+	keep := q.config.Policy&SpillToSession > 0
+	kept := []delivery{}
+	n := 0
+	for len(q.ch) > 0 {
+		d := <-q.ch
+		if keep && d.pb.QoS > message.QoS0 {
+			kept = append(kept, d)
+			continue
+		}
+		n++
+	}
+	for {
+		pb, at, ok := q.session.Unspill()
+		if !ok {
+			break
+		}
+		kept = append(kept, delivery{pb: pb, at: at})
+	}
+	for _, d := range kept {
+		q.session.Spill(d.pb, d.at)
+	}
+	return n
+}
@@ -0,0 +1,168 @@
+package broker_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Connect and subscribe with raw connection which never acknowledges PUBLISH
+func subscribeRaw(t *testing.T, addr, filter string) net.Conn {
+	conn := connectRaw(t, addr, 0)
+	ss := message.NewSubscribe()
+	ss.PacketId = 1
+	ss.AddTopic(message.SubscribeTopic{TopicName: filter, QoS: message.QoS1})
+	assert.NoError(t, message.WriteFrame(conn, ss))
+	frame, _, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, message.SUBACK, frame.Type)
+	return conn
+}
+
+func TestSlowConsumerSpill(t *testing.T) {
+	b := broker.NewBroker(":21211", broker.WithSysInterval(0), broker.WithSlowConsumer(broker.SlowConsumerConfig{
+		QueueSize: 2,
+		Policy:    broker.SpillToSession,
+		SpillSize: 3,
+	}))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	conn := subscribeRaw(t, "localhost:21211", "slow/#")
+	defer conn.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, b.Publish(ctx, "slow/foo", []byte("0"), broker.WithQoS(message.QoS1)))
+	// Subscriber receives the first message, but never acknowledges it
+	frame, _, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, message.PUBLISH, frame.Type)
+
+	start := time.Now()
+	for i := 1; i < 10; i++ {
+		assert.NoError(t, b.Publish(ctx, "slow/foo", []byte("message"), broker.WithQoS(message.QoS1)))
+	}
+	assert.True(t, time.Since(start) < time.Second, "publish must not wait for slow subscriber")
+
+	// 2 messages are queued, 3 messages are spilled and the others are dropped
+	st := b.Stats()
+	assert.Equal(t, int64(5), st.Queued)
+	assert.Equal(t, int64(4), st.Dropped)
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	b := broker.NewBroker(":21212", broker.WithSysInterval(0), broker.WithSlowConsumer(broker.SlowConsumerConfig{
+		QueueSize:       1,
+		Policy:          broker.DropQoS0 | broker.DisconnectSlow,
+		DisconnectAfter: 300 * time.Millisecond,
+	}))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	conn := subscribeRaw(t, "localhost:21212", "slow/#")
+	defer conn.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, b.Publish(ctx, "slow/foo", []byte("0"), broker.WithQoS(message.QoS1)))
+	frame, _, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, message.PUBLISH, frame.Type)
+
+	// Fill the queue, then the backlog starts
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, b.Publish(ctx, "slow/foo", []byte("message"), broker.WithQoS(message.QoS0)))
+	}
+	start := time.Now()
+	assert.Equal(t, message.QuotaExceeded, receiveDisconnect(t, conn).ReasonCode)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestSlowConsumerDisconnectWhileTakingMessages(t *testing.T) {
+	b := broker.NewBroker(":21214", broker.WithSysInterval(0), broker.WithSlowConsumer(broker.SlowConsumerConfig{
+		QueueSize:       2,
+		Policy:          broker.DisconnectSlow,
+		DisconnectAfter: 500 * time.Millisecond,
+	}))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	conn := subscribeRaw(t, "localhost:21214", "slow/#")
+	defer conn.Close()
+
+	// Messages are published faster than the subscriber takes them
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			b.Publish(ctx, "slow/foo", []byte("message"), broker.WithQoS(message.QoS1))
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	// Subscriber acknowledges a message every 100 milliseconds, it isn't stalled
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		frame, payload, err := message.ReceiveFrame(conn)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if frame.Type == message.DISCONNECT {
+			dc, err := message.ParseDisconnect(frame, payload)
+			assert.NoError(t, err)
+			assert.Equal(t, message.QuotaExceeded, dc.ReasonCode)
+			break
+		}
+		pb, err := message.ParsePublish(frame, payload)
+		assert.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, message.WriteFrame(conn, message.NewPubAck(pb.PacketId)))
+	}
+	assert.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestSlowConsumerSpillKeptWithSession(t *testing.T) {
+	b := broker.NewBroker(":21213", broker.WithSysInterval(0), broker.WithSlowConsumer(broker.SlowConsumerConfig{
+		QueueSize: 2,
+		Policy:    broker.SpillToSession,
+	}))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	conn := connectSession(t, "localhost:21213", "spill-session")
+	ss := message.NewSubscribe()
+	ss.PacketId = 1
+	ss.AddTopic(message.SubscribeTopic{TopicName: "slow/#", QoS: message.QoS1})
+	assert.NoError(t, message.WriteFrame(conn, ss))
+	frame, _, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, message.SUBACK, frame.Type)
+
+	ctx := context.Background()
+	assert.NoError(t, b.Publish(ctx, "slow/foo", []byte("0"), broker.WithQoS(message.QoS1)))
+	assert.Equal(t, "0", string(receivePublish(t, conn).Body))
+	// 2 messages are queued and 3 messages are spilled while the first message isn't acknowledged
+	for _, body := range []string{"1", "2", "3", "4", "5"} {
+		assert.NoError(t, b.Publish(ctx, "slow/foo", []byte(body), broker.WithQoS(message.QoS1)))
+	}
+	assert.Equal(t, int64(5), b.Stats().Queued)
+	conn.Close()
+	waitSubscriptions(t, b, 0)
+
+	// Queued and spilled messages are delivered in order after the in-flight message on resumption
+	conn, ack := connectSessionAck(t, "localhost:21213", "spill-session", false)
+	defer conn.Close()
+	assert.True(t, ack.SessionPresentFlag)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for _, body := range []string{"0", "1", "2", "3", "4", "5"} {
+		pb := receivePublish(t, conn)
+		assert.Equal(t, body, string(pb.Body))
+		assert.NoError(t, message.WriteFrame(conn, message.NewPubAck(pb.PacketId)))
+	}
+	assert.Equal(t, int64(0), b.Stats().Dropped)
+}
@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Maximum number of buckets which are kept for usernames and IP addresses before pruning
+const maxRateLimitBuckets = 10000
+
+// RateLimit is the token bucket setting. Zero Rate means unlimited
+type RateLimit struct {
+	// Tokens which are added per second
+	Rate float64
+	// Maximum tokens, default is the same as Rate
+	Burst float64
+}
+
+// RateLimitConfig is the setting of rate limits.
+// Exceeding messages/sec disconnects the client with MessageRateTooHigh,
+// exceeding bytes/sec rejects the message with QuotaExceeded on PUBACK/PUBREC (QoS0 message is dropped),
+// and exceeding connection attempts responds CONNACK with ConnectionRateExceeded.
+type RateLimitConfig struct {
+	// Number of PUBLISH per second for each client
+	ClientMessages RateLimit
+	// Bytes of PUBLISH per second for each client
+	ClientBytes RateLimit
+	// Number of PUBLISH per second for each username, shared with all clients which use the same username
+	UsernameMessages RateLimit
+	// Bytes of PUBLISH per second for each username
+	UsernameBytes RateLimit
+	// Number of connection attempts per second for each IP address
+	ConnectionsPerIP RateLimit
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// Create token bucket, or nil if the limit is unlimited
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.Rate
+	}
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (t *tokenBucket) refill(now time.Time) {
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+}
+
+// Consume tokens and report it's allowed or not. nil bucket always allows
+func (t *tokenBucket) allow(n float64) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.refill(time.Now())
+	if t.tokens < n {
+		return false
+	}
+	t.tokens -= n
+	return true
+}
+
+// Check the bucket is full, it means the bucket is the same as new one
+func (t *tokenBucket) full() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.refill(time.Now())
+	return t.tokens >= t.burst
+}
+
+// bucketSet holds token buckets by key like username or IP address
+type bucketSet struct {
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+	mu      sync.Mutex
+}
+
+func newBucketSet(limit RateLimit) *bucketSet {
+	return &bucketSet{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (s *bucketSet) allow(key string, n float64) bool {
+	if s.limit.Rate <= 0 || key == "" {
+		return true
+	}
+	s.mu.Lock()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= maxRateLimitBuckets {
+			s.prune()
+		}
+		bucket = newTokenBucket(s.limit)
+		s.buckets[key] = bucket
+	}
+	s.mu.Unlock()
+	return bucket.allow(n)
+}
+
+// Remove full buckets because they can be created again
+func (s *bucketSet) prune() {
+	for key, bucket := range s.buckets {
+		if bucket.full() {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+type rateLimiter struct {
+	config           RateLimitConfig
+	usernameMessages *bucketSet
+	usernameBytes    *bucketSet
+	connections      *bucketSet
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		config:           config,
+		usernameMessages: newBucketSet(config.UsernameMessages),
+		usernameBytes:    newBucketSet(config.UsernameBytes),
+		connections:      newBucketSet(config.ConnectionsPerIP),
+	}
+}
+
+// Check connection attempt from the address
+func (r *rateLimiter) allowConnection(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return r.connections.allow(host, 1)
+}
+
+// Check PUBLISH from the client, and return reason code if it exceeds the limit
+func (c *Client) limitPublish(size uint64) message.ReasonCode {
+	r := c.broker.rateLimiter
+	username := c.info.Username
+	if !c.messageLimit.allow(1) || !r.usernameMessages.allow(username, 1) {
+		return message.MessageRateTooHigh
+	}
+	if !c.byteLimit.allow(float64(size)) || !r.usernameBytes.allow(username, float64(size)) {
+		return message.QuotaExceeded
+	}
+	return message.Success
+}
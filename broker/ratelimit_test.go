@@ -0,0 +1,83 @@
+package broker_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+func TestRateLimitConnectionsPerIP(t *testing.T) {
+	b := broker.NewBroker(":21151", broker.WithSysInterval(0), broker.WithRateLimit(broker.RateLimitConfig{
+		ConnectionsPerIP: broker.RateLimit{Rate: 0.01, Burst: 1},
+	}))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	first := client.NewClient("mqtt://localhost:21151")
+	assert.NoError(t, first.Connect(context.Background()))
+	defer func() {
+		go first.Disconnect()
+		<-first.Closed
+	}()
+
+	second := client.NewClient("mqtt://localhost:21151")
+	assert.Error(t, second.Connect(context.Background()))
+}
+
+func TestRateLimitClientMessages(t *testing.T) {
+	b := broker.NewBroker(":21152", broker.WithSysInterval(0), broker.WithRateLimit(broker.RateLimitConfig{
+		ClientMessages: broker.RateLimit{Rate: 0.01, Burst: 2},
+	}))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.NewClient("mqtt://localhost:21152")
+	assert.NoError(t, c.Connect(context.Background()))
+	for i := 0; i < 3; i++ {
+		c.Publish("foo/bar", []byte("flood"))
+	}
+	select {
+	case <-c.Closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("client is not disconnected")
+	}
+	assert.Equal(t, int64(1), b.Stats().Dropped)
+}
+
+func TestRateLimitClientBytes(t *testing.T) {
+	b := broker.NewBroker(":21153", broker.WithSysInterval(0), broker.WithRateLimit(broker.RateLimitConfig{
+		ClientBytes: broker.RateLimit{Rate: 0.01, Burst: 50},
+	}))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	received := make(chan *message.Publish, 10)
+	stop, err := b.Subscribe("foo/#", func(pb *message.Publish) {
+		received <- pb
+	})
+	assert.NoError(t, err)
+	defer stop()
+
+	c := client.NewClient("mqtt://localhost:21153")
+	assert.NoError(t, c.Connect(context.Background()))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+	assert.NoError(t, c.Publish("foo/small", []byte("ok"), client.WithQoS(message.QoS1)))
+	err = c.Publish("foo/large", make([]byte, 100), client.WithQoS(message.QoS1))
+	if assert.IsType(t, &session.ReasonError{}, err) {
+		assert.Equal(t, message.QuotaExceeded, err.(*session.ReasonError).Code)
+	}
+
+	assert.Equal(t, "foo/small", receiveTopic(t, received))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(received))
+	assert.Equal(t, int64(1), b.Stats().Dropped)
+}
@@ -0,0 +1,251 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+// Session expiry interval which means the session never expires
+const sessionNeverExpire = 0xFFFFFFFF
+
+// Session state of disconnected client, which is resumed by the next connection until it expires.
+// Subscriptions are restored on resumption, but messages which are published while disconnected aren't queued
+type storedSession struct {
+	info          ClientInfo
+	session       *session.Session
+	subscriptions []message.SubscribeTopic
+	expiry        *time.Timer
+}
+
+// Duration to keep the session after the connection is closed, and false if the session ends with the connection.
+// v3.1.1 client keeps the session with CleanSession=0, and v5 client keeps it for SessionExpiryInterval
+func sessionExpiry(info message.Connect) (time.Duration, bool) {
+	if info.ProtocolVersion != message.Version5 {
+		return 0, !info.CleanStart
+	}
+	if info.Property == nil || info.Property.SessionExpiryInterval == 0 {
+		return 0, false
+	}
+	if info.Property.SessionExpiryInterval == sessionNeverExpire {
+		return 0, true
+	}
+	return time.Duration(info.Property.SessionExpiryInterval) * time.Second, true
+}
+
+// Keep the session and subscriptions of closed client, and report the session is kept or not
+func (b *Broker) keepSession(client *Client, subscriptions []message.SubscribeTopic) bool {
+	expiry, ok := sessionExpiry(client.info)
+	if !ok {
+		return false
+	}
+	stored := &storedSession{
+		info:          client.Info(),
+		session:       client.session,
+		subscriptions: subscriptions,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessions[client.Id()] = stored
+	if expiry > 0 {
+		stored.expiry = time.AfterFunc(expiry, func() {
+			b.mu.Lock()
+			current, ok := b.sessions[stored.info.ClientId]
+			if ok && current == stored {
+				delete(b.sessions, stored.info.ClientId)
+			}
+			b.mu.Unlock()
+			if ok && current == stored {
+				log.Debug("session expired: ", stored.info.ClientId)
+				b.hooks.OnSessionExpired(stored.info)
+			}
+		})
+	}
+	return true
+}
+
+// Resume the session from connected client or stored session which has the same client identifier.
+// CleanStart discards the previous session, and then the client information of discarded session is returned.
+// Must be called with lock of broker
+func (b *Broker) resumeSession(client *Client, old *Client) *ClientInfo {
+	stored, ok := b.sessions[client.Id()]
+	if ok {
+		delete(b.sessions, client.Id())
+		if stored.expiry != nil {
+			stored.expiry.Stop()
+		}
+	}
+	switch {
+	case client.info.CleanStart && old != nil:
+		info := old.Info()
+		return &info
+	case client.info.CleanStart && ok:
+		return &stored.info
+	case old != nil:
+		client.session.Takeover(old.session)
+	case ok:
+		log.Debug("session resumed for client: ", client.Id())
+		client.session.Takeover(stored.session)
+		for _, t := range stored.subscriptions {
+			if _, err := b.subscription.Subscribe(client.Id(), t); err != nil {
+				log.Debug("failed to restore subscription: ", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Check the client resumes existing session, which is reported by SessionPresent flag of CONNACK
+func (b *Broker) sessionPresent(cn *message.Connect) bool {
+	if cn.CleanStart {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.clients[cn.ClientId]; ok {
+		return true
+	}
+	_, ok := b.sessions[cn.ClientId]
+	return ok
+}
+
+// Remove the session of the client which has connected to another node of the cluster, and close the connection.
+// When resume is true, state of the session is returned in order to move it to the node, otherwise the session is discarded
+func (b *Broker) handoverSession(clientId string, resume bool) *sessionState {
+	b.mu.Lock()
+	var (
+		info          *ClientInfo
+		sess          *session.Session
+		subscriptions []message.SubscribeTopic
+	)
+	client, connected := b.clients[clientId]
+	if connected {
+		// Removed client isn't kept as stored session on closing
+		delete(b.clients, clientId)
+		i := client.Info()
+		info = &i
+		sess = client.session
+		subscriptions = b.subscription.ClientSubscriptions(clientId)
+	}
+	if stored, ok := b.sessions[clientId]; ok {
+		delete(b.sessions, clientId)
+		if stored.expiry != nil {
+			stored.expiry.Stop()
+		}
+		if !connected {
+			info = &stored.info
+			sess = stored.session
+			subscriptions = stored.subscriptions
+		}
+	}
+	b.subscription.UnsubscribeAll(clientId)
+	b.mu.Unlock()
+
+	if info == nil {
+		return nil
+	}
+	if connected {
+		// Queued messages are spilled to the session on closing
+		client.Disconnect(message.SessionTakenOver)
+	}
+	b.cluster.notifyFilters()
+	if !resume {
+		log.Debug("session is discarded by another node: ", clientId)
+		b.hooks.OnSessionExpired(*info)
+		return nil
+	}
+	log.Debug("session is moved to another node: ", clientId)
+	return encodeSession(sess, subscriptions)
+}
+
+// Store the session which is moved from another node, then it is resumed by the connecting client
+func (b *Broker) restoreSession(cn *message.Connect, state *sessionState) {
+	s := session.New(nil, context.Background())
+	for _, p := range state.Inflight {
+		if pb := p.decode(); pb != nil {
+			s.RestoreInflight(pb, p.State)
+		}
+	}
+	for _, p := range state.Received {
+		if pb := p.decode(); pb != nil {
+			s.RestoreReceived(pb)
+		}
+	}
+	now := time.Now()
+	for _, p := range state.Spilled {
+		if pb := p.decode(); pb != nil {
+			s.Spill(pb, now)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sessions[cn.ClientId] = &storedSession{
+		info: ClientInfo{
+			ClientId: cn.ClientId,
+			Username: cn.Username,
+		},
+		session:       s,
+		subscriptions: state.Subscriptions,
+	}
+}
+
+// Encode messages of the session, spilled messages are taken from the session
+func encodeSession(s *session.Session, subscriptions []message.SubscribeTopic) *sessionState {
+	state := &sessionState{
+		Subscriptions: subscriptions,
+	}
+	for _, m := range s.Inflights() {
+		if p, ok := encodeSessionPacket(m.Message); ok {
+			p.State = m.State
+			state.Inflight = append(state.Inflight, p)
+		}
+	}
+	for _, pb := range s.Received() {
+		if p, ok := encodeSessionPacket(pb); ok {
+			state.Received = append(state.Received, p)
+		}
+	}
+	for {
+		pb, _, ok := s.Unspill()
+		if !ok {
+			break
+		}
+		if p, ok := encodeSessionPacket(pb); ok {
+			state.Spilled = append(state.Spilled, p)
+		}
+	}
+	return state
+}
+
+func encodeSessionPacket(pb *message.Publish) (sessionPacket, bool) {
+	packet, err := pb.Encode()
+	if err != nil {
+		log.Debug("failed to encode session message: ", err)
+		return sessionPacket{}, false
+	}
+	return sessionPacket{
+		Version: pb.Version,
+		Packet:  packet,
+	}, true
+}
+
+func (p sessionPacket) decode() *message.Publish {
+	frame, payload, err := message.ReceiveFrame(bytes.NewReader(p.Packet))
+	if err != nil {
+		log.Debug("failed to read session message: ", err)
+		return nil
+	}
+	frame.SetVersion(p.Version)
+	pb, err := message.ParsePublish(frame, payload)
+	if err != nil {
+		log.Debug("failed to parse session message: ", err)
+		return nil
+	}
+	return pb
+}
@@ -0,0 +1,212 @@
+package broker_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Connect with raw connection which keeps the session for a minute after disconnection
+func connectSession(t *testing.T, addr, clientId string) net.Conn {
+	conn, _ := connectSessionAck(t, addr, clientId, false)
+	return conn
+}
+
+func connectSessionAck(t *testing.T, addr, clientId string, cleanStart bool) (net.Conn, *message.ConnAck) {
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	cn := message.NewConnect()
+	cn.ProtocolName = "MQTT"
+	cn.ProtocolVersion = 5
+	cn.ClientId = clientId
+	cn.CleanStart = cleanStart
+	cn.Property = &message.ConnectProperty{SessionExpiryInterval: 60}
+	assert.NoError(t, message.WriteFrame(conn, cn))
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	ack, err := message.ParseConnAck(frame, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, message.Success, ack.ReasonCode)
+	return conn, ack
+}
+
+func publishQoS2(t *testing.T, conn net.Conn, packetId uint16, dup bool) message.ReasonCode {
+	pb := message.NewPublish(packetId, message.WithQoS(message.QoS2))
+	pb.TopicName = "qos2/foo"
+	pb.Body = []byte("exactly once")
+	pb.DUP = dup
+	assert.NoError(t, message.WriteFrame(conn, pb))
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	ack, err := message.ParsePubRec(frame, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, packetId, ack.PacketId)
+	return ack.ReasonCode
+}
+
+func releaseQoS2(t *testing.T, conn net.Conn, packetId uint16) message.ReasonCode {
+	assert.NoError(t, message.WriteFrame(conn, message.NewPubRel(packetId)))
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	ack, err := message.ParsePubComp(frame, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, packetId, ack.PacketId)
+	return ack.ReasonCode
+}
+
+func TestQoS2ExactlyOnceOverReconnect(t *testing.T) {
+	b := broker.NewBroker(":21231", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	sub := client.NewClient("mqtt://localhost:21231")
+	assert.NoError(t, sub.Connect(context.Background()))
+	defer func() {
+		go sub.Disconnect()
+		<-sub.Closed
+	}()
+	assert.NoError(t, sub.Subscribe("qos2/#", nil, client.WithQoS(message.QoS2)))
+
+	conn := connectSession(t, "localhost:21231", "qos2-publisher")
+	assert.Equal(t, message.Success, publishQoS2(t, conn, 5, false))
+	// Retransmission is acknowledged again, but reusing the identifier before PUBREL is rejected
+	assert.Equal(t, message.Success, publishQoS2(t, conn, 5, true))
+	assert.Equal(t, message.PacketIdentifierInUse, publishQoS2(t, conn, 5, false))
+	conn.Close()
+
+	// PUBREL after reconnection releases the message which was received by the previous connection
+	conn = connectSession(t, "localhost:21231", "qos2-publisher")
+	defer conn.Close()
+	assert.Equal(t, message.Success, releaseQoS2(t, conn, 5))
+	pb := receiveMessage(t, sub)
+	assert.Equal(t, []byte("exactly once"), pb.Body)
+
+	// Retransmitted PUBREL is completed without delivering twice
+	assert.Equal(t, message.Success, releaseQoS2(t, conn, 5))
+	assert.Equal(t, message.PacketIdentifierNotFound, releaseQoS2(t, conn, 6))
+	select {
+	case pb := <-sub.Message:
+		t.Fatalf("message is delivered twice: %s", string(pb.Body))
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func receivePublish(t *testing.T, conn net.Conn) *message.Publish {
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	pb, err := message.ParsePublish(frame, payload)
+	assert.NoError(t, err)
+	return pb
+}
+
+func TestResendInflightOnResume(t *testing.T) {
+	b := broker.NewBroker(":21232", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	subscribe := func(conn net.Conn) {
+		ss := message.NewSubscribe()
+		ss.PacketId = 1
+		ss.AddTopic(message.SubscribeTopic{TopicName: "resume/#", QoS: message.QoS2})
+		assert.NoError(t, message.WriteFrame(conn, ss))
+		frame, _, err := message.ReceiveFrame(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, message.SUBACK, frame.Type)
+	}
+	ctx := context.Background()
+
+	t.Run("PUBLISH is resent with DUP flag", func(t *testing.T) {
+		conn := connectSession(t, "localhost:21232", "resume-qos1")
+		subscribe(conn)
+		assert.NoError(t, b.Publish(ctx, "resume/foo", []byte("qos1"), broker.WithQoS(message.QoS1)))
+		first := receivePublish(t, conn)
+		assert.False(t, first.DUP)
+		conn.Close()
+
+		conn = connectSession(t, "localhost:21232", "resume-qos1")
+		defer conn.Close()
+		resent := receivePublish(t, conn)
+		assert.True(t, resent.DUP)
+		assert.Equal(t, first.PacketId, resent.PacketId)
+		assert.Equal(t, []byte("qos1"), resent.Body)
+		assert.NoError(t, message.WriteFrame(conn, message.NewPubAck(resent.PacketId)))
+	})
+
+	t.Run("PUBREL is resent after PUBREC", func(t *testing.T) {
+		conn := connectSession(t, "localhost:21232", "resume-qos2")
+		subscribe(conn)
+		assert.NoError(t, b.Publish(ctx, "resume/foo", []byte("qos2"), broker.WithQoS(message.QoS2)))
+		pb := receivePublish(t, conn)
+		assert.NoError(t, message.WriteFrame(conn, message.NewPubRec(pb.PacketId)))
+		frame, _, err := message.ReceiveFrame(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, message.PUBREL, frame.Type)
+		conn.Close()
+
+		conn = connectSession(t, "localhost:21232", "resume-qos2")
+		defer conn.Close()
+		frame, payload, err := message.ReceiveFrame(conn)
+		assert.NoError(t, err)
+		pl, err := message.ParsePubRel(frame, payload)
+		assert.NoError(t, err)
+		assert.Equal(t, pb.PacketId, pl.PacketId)
+		assert.NoError(t, message.WriteFrame(conn, message.NewPubComp(pl.PacketId)))
+	})
+}
+
+func waitSubscriptions(t *testing.T, b *broker.Broker, n int64) {
+	for i := 0; b.Stats().Subscriptions != n; i++ {
+		if i > 30 {
+			t.Fatalf("subscriptions are not %d", n)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestResumeSessionRestoresSubscriptions(t *testing.T) {
+	b := broker.NewBroker(":21233", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, ack := connectSessionAck(t, "localhost:21233", "present-client", false)
+	assert.False(t, ack.SessionPresentFlag)
+	ss := message.NewSubscribe()
+	ss.PacketId = 1
+	ss.AddTopic(message.SubscribeTopic{TopicName: "present/#", QoS: message.QoS1})
+	assert.NoError(t, message.WriteFrame(conn, ss))
+	frame, _, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, message.SUBACK, frame.Type)
+	conn.Close()
+	waitSubscriptions(t, b, 0)
+	time.Sleep(100 * time.Millisecond)
+
+	// Stored session is resumed with its subscriptions
+	conn, ack = connectSessionAck(t, "localhost:21233", "present-client", false)
+	assert.True(t, ack.SessionPresentFlag)
+	waitSubscriptions(t, b, 1)
+	assert.NoError(t, b.Publish(context.Background(), "present/foo", []byte("resumed"), broker.WithQoS(message.QoS1)))
+	pb := receivePublish(t, conn)
+	assert.Equal(t, "present/foo", pb.TopicName)
+	assert.NoError(t, message.WriteFrame(conn, message.NewPubAck(pb.PacketId)))
+
+	// Taking over the connected session keeps subscriptions too
+	taken, ack := connectSessionAck(t, "localhost:21233", "present-client", false)
+	defer taken.Close()
+	conn.Close()
+	assert.True(t, ack.SessionPresentFlag)
+	time.Sleep(100 * time.Millisecond)
+	waitSubscriptions(t, b, 1)
+
+	// CleanStart discards the session
+	clean, ack := connectSessionAck(t, "localhost:21233", "present-client", true)
+	defer clean.Close()
+	assert.False(t, ack.SessionPresentFlag)
+	waitSubscriptions(t, b, 0)
+}
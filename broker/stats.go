@@ -0,0 +1,200 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+const (
+	sysTopicPrefix     = "$SYS/"
+	defaultSysInterval = 10 * time.Second
+)
+
+// Stats is the snapshot of broker statistics
+type Stats struct {
+	// Number of connected clients
+	Clients int64
+	// Total number of PUBLISH packets which clients sent to the broker
+	MessagesReceived int64
+	// Total number of PUBLISH packets which the broker delivered to clients
+	MessagesSent  int64
+	BytesReceived int64
+	BytesSent     int64
+	// Number of retain messages
+	Retained int64
+	// Number of subscriptions of clients and in-process subscribers
+	Subscriptions int64
+	// Number of QoS1 and QoS2 messages which are waiting for acknowledgment
+	InFlight int64
+	// Total number of messages which were not delivered
+	Dropped int64
+	// Number of messages which are waiting in delivery queues of subscribers, including spilled messages
+	Queued int64
+	Uptime time.Duration
+}
+
+// Counters which are updated from multiple goroutines atomically
+type stats struct {
+	start            time.Time
+	messagesReceived int64
+	messagesSent     int64
+	bytesReceived    int64
+	bytesSent        int64
+	inFlight         int64
+	dropped          int64
+
+	connections     int64
+	authFailures    int64
+	eventsDropped   int64
+	packetsReceived [16]int64
+	packetsSent     [16]int64
+
+	// Reason code counters and latency histograms are guarded by mutex
+	reasonCodes map[reasonCodeKey]int64
+	fanout      histogram
+	deliver     histogram
+	mu          sync.Mutex
+}
+
+func newStats() *stats {
+	return &stats{
+		start:       time.Now(),
+		reasonCodes: make(map[reasonCodeKey]int64),
+		fanout:      newHistogram(fanoutBuckets),
+		deliver:     newHistogram(fanoutBuckets),
+	}
+}
+
+func isSysTopic(topic string) bool {
+	return strings.HasPrefix(topic, sysTopicPrefix)
+}
+
+// countingConn counts bytes which are sent and received
+type countingConn struct {
+	net.Conn
+	stats *stats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.stats.bytesReceived, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.stats.bytesSent, int64(n))
+	// Each write is a packet, so the first byte of buffer is the fixed header
+	if n > 0 {
+		c.stats.packetSent(message.MessageType(b[0] >> 4))
+	}
+	return n, err
+}
+
+// Write multiple packets at once, each buffer is a packet
+func (c *countingConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	for _, b := range bufs {
+		if len(b) > 0 {
+			c.stats.packetSent(message.MessageType(b[0] >> 4))
+		}
+	}
+	n, err := bufs.WriteTo(c.Conn)
+	atomic.AddInt64(&c.stats.bytesSent, n)
+	return n, err
+}
+
+// Get current broker statistics
+func (b *Broker) Stats() Stats {
+	b.mu.Lock()
+	clients := len(b.clients)
+	var queued int
+	for _, c := range b.clients {
+		queued += c.queue.depth()
+	}
+	b.mu.Unlock()
+
+	return Stats{
+		Clients:          int64(clients),
+		MessagesReceived: atomic.LoadInt64(&b.stats.messagesReceived),
+		MessagesSent:     atomic.LoadInt64(&b.stats.messagesSent),
+		BytesReceived:    atomic.LoadInt64(&b.stats.bytesReceived),
+		BytesSent:        atomic.LoadInt64(&b.stats.bytesSent),
+		Retained:         int64(len(b.subscription.RetainMessages())),
+		Subscriptions:    int64(b.subscription.Count(isClusterNode)),
+		InFlight:         atomic.LoadInt64(&b.stats.inFlight),
+		Dropped:          atomic.LoadInt64(&b.stats.dropped),
+		Queued:           int64(queued),
+		Uptime:           time.Since(b.stats.start),
+	}
+}
+
+// Publish statistics to $SYS topics periodically
+func (b *Broker) publishSys(ctx context.Context) {
+	ticker := time.NewTicker(b.sysInterval)
+	defer ticker.Stop()
+
+	last := b.Stats()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := b.Stats()
+		perSecond := func(now, prev int64) string {
+			rate := float64(now-prev) / b.sysInterval.Seconds()
+			return strconv.FormatFloat(rate, 'f', 2, 64)
+		}
+		values := map[string]string{
+			"uptime":                   strconv.Itoa(int(current.Uptime.Seconds())) + " seconds",
+			"clients/connected":        strconv.FormatInt(current.Clients, 10),
+			"messages/received":        strconv.FormatInt(current.MessagesReceived, 10),
+			"messages/sent":            strconv.FormatInt(current.MessagesSent, 10),
+			"messages/inflight":        strconv.FormatInt(current.InFlight, 10),
+			"load/messages/received":   perSecond(current.MessagesReceived, last.MessagesReceived),
+			"load/messages/sent":       perSecond(current.MessagesSent, last.MessagesSent),
+			"bytes/received":           strconv.FormatInt(current.BytesReceived, 10),
+			"bytes/sent":               strconv.FormatInt(current.BytesSent, 10),
+			"load/bytes/received":      perSecond(current.BytesReceived, last.BytesReceived),
+			"load/bytes/sent":          perSecond(current.BytesSent, last.BytesSent),
+			"retained messages/count":  strconv.FormatInt(current.Retained, 10),
+			"subscriptions/count":      strconv.FormatInt(current.Subscriptions, 10),
+			"publish/messages/dropped": strconv.FormatInt(current.Dropped, 10),
+			"publish/messages/queued":  strconv.FormatInt(current.Queued, 10),
+		}
+		for topic, value := range values {
+			if err := b.Publish(ctx, sysTopicPrefix+"broker/"+topic, []byte(value), WithRetain()); err != nil {
+				log.Debug("failed to publish $SYS message: ", err)
+			}
+		}
+		last = current
+	}
+}
+
+// Publish client presence to $SYS/broker/clients/connected/<id>.
+// Retain message is kept while client is connected, so the subscriber can know connected clients.
+func (b *Broker) publishPresence(clientId string, connected bool) {
+	if b.sysInterval == 0 {
+		return
+	}
+	topic := sysTopicPrefix + "broker/clients/connected/" + clientId
+	ctx := context.Background()
+	if connected {
+		if err := b.Publish(ctx, topic, []byte("1"), WithRetain()); err != nil {
+			log.Debug("failed to publish client presence: ", err)
+		}
+		return
+	}
+	b.deleteRetainMessage(topic)
+	if err := b.Publish(ctx, topic, []byte("0")); err != nil {
+		log.Debug("failed to publish client presence: ", err)
+	}
+}
@@ -0,0 +1,66 @@
+package broker_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestSysTopicsArePublished(t *testing.T) {
+	b := broker.NewBroker(":21121", broker.WithSysInterval(100*time.Millisecond))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	var mu sync.Mutex
+	sys := map[string]string{}
+	stop, err := b.Subscribe("$SYS/broker/#", func(pb *message.Publish) {
+		mu.Lock()
+		defer mu.Unlock()
+		sys[pb.TopicName] = string(pb.Body)
+	})
+	assert.NoError(t, err)
+	defer stop()
+	wildcard := make(chan *message.Publish, 100)
+	stop, err = b.Subscribe("#", func(pb *message.Publish) {
+		wildcard <- pb
+	})
+	assert.NoError(t, err)
+	defer stop()
+
+	c := client.NewClient("mqtt://localhost:21121")
+	assert.NoError(t, c.Connect(context.Background(), client.WithClientId("sys-client")))
+	assert.NoError(t, c.Publish("foo/bar", []byte("hello")))
+	time.Sleep(300 * time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, "1", sys["$SYS/broker/clients/connected"])
+	assert.Equal(t, "1", sys["$SYS/broker/clients/connected/sys-client"])
+	assert.Equal(t, "1", sys["$SYS/broker/messages/received"])
+	assert.Contains(t, sys, "$SYS/broker/uptime")
+	assert.Contains(t, sys, "$SYS/broker/load/messages/received")
+	assert.Contains(t, sys, "$SYS/broker/bytes/received")
+	mu.Unlock()
+
+	go c.Disconnect()
+	<-c.Closed
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, "0", sys["$SYS/broker/clients/connected/sys-client"])
+	mu.Unlock()
+
+	// "#" doesn't match to $SYS topics
+	assert.Equal(t, 1, len(wildcard))
+	assert.Equal(t, "foo/bar", (<-wildcard).TopicName)
+
+	stats := b.Stats()
+	assert.Equal(t, int64(0), stats.Clients)
+	assert.Equal(t, int64(1), stats.MessagesReceived)
+	assert.True(t, stats.BytesReceived > 0)
+}
@@ -0,0 +1,56 @@
+package broker_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestPipelinedPackets(t *testing.T) {
+	b := broker.NewBroker(":21201", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	cn := message.NewConnect()
+	cn.ProtocolName = "MQTT"
+	cn.ProtocolVersion = message.Version5
+	cn.ClientId = "pipelined-client"
+	ss := message.NewSubscribe()
+	ss.PacketId = 1
+	ss.AddTopic(message.SubscribeTopic{TopicName: "pipeline/#", QoS: message.QoS0})
+	pb := message.NewPublish(0)
+	pb.TopicName = "pipeline/foo"
+	pb.Body = []byte("pipelined")
+
+	// Send all packets in a single write, broker must not drop packets which follow CONNECT
+	buf := new(bytes.Buffer)
+	for _, m := range []message.Encoder{cn, ss, pb} {
+		assert.NoError(t, message.WriteFrame(buf, m))
+	}
+	conn, err := net.Dial("tcp", "localhost:21201")
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(buf.Bytes())
+	assert.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	r := message.NewPacketReader(conn)
+	defer r.Release()
+	for _, expect := range []message.MessageType{message.CONNACK, message.SUBACK, message.PUBLISH} {
+		f, p, err := r.ReadFrame()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, expect, f.Type)
+		if f.Type == message.PUBLISH {
+			received, err := message.ParsePublish(f, p)
+			assert.NoError(t, err)
+			assert.Equal(t, "pipelined", string(received.Body))
+		}
+	}
+}
@@ -11,21 +11,33 @@ import (
 )
 
 type SubscriptionInfo struct {
-	Clients       map[string]message.QoSLevel
+	Clients       map[string]message.SubscribeTopic
 	RetainMessage *message.Publish
 }
 
 type Subscription struct {
 	topics sync.Map
+	// Wildcard topic filters are kept in order to match topics which will be created later
+	filters map[string]map[string]message.SubscribeTopic
+
+	mu sync.RWMutex
 }
 
 func NewSubscription() *Subscription {
 	return &Subscription{
-		topics: sync.Map{},
+		topics:  sync.Map{},
+		filters: make(map[string]map[string]message.SubscribeTopic),
 	}
 }
 
+func isWildcardTopic(topic string) bool {
+	return strings.Contains(topic, "#") || strings.Contains(topic, "+")
+}
+
 func (s *Subscription) UnsubscribeAll(clientId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.topics.Range(func(k, v interface{}) bool {
 		info := v.(*SubscriptionInfo)
 		if _, ok := info.Clients[clientId]; ok {
@@ -33,45 +45,70 @@ func (s *Subscription) UnsubscribeAll(clientId string) {
 		}
 		return true
 	})
+	for filter, clients := range s.filters {
+		delete(clients, clientId)
+		if len(clients) == 0 {
+			delete(s.filters, filter)
+		}
+	}
 }
 
-func (s *Subscription) Unsubscribe(clientId, topic string) {
+// Unsubscribe topic filter, and report subscription existed or not.
+// Only the subscription of the same filter string is removed, overlapping subscriptions are kept
+func (s *Subscription) Unsubscribe(clientId, topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if isWildcardTopic(topic) {
+		clients, ok := s.filters[topic]
+		if !ok {
+			return false
+		}
+		_, existed := clients[clientId]
+		delete(clients, clientId)
+		if len(clients) == 0 {
+			delete(s.filters, topic)
+		}
+		return existed
+	}
+
 	v, ok := s.topics.Load(topic)
 	if !ok {
-		return
+		return false
 	}
 	info := v.(*SubscriptionInfo)
-	if _, ok := info.Clients[clientId]; ok {
-		delete(info.Clients, clientId)
-	}
+	_, existed := info.Clients[clientId]
+	delete(info.Clients, clientId)
+	return existed
 }
 
+// Subscribe topic filter. Subscriptions are keyed by the filter string,
+// and wildcard filters are matched to the topic on publishing, see Subscribers()
 func (s *Subscription) Subscribe(clientId string, t message.SubscribeTopic) (message.ReasonCode, error) {
 	targets, err := s.FindTopics(t.TopicName)
 	if err != nil {
 		return message.UnspecifiedError, errors.Wrap(err, "topic not found: "+t.TopicName)
-	} else if len(targets) == 0 {
-		// If target hasn't created yet, create new topic.
-		// But, topic name has wildcard, we'll skip it
-		if !strings.Contains(t.TopicName, "#") && !strings.Contains(t.TopicName, "+") {
-			targets = append(targets, t.TopicName)
-		} else {
-			return message.NoSubscriptionExisted, nil
-		}
 	}
 
-	for _, topic := range targets {
-		var info *SubscriptionInfo
-		if v, ok := s.topics.Load(topic); ok {
-			info = v.(*SubscriptionInfo)
-		} else {
-			info = &SubscriptionInfo{
-				Clients: make(map[string]message.QoSLevel),
-			}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if isWildcardTopic(t.TopicName) {
+		if _, ok := s.filters[t.TopicName]; !ok {
+			s.filters[t.TopicName] = make(map[string]message.SubscribeTopic)
+		}
+		s.filters[t.TopicName][clientId] = t
+		log.Debugf("client %s subscribed filter for %s\n", clientId, t.TopicName)
+		// Filter is kept for the topics which will be created later
+		if len(targets) == 0 {
+			return message.NoSubscriptionExisted, nil
 		}
-		info.Clients[clientId] = t.QoS
-		s.topics.Store(topic, info)
-		log.Debugf("client %s subscribed top for %s\n", clientId, topic)
+	} else {
+		v, _ := s.topics.LoadOrStore(t.TopicName, &SubscriptionInfo{
+			Clients: make(map[string]message.SubscribeTopic),
+		})
+		v.(*SubscriptionInfo).Clients[clientId] = t
+		log.Debugf("client %s subscribed top for %s\n", clientId, t.TopicName)
 	}
 
 	switch t.QoS {
@@ -92,7 +129,7 @@ func (s *Subscription) CompileTopicRegex(topic string) (*regexp.Regexp, error) {
 		// It's OK to use only MLW character
 		if topic != "#" {
 			// MLW must present after topic division character
-			if topic[mlw-1] != '/' {
+			if mlw == 0 || topic[mlw-1] != '/' {
 				return nil, errors.New("Multi-level wildcard must present after topic division chacater of `/`")
 			}
 			// MLW must present at last character of topic name
@@ -105,16 +142,17 @@ func (s *Subscription) CompileTopicRegex(topic string) (*regexp.Regexp, error) {
 	if slw := strings.Index(topic, "+"); slw != -1 {
 		// It's OK to use only SLW character
 		if topic != "+" {
-			// SLW must present after topic division character
-			if topic[slw-1] != '/' {
+			// SLW must present after topic division character, or at the first level
+			if slw > 0 && topic[slw-1] != '/' {
 				return nil, errors.New("Single-level wildcard must present after topic division chacater of `/`")
 			}
 		}
 	}
 
-	t := strings.Replace(topic, "+", "[^/]+", -1)
+	// Escape regexp meta characters like "$" in topic name, except wildcards
+	t := strings.Replace(regexp.QuoteMeta(topic), `\+`, "[^/]+", -1)
 	t = strings.Replace(t, "/#", ".*", -1)
-	t += "$"
+	t = "^" + t + "$"
 
 	if r, err := regexp.Compile(t); err != nil {
 		return nil, errors.Wrap(err, "failed to compile regex for topic")
@@ -133,6 +171,10 @@ func (s *Subscription) FindTopics(topic string) ([]string, error) {
 	topics := []string{}
 	s.topics.Range(func(k, v interface{}) bool {
 		topicName := k.(string)
+		// Topic which starts with "$" doesn't match to the filter which starts with wildcard
+		if strings.HasPrefix(topicName, "$") && (topic[0] == '#' || topic[0] == '+') {
+			return true
+		}
 		if r.MatchString(topicName) {
 			topics = append(topics, topicName)
 		}
@@ -141,6 +183,7 @@ func (s *Subscription) FindTopics(topic string) ([]string, error) {
 	return topics, nil
 }
 
+// Get subscribers of the exact topic, subscribers of wildcard filters aren't included
 func (s *Subscription) GetClientsByTopic(topic string) *SubscriptionInfo {
 	log.Debugf("find all clients fot topic: %s\n", topic)
 
@@ -149,3 +192,152 @@ func (s *Subscription) GetClientsByTopic(topic string) *SubscriptionInfo {
 	}
 	return nil
 }
+
+// Get all subscribers and its subscription for the topic.
+// The result includes subscribers of wildcard filters which match to the topic,
+// and if client has overlapping subscriptions, the one which has maximum QoS is used.
+func (s *Subscription) Subscribers(topic string) map[string]message.SubscribeTopic {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscribers := make(map[string]message.SubscribeTopic)
+	if v, ok := s.topics.Load(topic); ok {
+		for cid, t := range v.(*SubscriptionInfo).Clients {
+			subscribers[cid] = t
+		}
+	}
+	for filter, clients := range s.filters {
+		if !message.MatchTopic(filter, topic) {
+			continue
+		}
+		for cid, t := range clients {
+			if current, ok := subscribers[cid]; !ok || current.QoS < t.QoS {
+				subscribers[cid] = t
+			}
+		}
+	}
+	return subscribers
+}
+
+// Store retain message for the topic. If message is nil, retain message is deleted
+func (s *Subscription) SetRetainMessage(topic string, pb *message.Publish) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pb == nil {
+		if v, ok := s.topics.Load(topic); ok {
+			v.(*SubscriptionInfo).RetainMessage = nil
+		}
+		return
+	}
+	v, _ := s.topics.LoadOrStore(topic, &SubscriptionInfo{
+		Clients: make(map[string]message.SubscribeTopic),
+	})
+	v.(*SubscriptionInfo).RetainMessage = pb
+}
+
+// Get retain message for the topic
+func (s *Subscription) RetainMessage(topic string) *message.Publish {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if v, ok := s.topics.Load(topic); ok {
+		return v.(*SubscriptionInfo).RetainMessage
+	}
+	return nil
+}
+
+// Get all retain messages
+func (s *Subscription) RetainMessages() []*message.Publish {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	messages := []*message.Publish{}
+	s.topics.Range(func(k, v interface{}) bool {
+		if pb := v.(*SubscriptionInfo).RetainMessage; pb != nil {
+			messages = append(messages, pb)
+		}
+		return true
+	})
+	return messages
+}
+
+// Get all topics and wildcard filters which are subscribed. Subscriptions of the client which skip returns true are ignored.
+func (s *Subscription) Filters(skip func(clientId string) bool) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[string]struct{})
+	s.topics.Range(func(k, v interface{}) bool {
+		for cid := range v.(*SubscriptionInfo).Clients {
+			if !skip(cid) {
+				found[k.(string)] = struct{}{}
+				break
+			}
+		}
+		return true
+	})
+	for filter, clients := range s.filters {
+		for cid := range clients {
+			if !skip(cid) {
+				found[filter] = struct{}{}
+				break
+			}
+		}
+	}
+
+	filters := []string{}
+	for f := range found {
+		filters = append(filters, f)
+	}
+	return filters
+}
+
+// Count subscriptions. Subscriptions of the client which skip returns true are ignored.
+func (s *Subscription) Count(skip func(clientId string) bool) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[string]struct{})
+	s.topics.Range(func(k, v interface{}) bool {
+		for cid, t := range v.(*SubscriptionInfo).Clients {
+			if !skip(cid) {
+				found[cid+"\x00"+t.TopicName] = struct{}{}
+			}
+		}
+		return true
+	})
+	for filter, clients := range s.filters {
+		for cid := range clients {
+			if !skip(cid) {
+				found[cid+"\x00"+filter] = struct{}{}
+			}
+		}
+	}
+	return len(found)
+}
+
+// Get subscriptions of the client
+func (s *Subscription) ClientSubscriptions(clientId string) []message.SubscribeTopic {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make(map[string]message.SubscribeTopic)
+	s.topics.Range(func(k, v interface{}) bool {
+		if t, ok := v.(*SubscriptionInfo).Clients[clientId]; ok {
+			found[t.TopicName] = t
+		}
+		return true
+	})
+	for _, clients := range s.filters {
+		if t, ok := clients[clientId]; ok {
+			found[t.TopicName] = t
+		}
+	}
+
+	subscriptions := []message.SubscribeTopic{}
+	for _, t := range found {
+		subscriptions = append(subscriptions, t)
+	}
+	return subscriptions
+}
@@ -178,3 +178,100 @@ func TestFindTopicsWithExactTopicSingleLevelWildcard(t *testing.T) {
 	assert.Equal(t, 2, len(topics))
 	// unordered
 }
+
+func TestSubscribersIncludeWildcardFilterForNewTopic(t *testing.T) {
+	ss := broker.NewSubscription()
+	ss.Subscribe("1111-1111-1111-1111", message.SubscribeTopic{
+		TopicName: "foo/+",
+		QoS:       message.QoS1,
+	})
+	ss.Subscribe("2222-2222-2222-2222", message.SubscribeTopic{
+		TopicName: "foo/bar",
+		QoS:       message.QoS0,
+	})
+	subscribers := ss.Subscribers("foo/bar")
+	assert.Equal(t, 2, len(subscribers))
+	assert.Equal(t, message.QoS1, subscribers["1111-1111-1111-1111"].QoS)
+	assert.Equal(t, message.QoS0, subscribers["2222-2222-2222-2222"].QoS)
+
+	subscribers = ss.Subscribers("foo/baz")
+	assert.Equal(t, 1, len(subscribers))
+
+	assert.True(t, ss.Unsubscribe("1111-1111-1111-1111", "foo/+"))
+	subscribers = ss.Subscribers("foo/baz")
+	assert.Equal(t, 0, len(subscribers))
+}
+
+func TestFiltersSkipClients(t *testing.T) {
+	ss := broker.NewSubscription()
+	ss.Subscribe("1111-1111-1111-1111", message.SubscribeTopic{
+		TopicName: "foo/bar",
+		QoS:       message.QoS0,
+	})
+	ss.Subscribe("1111-1111-1111-1111", message.SubscribeTopic{
+		TopicName: "foo/#",
+		QoS:       message.QoS1,
+	})
+	ss.Subscribe("remote", message.SubscribeTopic{
+		TopicName: "baz/+",
+		QoS:       message.QoS1,
+	})
+	filters := ss.Filters(func(clientId string) bool {
+		return clientId == "remote"
+	})
+	assert.ElementsMatch(t, []string{"foo/bar", "foo/#"}, filters)
+}
+
+func TestFindTopicsExcludeSysTopicsFromLeadingWildcard(t *testing.T) {
+	ss := broker.NewSubscription()
+	ss.Subscribe("1111-1111-1111-1111", message.SubscribeTopic{
+		TopicName: "$SYS/broker/uptime",
+		QoS:       message.QoS0,
+	})
+	topics, err := ss.FindTopics("+/broker/uptime")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(topics))
+
+	topics, err = ss.FindTopics("$SYS/broker/+")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$SYS/broker/uptime"}, topics)
+}
+
+func TestOverlappingSubscriptionsAreKeptByFilter(t *testing.T) {
+	ss := broker.NewSubscription()
+	ss.Subscribe("1111-1111-1111-1111", message.SubscribeTopic{
+		TopicName: "a/b",
+		QoS:       message.QoS2,
+	})
+	reason, err := ss.Subscribe("1111-1111-1111-1111", message.SubscribeTopic{
+		TopicName: "a/+",
+		QoS:       message.QoS0,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, message.GrantedQoS0, reason)
+
+	// Wildcard filter doesn't overwrite the explicit subscription
+	subscribers := ss.Subscribers("a/b")
+	assert.Equal(t, 1, len(subscribers))
+	assert.Equal(t, "a/b", subscribers["1111-1111-1111-1111"].TopicName)
+	assert.Equal(t, message.QoS2, subscribers["1111-1111-1111-1111"].QoS)
+	assert.Equal(t, 2, len(ss.ClientSubscriptions("1111-1111-1111-1111")))
+
+	// Unsubscribe removes only the filter
+	assert.True(t, ss.Unsubscribe("1111-1111-1111-1111", "a/+"))
+	assert.False(t, ss.Unsubscribe("1111-1111-1111-1111", "a/+"))
+	subscribers = ss.Subscribers("a/b")
+	assert.Equal(t, message.QoS2, subscribers["1111-1111-1111-1111"].QoS)
+	assert.Equal(t, 0, len(ss.Subscribers("a/c")))
+	assert.Equal(t, []message.SubscribeTopic{{TopicName: "a/b", QoS: message.QoS2}}, ss.ClientSubscriptions("1111-1111-1111-1111"))
+
+	// Explicit subscription is removed, then the wildcard filter still matches
+	ss.Subscribe("1111-1111-1111-1111", message.SubscribeTopic{
+		TopicName: "a/+",
+		QoS:       message.QoS1,
+	})
+	assert.True(t, ss.Unsubscribe("1111-1111-1111-1111", "a/b"))
+	subscribers = ss.Subscribers("a/b")
+	assert.Equal(t, "a/+", subscribers["1111-1111-1111-1111"].TopicName)
+	assert.Equal(t, 1, ss.Count(func(string) bool { return false }))
+}
@@ -0,0 +1,80 @@
+package broker_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func receiveDisconnect(t *testing.T, conn net.Conn) *message.Disconnect {
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, message.DISCONNECT, frame.Type)
+	dc, err := message.ParseDisconnect(frame, payload)
+	assert.NoError(t, err)
+	return dc
+}
+
+func TestDisconnectProtocolViolation(t *testing.T) {
+	b := broker.NewBroker(":21191", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Run("wildcard in topic name", func(t *testing.T) {
+		conn := connectRaw(t, "localhost:21191", 0)
+		defer conn.Close()
+		_, err := conn.Write([]byte{0x30, 0x06, 0x00, 0x03, 'a', '/', '+', 0x00})
+		assert.NoError(t, err)
+		assert.Equal(t, message.TopicNameInvalid, receiveDisconnect(t, conn).ReasonCode)
+	})
+
+	t.Run("topic alias", func(t *testing.T) {
+		conn := connectRaw(t, "localhost:21191", 0)
+		defer conn.Close()
+		_, err := conn.Write([]byte{0x30, 0x07, 0x00, 0x00, 0x03, 0x23, 0x00, 0x01, 'x'})
+		assert.NoError(t, err)
+		assert.Equal(t, message.TopicAliasInvalid, receiveDisconnect(t, conn).ReasonCode)
+	})
+
+	t.Run("invalid reserved flags", func(t *testing.T) {
+		conn := connectRaw(t, "localhost:21191", 0)
+		defer conn.Close()
+		_, err := conn.Write([]byte{0xC1, 0x00})
+		assert.NoError(t, err)
+		assert.Equal(t, message.MalformedPacket, receiveDisconnect(t, conn).ReasonCode)
+	})
+
+	t.Run("second CONNECT", func(t *testing.T) {
+		conn := connectRaw(t, "localhost:21191", 0)
+		defer conn.Close()
+		cn := message.NewConnect()
+		cn.ClientId = "raw-client"
+		assert.NoError(t, message.WriteFrame(conn, cn))
+		assert.Equal(t, message.ProtocolError, receiveDisconnect(t, conn).ReasonCode)
+	})
+}
+
+func TestConnectUnsupportedProtocol(t *testing.T) {
+	b := broker.NewBroker(":21192", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "localhost:21192")
+	assert.NoError(t, err)
+	defer conn.Close()
+	cn := message.NewConnect()
+	cn.ProtocolName = "MQTT"
+	cn.ProtocolVersion = 9
+	cn.ClientId = "raw-client"
+	assert.NoError(t, message.WriteFrame(conn, cn))
+	frame, payload, err := message.ReceiveFrame(conn)
+	assert.NoError(t, err)
+	ack, err := message.ParseConnAck(frame, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, message.UnsupportedProtocolVersion, ack.ReasonCode)
+}
@@ -0,0 +1,99 @@
+package broker_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func receiveMessage(t *testing.T, c *client.Client) *message.Publish {
+	select {
+	case pb := <-c.Message:
+		return pb
+	case <-time.After(3 * time.Second):
+		t.Fatal("message is not received")
+	}
+	return nil
+}
+
+func TestTranslateBetweenProtocolVersions(t *testing.T) {
+	b := broker.NewBroker(":21181", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	v3 := client.NewClient("mqtt://localhost:21181")
+	assert.NoError(t, v3.Connect(context.Background(), client.WithProtocolVersion(message.Version311)))
+	defer func() {
+		go v3.Disconnect()
+		<-v3.Closed
+	}()
+	v5 := client.NewClient("mqtt://localhost:21181")
+	assert.NoError(t, v5.Connect(context.Background()))
+	defer func() {
+		go v5.Disconnect()
+		<-v5.Closed
+	}()
+
+	assert.NoError(t, v3.Subscribe("from/v5/#", nil, client.WithQoS(message.QoS1)))
+	assert.NoError(t, v5.Subscribe("from/v3/#", nil, client.WithQoS(message.QoS2)))
+
+	t.Run("v5 publisher to v3 subscriber", func(t *testing.T) {
+		assert.NoError(t, v5.Publish("from/v5/foo", []byte("hello v3"),
+			client.WithQoS(message.QoS1),
+			client.WithProperty(&message.PublishProperty{ContentType: "text/plain"}),
+		))
+		pb := receiveMessage(t, v3)
+		assert.Equal(t, "from/v5/foo", pb.TopicName)
+		assert.Equal(t, []byte("hello v3"), pb.Body)
+		assert.Nil(t, pb.Property)
+	})
+
+	t.Run("v3 publisher to v5 subscriber", func(t *testing.T) {
+		assert.NoError(t, v3.Publish("from/v3/foo", []byte("hello v5"), client.WithQoS(message.QoS2)))
+		pb := receiveMessage(t, v5)
+		assert.Equal(t, "from/v3/foo", pb.TopicName)
+		assert.Equal(t, []byte("hello v5"), pb.Body)
+		assert.Equal(t, message.QoS2, pb.QoS)
+	})
+
+	t.Run("retained message for v3 subscriber", func(t *testing.T) {
+		assert.NoError(t, v5.Publish("from/v5/retained", []byte("retained"),
+			client.WithRetain(),
+			client.WithProperty(&message.PublishProperty{ContentType: "text/plain"}),
+		))
+		receiveMessage(t, v3)
+
+		late := client.NewClient("mqtt://localhost:21181")
+		assert.NoError(t, late.Connect(context.Background(), client.WithProtocolVersion(message.Version311)))
+		defer func() {
+			go late.Disconnect()
+			<-late.Closed
+		}()
+		assert.NoError(t, late.Subscribe("from/v5/retained", nil))
+		pb := receiveMessage(t, late)
+		assert.Equal(t, []byte("retained"), pb.Body)
+		assert.True(t, pb.RETAIN)
+	})
+}
+
+func TestRejectV311Connection(t *testing.T) {
+	b := broker.NewBroker(":21182", broker.WithSysInterval(0), broker.WithBans(
+		broker.Ban{Type: broker.BanClientId, Value: "old-firmware"},
+	))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.NewClient("mqtt://localhost:21182")
+	assert.Error(t, c.Connect(context.Background(),
+		client.WithProtocolVersion(message.Version311),
+		client.WithClientId("old-firmware"),
+	))
+
+	c = client.NewClient("mqtt://localhost:21182")
+	assert.Error(t, c.Connect(context.Background(), client.WithProtocolVersion(3)))
+}
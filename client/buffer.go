@@ -0,0 +1,223 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+// BufferPolicy decides how to handle the message when the offline buffer is full
+type BufferPolicy uint8
+
+const (
+	// Drop the oldest buffered message to accept the new one
+	DropOldest BufferPolicy = iota
+	// Reject the new message, Publish returns ErrBufferFull
+	DropNewest
+)
+
+const defaultBufferSize = 1000
+
+var ErrBufferFull = errors.New("offline buffer is full")
+
+// OfflineBufferConfig is the setting of the buffer which accepts publishes while the client is disconnected.
+// Buffered messages are sent in order after the connection is established
+type OfflineBufferConfig struct {
+	// Maximum number of buffered messages, default is 1000
+	Size   int
+	Policy BufferPolicy
+	// Keep buffered messages in the store which is set by WithStore, so they survive process restarts
+	Persistent bool
+}
+
+func (c OfflineBufferConfig) withDefaults() OfflineBufferConfig {
+	if c.Size <= 0 {
+		c.Size = defaultBufferSize
+	}
+	return c
+}
+
+// BufferStats is the snapshot of the offline buffer
+type BufferStats struct {
+	// Number of buffered messages
+	Depth int
+	// Number of messages which were dropped because the buffer was full
+	Dropped int64
+}
+
+type bufferedPublish struct {
+	key uint64
+	pb  *message.Publish
+}
+
+type offlineBuffer struct {
+	config   OfflineBufferConfig
+	store    Store
+	clientId string
+	messages []bufferedPublish
+	key      uint64
+	dropped  int64
+	// Connection which has sent all buffered messages, then publishes are sent directly while it's alive
+	online *connection
+	mu     sync.Mutex
+}
+
+func newOfflineBuffer(config OfflineBufferConfig) *offlineBuffer {
+	return &offlineBuffer{
+		config: config,
+	}
+}
+
+// Buffer the message while the client is offline or older messages remain in order to keep the order,
+// and returns false when the message should be sent directly
+func (b *offlineBuffer) push(pb *message.Publish) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.online != nil && b.online.ctx.Err() == nil && len(b.messages) == 0 {
+		return false, nil
+	}
+	if len(b.messages) >= b.config.Size {
+		b.dropped++
+		if b.config.Policy == DropNewest {
+			return true, ErrBufferFull
+		}
+		log.Debug("offline buffer is full, drop the oldest message")
+		b.deleteStored(b.messages[0].key)
+		b.messages = b.messages[1:]
+	}
+
+	b.key++
+	if b.store != nil {
+		packet, err := encodeBuffered(pb)
+		if err != nil {
+			return true, errors.Wrap(err, "failed to encode buffered message")
+		}
+		if err := b.store.PutBuffered(b.clientId, b.key, packet); err != nil {
+			return true, errors.Wrap(err, "failed to save buffered message")
+		}
+	}
+	b.messages = append(b.messages, bufferedPublish{key: b.key, pb: pb})
+	return true, nil
+}
+
+// Get the oldest buffered message. When no message remains, following publishes are sent directly to the connection
+func (b *offlineBuffer) next(conn *connection) (bufferedPublish, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.messages) == 0 {
+		b.online = conn
+		return bufferedPublish{}, false
+	}
+	return b.messages[0], true
+}
+
+// Remove the message which has been handed to the connection
+func (b *offlineBuffer) remove(key uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, m := range b.messages {
+		if m.key == key {
+			b.messages = append(b.messages[:i], b.messages[i+1:]...)
+			b.deleteStored(key)
+			return
+		}
+	}
+}
+
+func (b *offlineBuffer) deleteStored(key uint64) {
+	if b.store == nil {
+		return
+	}
+	if err := b.store.DeleteBuffered(b.clientId, key); err != nil {
+		log.Debug("failed to delete buffered message: ", err)
+	}
+}
+
+func (b *offlineBuffer) stats() BufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BufferStats{
+		Depth:   len(b.messages),
+		Dropped: b.dropped,
+	}
+}
+
+// Packet identifier is allocated when the message is sent, so placeholder is encoded for QoS1 and QoS2
+func encodeBuffered(pb *message.Publish) ([]byte, error) {
+	if pb.QoS > message.QoS0 {
+		pb = pb.Copy()
+		pb.PacketId = 1
+	}
+	return pb.Encode()
+}
+
+// Restore messages which were buffered by the previous process
+func (c *Client) restoreBuffer(b *offlineBuffer) error {
+	messages, err := c.store.LoadBuffered(c.clientId)
+	if err != nil {
+		return errors.Wrap(err, "failed to load buffered messages")
+	}
+	b.store = c.store
+	b.clientId = c.clientId
+	for _, m := range messages {
+		pb, err := c.decodeStored(StoredMessage{Packet: m.Packet})
+		if err != nil {
+			log.Debug("skip invalid buffered message: ", err)
+			continue
+		}
+		pb.PacketId = 0
+		b.messages = append(b.messages, bufferedPublish{key: m.Key, pb: pb})
+		if m.Key > b.key {
+			b.key = m.Key
+		}
+	}
+	log.Debugf("%d buffered messages are restored", len(b.messages))
+	return nil
+}
+
+// Send buffered messages in order. Message is removed from the buffer when it's taken over by the session,
+// then it's resent on session resumption even if the connection is lost before completion
+func (c *Client) drain(conn *connection, sess *session.Session) {
+	for conn.ctx.Err() == nil {
+		m, ok := c.buffer.next(conn)
+		if !ok {
+			return
+		}
+		if m.pb.QoS == message.QoS0 {
+			if err := c.writeTo(conn, m.pb); err != nil {
+				log.Debug("failed to send buffered message: ", err)
+				return
+			}
+			c.buffer.remove(m.key)
+			continue
+		}
+		out, err := sess.Allocate(m.pb)
+		if err != nil {
+			log.Debug("failed to allocate packet identifier for buffered message: ", err)
+			return
+		}
+		c.buffer.remove(m.key)
+		if err := sess.Send(out.PacketId); err != nil {
+			if _, ok := err.(*session.ReasonError); ok {
+				log.Debug("buffered message is refused by the broker: ", err)
+				continue
+			}
+			log.Debug("failed to send buffered message: ", err)
+			return
+		}
+	}
+}
+
+// Get the depth of the offline buffer, zero value is returned if the buffer isn't enabled
+func (c *Client) BufferStats() BufferStats {
+	if c.buffer == nil {
+		return BufferStats{}
+	}
+	return c.buffer.stats()
+}
@@ -0,0 +1,108 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestClientBuffersPublishesWhileDisconnected(t *testing.T) {
+	first := broker.NewBroker(":21261", broker.WithSysInterval(0))
+	stop := serveBroker(first)
+	time.Sleep(100 * time.Millisecond)
+
+	lost := make(chan error, 1)
+	c := client.NewClient("mqtt://localhost:21261")
+	assert.NoError(t, c.Connect(context.Background(),
+		client.WithClientId("buffered-client"),
+		client.WithAutoReconnect(client.ReconnectConfig{
+			InitialDelay: time.Second,
+			MaxDelay:     time.Second,
+		}),
+		client.WithOnConnectionLost(func(err error) {
+			lost <- err
+		}),
+		client.WithOfflineBuffer(client.OfflineBufferConfig{
+			Size:   3,
+			Policy: client.DropOldest,
+		}),
+	))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+
+	stop()
+	select {
+	case <-lost:
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection lost is not notified")
+	}
+	for i := 1; i <= 4; i++ {
+		assert.NoError(t, c.Publish("buffer/foo", []byte(fmt.Sprintf("message-%d", i)), client.WithQoS(message.QoS1)))
+	}
+	assert.Equal(t, client.BufferStats{Depth: 3, Dropped: 1}, c.BufferStats())
+
+	// Subscribe before the publisher reconnects
+	second := broker.NewBroker(":21261", broker.WithSysInterval(0))
+	defer serveBroker(second)()
+	time.Sleep(100 * time.Millisecond)
+	sub := client.NewClient("mqtt://localhost:21261")
+	assert.NoError(t, sub.Connect(context.Background()))
+	defer func() {
+		go sub.Disconnect()
+		<-sub.Closed
+	}()
+	assert.NoError(t, sub.Subscribe("buffer/#", nil, client.WithQoS(message.QoS1)))
+
+	for i := 2; i <= 4; i++ {
+		pb := receiveMessage(t, sub)
+		assert.Equal(t, fmt.Sprintf("message-%d", i), string(pb.Body))
+	}
+	assert.Equal(t, 0, c.BufferStats().Depth)
+
+	// Buffer is empty, then publish is sent directly
+	assert.NoError(t, c.Publish("buffer/foo", []byte("direct"), client.WithQoS(message.QoS1)))
+	assert.Equal(t, "direct", string(receiveMessage(t, sub).Body))
+}
+
+func TestClientOfflineBufferRejectsNewest(t *testing.T) {
+	b := broker.NewBroker(":21262", broker.WithSysInterval(0))
+	stop := serveBroker(b)
+	time.Sleep(100 * time.Millisecond)
+
+	lost := make(chan error, 1)
+	c := client.NewClient("mqtt://localhost:21262")
+	assert.NoError(t, c.Connect(context.Background(),
+		client.WithAutoReconnect(client.ReconnectConfig{
+			InitialDelay: time.Minute,
+		}),
+		client.WithOnConnectionLost(func(err error) {
+			lost <- err
+		}),
+		client.WithOfflineBuffer(client.OfflineBufferConfig{
+			Size:   1,
+			Policy: client.DropNewest,
+		}),
+	))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+
+	stop()
+	select {
+	case <-lost:
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection lost is not notified")
+	}
+	assert.NoError(t, c.Publish("buffer/foo", []byte("kept")))
+	assert.Equal(t, client.ErrBufferFull, c.Publish("buffer/foo", []byte("rejected")))
+	assert.Equal(t, client.BufferStats{Depth: 1, Dropped: 1}, c.BufferStats())
+}
@@ -18,77 +18,290 @@ type ConnectionOption = message.ConnectProperty
 type ServerInfo = message.ConnAckProperty
 
 type Client struct {
-	packetId *uint32
 	url      string
-	conn     net.Conn
+	clientId string
+	conn     *connection
 	ctx      context.Context
 	session  *session.Session
+	// Cancel the context of the client, it closes the connection and stops reconnection
+	terminate context.CancelFunc
+	// CONNECT packet which is sent again on reconnection
+	connectMessage *message.Connect
+
+	// Automatic reconnection is disabled if nil
+	reconnect        *ReconnectConfig
+	onConnectionLost func(err error)
+	onReconnect      func()
+	// Session state is persisted if the store is set
+	store Store
+	// Publishes are buffered while disconnected if the buffer is set
+	buffer *offlineBuffer
+	// Subscriptions which are restored when the broker doesn't have the session on reconnection
+	subscriptions map[string]subscription
+	// Dispatch incoming messages to the handlers of subscriptions
+	router *router
+
+	responseTopic string
+	responseMu    sync.Mutex
+	requests      sync.Map
+	handlers      map[string]RequestHandler
 
 	Closed  chan struct{}
 	Message chan *message.Publish
 
+	// Protocol version of the connection
+	version uint8
+
 	once       sync.Once
 	ServerInfo *ServerInfo
 	mu         sync.Mutex
+	// Guard the connection and session which are replaced on reconnection
+	connMu sync.Mutex
+	closed bool
 }
 
 func NewClient(u string) *Client {
-	var packetId uint32 = 0
 	return &Client{
-		packetId: &packetId,
-		url:      u,
+		url:           u,
+		handlers:      make(map[string]RequestHandler),
+		subscriptions: make(map[string]subscription),
+		router:        newRouter(),
 	}
 }
 
 func (c *Client) Connect(ctx context.Context, options ...ClientOption) error {
-	var err error
-
-	if c.conn, c.ServerInfo, err = connect(c.url, options); err != nil {
+	if err := validateOptions(options); err != nil {
+		return err
+	}
+	cm := makeConnectionMessage(options)
+	cctx, terminate := context.WithCancel(ctx)
+	conn, ack, err := connect(cctx, c.url, cm)
+	if err != nil {
+		terminate()
 		return errors.Wrap(err, "failed to connect to "+c.url)
 	}
 
 	log.Debug("connection established!")
 
-	c.ctx = ctx
+	// Keep in-flight messages and QoS2 state of the previous connection when the session is resumed
+	resume := c.session != nil && c.clientId == cm.ClientId && !cm.CleanStart
+	c.clientId = cm.ClientId
+	c.version = cm.ProtocolVersion
+	c.connectMessage = cm
+	c.ctx, c.terminate = cctx, terminate
 	c.Closed = make(chan struct{})
 	c.Message = make(chan *message.Publish)
-	c.session = session.New(c.conn, c.ctx)
+	var bufferConfig *OfflineBufferConfig
+	for _, o := range options {
+		switch o.name {
+		case nameReconnect:
+			config := o.value.(ReconnectConfig).withDefaults()
+			c.reconnect = &config
+		case nameOnConnectionLost:
+			c.onConnectionLost = o.value.(func(error))
+		case nameOnReconnect:
+			c.onReconnect = o.value.(func())
+		case nameStore:
+			c.store = o.value.(Store)
+		case nameOfflineBuffer:
+			config := o.value.(OfflineBufferConfig).withDefaults()
+			bufferConfig = &config
+		case nameDefaultHandler:
+			c.router.setDefault(o.value.(MessageHandler))
+		case nameOnHandlerPanic:
+			c.router.setOnPanic(o.value.(func(*message.Publish, interface{})))
+		}
+	}
+	abort := func(err error) error {
+		conn.Close()
+		conn.reader.Release()
+		terminate()
+		return err
+	}
+	// Replay messages which were saved by the previous process
+	if c.store != nil && !resume {
+		sess, err := c.restoreSession(cctx, cm.ClientId)
+		if err != nil {
+			return abort(errors.Wrap(err, "failed to restore session"))
+		}
+		c.session = sess
+		resume = true
+	}
+	// Buffer is kept over Connect calls, so remaining messages are sent by the next connection
+	if bufferConfig != nil && c.buffer == nil {
+		buffer := newOfflineBuffer(*bufferConfig)
+		if bufferConfig.Persistent {
+			if c.store == nil {
+				return abort(errors.New("persistent offline buffer requires the store"))
+			}
+			if err := c.restoreBuffer(buffer); err != nil {
+				return abort(errors.Wrap(err, "failed to restore offline buffer"))
+			}
+		}
+		c.buffer = buffer
+	}
+	c.start(conn, ack, resume)
 
-	go c.mainLoop()
+	return nil
+}
 
+// Check combination of the options before connecting
+func validateOptions(options []ClientOption) error {
+	var store, clientId bool
+	for _, o := range options {
+		switch o.name {
+		case nameStore:
+			store = true
+		case nameClientId:
+			clientId = true
+		}
+	}
+	// Stored messages are looked up by the client identifier, generated one is different for each process
+	if store && !clientId {
+		return errors.New("store requires the fixed client identifier by WithClientId")
+	}
 	return nil
 }
 
+// Start goroutines for the connection, and returns false if the client has been closed.
+// Resumed session takes over in-flight messages and QoS2 state from the previous connection
+func (c *Client) start(conn *connection, ack *message.ConnAck, resume bool) bool {
+	sess := session.New(conn.writer, conn.ctx)
+	c.connMu.Lock()
+	if c.closed {
+		c.connMu.Unlock()
+		conn.Close()
+		conn.reader.Release()
+		return false
+	}
+	if resume && c.session != nil {
+		sess.Takeover(c.session)
+	}
+	if c.store != nil {
+		sess.Persist(storePersistence{store: c.store, clientId: c.clientId})
+	}
+	c.conn = conn
+	c.session = sess
+	c.ServerInfo = ack.Property
+	c.connMu.Unlock()
+
+	// Negotiated keepalive, broker's ServerKeepAlive takes precedence over ours
+	keepAlive := time.Duration(c.connectMessage.KeepAlive) * time.Second
+	if ack.Property != nil && ack.Property.ServerKeepAlive > 0 {
+		keepAlive = time.Duration(ack.Property.ServerKeepAlive) * time.Second
+	}
+
+	go c.mainLoop(conn, sess)
+	if keepAlive > 0 {
+		go c.pingLoop(conn, keepAlive)
+	}
+	// Buffered messages are sent after the session is resumed in order to keep the order of messages
+	go func() {
+		if resume {
+			if err := c.resume(sess, ack.SessionPresentFlag); err != nil {
+				log.Debug("failed to resume session: ", err)
+				return
+			}
+		}
+		if c.buffer != nil {
+			c.drain(conn, sess)
+		}
+	}()
+	return true
+}
+
+// Get the connection and session which are currently used
+func (c *Client) current() (*connection, *session.Session) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn, c.session
+}
+
 func (c *Client) Disconnect() {
 	c.once.Do(func() {
 		log.Debug("============================ Client closing =======================")
 
+		c.connMu.Lock()
+		c.closed = true
+		conn := c.conn
+		c.connMu.Unlock()
+
 		dc := message.NewDisconnect(message.NormalDisconnection)
-		if err := message.WriteFrame(c.conn, dc); err != nil {
+		if err := c.writeTo(conn, dc); err != nil {
 			log.Debug("failed to send DISCONNECT message: ", err)
 		}
 		log.Debug("Closing connection")
-		c.conn.Close()
+		conn.Close()
+		c.terminate()
 		log.Debug("connection closed, send channel")
 		c.Closed <- struct{}{}
 		log.Debug("channel sent")
 	})
 }
 
-func (c *Client) mainLoop() {
-	pingInterval := time.NewTicker(5 * time.Second)
-	defer pingInterval.Stop()
-	defer c.Disconnect()
+// Handle the end of the connection. Client reconnects if automatic reconnection is enabled,
+// otherwise the client is closed
+func (c *Client) connectionLost(conn *connection, err error) {
+	conn.Close()
+	// Client has been closed by Disconnect() or the context
+	if c.ctx.Err() != nil {
+		c.Disconnect()
+		return
+	}
+	log.Debug("connection lost: ", err)
+	if c.onConnectionLost != nil {
+		c.onConnectionLost(err)
+	}
+	if c.reconnect == nil {
+		c.Disconnect()
+		return
+	}
+	c.reconnectLoop()
+}
+
+// Send PINGREQ at keepalive interval.
+// If PINGRESP hasn't arrived until the next interval, the connection is regarded as lost and closed.
+func (c *Client) pingLoop(conn *connection, keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-conn.ctx.Done():
+			return
+		case <-ticker.C:
+			if !atomic.CompareAndSwapInt32(&conn.pinging, 0, 1) {
+				log.Debug("PINGRESP is not received in keepalive, close connection")
+				conn.Close()
+				return
+			}
+			if err := c.writeTo(conn, message.NewPingReq()); err != nil {
+				log.Debug("failed to send PINGREQ: ", err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) mainLoop(conn *connection, sess *session.Session) {
+	var err error
+	defer func() {
+		conn.reader.Release()
+		c.connectionLost(conn, err)
+	}()
+
+	for {
+		select {
+		case <-conn.ctx.Done():
 			log.Debugf("terminated")
 			return
-		case <-pingInterval.C:
-			message.WriteFrame(c.conn, message.NewPingReq())
 		default:
-			frame, payload, err := message.ReceiveFrame(c.conn)
+			var (
+				frame   *message.Frame
+				payload []byte
+			)
+			frame, payload, err = conn.ReadFrame()
 			if err != nil {
 				log.Debug("failed to receive message: ", err)
 				if nerr, ok := err.(net.Error); ok {
@@ -99,19 +312,31 @@ func (c *Client) mainLoop() {
 				}
 				return
 			}
+			frame.SetVersion(c.version)
 			switch frame.Type {
 			case message.PINGRESP:
 				if _, err := message.ParsePingResp(frame, payload); err != nil {
 					log.Debug("malformed packet: failed to decode to PINGREQ packet: ", err)
 					continue
 				}
+				atomic.StoreInt32(&conn.pinging, 0)
 			case message.SUBACK:
 				ack, err := message.ParseSubAck(frame, payload)
 				if err != nil {
 					log.Debug("malformed packet: failed to decode to SUBACK packet: ", err)
 					continue
 				}
-				if err := c.session.Meet(ack.PacketId, message.SUBACK, ack); err != nil {
+				if err := sess.Meet(ack.PacketId, message.SUBACK, ack); err != nil {
+					log.Debug("malformed packet: unexpected packet identifier received: ", err)
+					continue
+				}
+			case message.UNSUBACK:
+				ack, err := message.ParseUnsubAck(frame, payload)
+				if err != nil {
+					log.Debug("malformed packet: failed to decode to UNSUBACK packet: ", err)
+					continue
+				}
+				if err := sess.Meet(ack.PacketId, message.UNSUBACK, ack); err != nil {
 					log.Debug("malformed packet: unexpected packet identifier received: ", err)
 					continue
 				}
@@ -121,7 +346,7 @@ func (c *Client) mainLoop() {
 					log.Debug("malformed packet: failed to decode to PUBACK packet: ", err)
 					continue
 				}
-				if err := c.session.Meet(ack.PacketId, message.PUBACK, ack); err != nil {
+				if err := sess.Meet(ack.PacketId, message.PUBACK, ack); err != nil {
 					log.Debug("malformed packet: unexpected packet identifier received: ", err)
 					continue
 				}
@@ -130,7 +355,7 @@ func (c *Client) mainLoop() {
 				if err != nil {
 					log.Debug("malformed packet: failed to decode to PUBLISH packet: ", err)
 					continue
-				} else if err := c.receivePublish(pb); err != nil {
+				} else if err := c.receivePublish(conn, sess, pb); err != nil {
 					log.Debug("client failed to process publish pakcet: ", err)
 					continue
 				}
@@ -140,7 +365,7 @@ func (c *Client) mainLoop() {
 					log.Debug("malformed packet: failed to decode to PUBREC packet: ", err)
 					continue
 				}
-				if err := c.session.Meet(ack.PacketId, message.PUBREC, ack); err != nil {
+				if err := sess.Meet(ack.PacketId, message.PUBREC, ack); err != nil {
 					log.Debug("malformed packet: unexpected packet identifier received: ", err)
 					continue
 				}
@@ -151,27 +376,28 @@ func (c *Client) mainLoop() {
 					continue
 				}
 				log.Debug("PUBREL package received")
-				pb, ok := c.session.LoadMessage(pl.PacketId)
+				// Message is nil for retransmitted PUBREL, then respond PUBCOMP again without delivering
+				pb, ok := sess.Release(pl.PacketId)
+				pc := message.NewPubComp(pl.PacketId)
 				if !ok {
 					log.Debug("Client received PUBREL packet, but message wan't saved")
-					continue
+					pc.ReasonCode = message.PacketIdentifierNotFound
 				}
-				log.Debug("Message found")
-				pc := message.NewPubComp(pl.PacketId)
-				if err := message.WriteFrame(c.conn, pc); err != nil {
+				if err := c.writeTo(conn, pc); err != nil {
 					log.Debug("failed to send PUBCOMP packet to publisher")
 					continue
 				}
 				log.Debug("Send PUBCOMP")
-				c.Message <- pb
-				c.session.DeleteMessage(pl.PacketId)
+				if pb != nil {
+					c.deliver(pb)
+				}
 			case message.PUBCOMP:
 				ack, err := message.ParsePubComp(frame, payload)
 				if err != nil {
 					log.Debug("malformed packet: failed to decode to PUBCOMP packet: ", err)
 					continue
 				}
-				if err := c.session.Meet(ack.PacketId, message.PUBCOMP, ack); err != nil {
+				if err := sess.Meet(ack.PacketId, message.PUBCOMP, ack); err != nil {
 					log.Debug("malformed packet: unexpected packet identifier received: ", err)
 					continue
 				}
@@ -180,39 +406,19 @@ func (c *Client) mainLoop() {
 	}
 }
 
-func (c *Client) makePacketId() uint16 {
-	if *c.packetId == 0xFFFF {
-		atomic.StoreUint32(c.packetId, 1)
-	} else {
-		atomic.AddUint32(c.packetId, 1)
-	}
-	return uint16(*c.packetId)
+// Write packet to the current connection
+func (c *Client) write(m message.Encoder) error {
+	conn, _ := c.current()
+	return c.writeTo(conn, m)
 }
 
-func (c *Client) Subscribe(topic string, qos message.QoSLevel) error {
-	packetId := c.makePacketId()
-
-	ss := message.NewSubscribe()
-	ss.PacketId = packetId
-	// TODO: enable to set Retain handling, NoLocal flag
-	ss.AddTopic(message.SubscribeTopic{
-		TopicName: topic,
-		QoS:       qos,
-	})
-
-	log.Debug("send subscribe")
-	if ack, err := c.session.Start(packetId, message.SUBACK, ss, 0); err != nil {
-		log.Debug("failed to finish session: ", err)
-		return err
-	} else if _, ok := ack.(*message.SubAck); !ok {
-		log.Debug("unexpected ack received")
-		return errors.New("unexpected ack received")
-	}
-	log.Debug("sent subscribe")
-	return nil
+// Write packet which is encoded by the protocol version of the connection
+func (c *Client) writeTo(conn *connection, m message.Encoder) error {
+	m.SetVersion(c.version)
+	return conn.WriteFrame(m)
 }
 
-func (c *Client) Publish(topic string, body []byte, opts ...ClientOption) error {
+func makePublishMessage(topic string, body []byte, opts []ClientOption) *message.Publish {
 	pb := message.NewPublish(0, message.WithQoS(message.QoS0))
 	for _, o := range opts {
 		switch o.name {
@@ -220,65 +426,85 @@ func (c *Client) Publish(topic string, body []byte, opts ...ClientOption) error
 			pb.SetRetain(true)
 		case nameQoS:
 			pb.SetQoS(o.value.(message.QoSLevel))
+		case nameProperty:
+			pb.Property = o.value.(*message.PublishProperty)
 		}
 	}
 	pb.TopicName = topic
 	pb.Body = body
+	return pb
+}
+
+// Publish message to the broker, QoS1/QoS2 message waits until the flow completes.
+// session.ReasonError is returned when the broker refuses the message by the reason code
+func (c *Client) Publish(topic string, body []byte, opts ...ClientOption) error {
+	return c.publish(makePublishMessage(topic, body, opts))
+}
+
+func (c *Client) publish(pb *message.Publish) error {
+	pb.SetVersion(c.version)
+	c.connMu.Lock()
+	closed := c.closed
+	c.connMu.Unlock()
+	if closed {
+		return errors.New("client is closed")
+	}
+	if c.buffer != nil {
+		if buffered, err := c.buffer.push(pb); buffered || err != nil {
+			return err
+		}
+	}
+	if conn, _ := c.current(); conn == nil {
+		return errors.New("client is not connected")
+	}
+
 	switch pb.QoS {
 	case message.QoS0:
 		// If OoS is zero, we don't need packet identifier and any acknowledgment
-		if err := message.WriteFrame(c.conn, pb); err != nil {
+		if err := c.write(pb); err != nil {
 			log.Debug("failed to send publish with QoS0 ", err)
 			return errors.Wrap(err, "failed to send publish with QoS0")
 		}
-	case message.QoS1:
-		pb.PacketId = c.makePacketId()
-		if ack, err := c.session.Start(pb.PacketId, message.PUBACK, pb, session.MaxRetries); err != nil {
-			log.Debug("failed to publish session for QoS1: ", err)
-			return errors.Wrap(err, "failed to publish session for QoS1")
-		} else if _, ok := ack.(*message.PubAck); !ok {
-			log.Debug("failed to type conversion for OoS1")
-			return errors.New("failed to type conversion for QoS1")
+	default:
+		conn, sess := c.current()
+		if conn.ctx.Err() != nil {
+			return errors.New("connection is closed")
 		}
-	case message.QoS2:
-		pb.PacketId = c.makePacketId()
-		if ack, err := c.session.Start(pb.PacketId, message.PUBREC, pb, session.MaxRetries); err != nil {
-			log.Debug("failed to publish session for QoS2: ", err)
-			return errors.Wrap(err, "failed to publish session for QoS2")
-		} else if _, ok := ack.(*message.PubRec); !ok {
-			log.Debug("failed to type conversion fto PUBREC or QoS2")
-			return errors.New("failed to type conversion fto PUBREC or QoS2")
+		// Message is kept in the session until the flow completes, and resent when the session is resumed
+		out, err := sess.Allocate(pb)
+		if err != nil {
+			log.Debug("failed to allocate packet identifier: ", err)
+			return errors.Wrap(err, "failed to allocate packet identifier")
 		}
-		log.Debug("PUBREC received. Send PUBREL")
-		time.Sleep(10 * time.Millisecond)
-		// On QoS2, need to send more packet for PUBREL
-		pl := message.NewPubRel(pb.PacketId)
-		if ack, err := c.session.Start(pb.PacketId, message.PUBCOMP, pl, session.MaxRetries); err != nil {
-			log.Debug("failed to pubrel session for QoS2: ", err)
-			return errors.Wrap(err, "failed to pubrel session for QoS2")
-		} else if _, ok := ack.(*message.PubComp); !ok {
-			log.Debug("failed to type conversion to PUBCOMP for QoS2")
-			return errors.New("failed to type conversion to PUBCOMP for QoS2")
+		if err := sess.Send(out.PacketId); err != nil {
+			// Refusal by the broker is returned as it is in order to check the reason code
+			if _, ok := err.(*session.ReasonError); ok {
+				return err
+			}
+			log.Debugf("failed to publish session for QoS%d: %s", pb.QoS, err)
+			return errors.Wrapf(err, "failed to publish session for QoS%d", pb.QoS)
 		}
 	}
 	return nil
 }
 
-func (c *Client) receivePublish(pb *message.Publish) error {
+func (c *Client) receivePublish(conn *connection, sess *session.Session, pb *message.Publish) error {
 	log.Debugf("PUBLISH message received with QoS: %d\n", pb.QoS)
 	switch pb.QoS {
 	case message.QoS0:
-		c.Message <- pb
+		c.deliver(pb)
 	case message.QoS1:
 		log.Debug("Send PUBACK to the publisher")
-		if err := message.WriteFrame(c.conn, message.NewPubAck(pb.PacketId)); err != nil {
+		if err := c.writeTo(conn, message.NewPubAck(pb.PacketId)); err != nil {
 			log.Debug("failed to send PUBACK packet")
 			return errors.Wrap(err, "failed to send PUBACK packet")
 		}
-		c.Message <- pb
+		c.deliver(pb)
 	case message.QoS2:
-		c.session.StoreMessage(pb)
-		if err := message.WriteFrame(c.conn, message.NewPubRec(pb.PacketId)); err != nil {
+		// Retransmitted PUBLISH is only acknowledged again, stored message isn't replaced
+		ack := message.NewPubRec(pb.PacketId)
+		ack.ReasonCode = sess.Receive(pb)
+		if err := c.writeTo(conn, ack); err != nil {
 			log.Debug("failed to send PUBREC packet")
 			return errors.Wrap(err, "failed to send PUBREC packet")
 		}
@@ -288,3 +514,10 @@ func (c *Client) receivePublish(pb *message.Publish) error {
 	}
 	return nil
 }
+
+func (c *Client) deliver(pb *message.Publish) {
+	if c.receiveResponse(pb) || c.receiveRequest(pb) || c.router.dispatch(pb) {
+		return
+	}
+	c.Message <- pb
+}
@@ -0,0 +1,35 @@
+package client_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Start broker and return the function which stops it and waits for the listener to be closed
+func serveBroker(b *broker.Broker) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.ListenAndServe(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func receiveMessage(t *testing.T, c *client.Client) *message.Publish {
+	select {
+	case pb := <-c.Message:
+		return pb
+	case <-time.After(3 * time.Second):
+		t.Fatal("message is not received")
+	}
+	return nil
+}
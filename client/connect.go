@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"net"
 	"time"
 
@@ -14,11 +15,17 @@ import (
 	"github.com/ysugimoto/gqtt/message"
 )
 
+const defaultKeepAlive = 30
+
 func makeConnectionMessage(opts []ClientOption) *message.Connect {
 	connect := message.NewConnect()
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 5
 	connect.ClientId = uuid.NewV4().String()
+	connect.KeepAlive = defaultKeepAlive
+	// Session is discarded unless the client resumes it by automatic reconnection or the store
+	connect.CleanStart = true
 
-	var exists bool
 	p := &message.ConnectProperty{}
 	for _, o := range opts {
 		log.Debugf("option data %+v", o)
@@ -28,13 +35,24 @@ func makeConnectionMessage(opts []ClientOption) *message.Connect {
 			v := o.value.(map[string]string)
 			d := base64.StdEncoding.EncodeToString([]byte(v["user"] + ":" + v["pass"]))
 			p.AuthenticationData = []byte(d)
-			exists = true
 		case nameLoginAuth:
 			p.AuthenticationMethod = "login"
 			v := o.value.(map[string]string)
 			p.AuthenticationData = []byte(v["user"])
 			p.ChallengeData = v
-			exists = true
+		case nameClientId:
+			connect.ClientId = o.value.(string)
+		case nameKeepAlive:
+			connect.KeepAlive = o.value.(uint16)
+		case nameVersion:
+			connect.ProtocolVersion = o.value.(uint8)
+		case nameSessionExpiry:
+			p.SessionExpiryInterval = o.value.(uint32)
+		case nameRequestResponse:
+			// Response information is used for the response topic of Request
+			p.RequestResponseInformation = true
+		case nameReconnect, nameStore:
+			connect.CleanStart = false
 		case nameWill:
 			v := o.value.(map[string]interface{})
 			connect.FlagWill = true
@@ -47,18 +65,60 @@ func makeConnectionMessage(opts []ClientOption) *message.Connect {
 			}
 		}
 	}
-	if exists {
-		connect.Property = p
+	// v3.1.1 doesn't have properties, so Request/Response and enhanced authentication are not available
+	if connect.ProtocolVersion == message.Version311 {
+		p = nil
 	}
+	connect.Property = p
 	return connect
 }
 
-func connect(u string, opts []ClientOption) (net.Conn, *ServerInfo, error) {
+// Network connection with the reader and writer which are kept until the connection is closed.
+// Context is canceled on closing, then goroutines and sessions of the connection finish
+type connection struct {
+	net.Conn
+	reader *message.PacketReader
+	writer *message.PacketWriter
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Set while PINGREQ is waiting for PINGRESP
+	pinging int32
+}
+
+func newConnection(ctx context.Context, conn net.Conn) *connection {
+	cctx, cancel := context.WithCancel(ctx)
+	return &connection{
+		Conn:   conn,
+		reader: message.NewPacketReader(conn),
+		writer: message.NewPacketWriter(conn),
+		ctx:    cctx,
+		cancel: cancel,
+	}
+}
+
+func (c *connection) ReadFrame() (*message.Frame, []byte, error) {
+	return c.reader.ReadFrame()
+}
+
+func (c *connection) WriteFrame(m message.Encoder) error {
+	return c.writer.WriteFrame(m)
+}
+
+// Close the connection and stop the writer.
+// Reader is released by the receiving loop because it may be reading at this time
+func (c *connection) Close() error {
+	err := c.Conn.Close()
+	c.writer.Close()
+	c.cancel()
+	return err
+}
+
+func connect(ctx context.Context, u string, c *message.Connect) (*connection, *message.ConnAck, error) {
 	var (
 		conn   net.Conn
 		err    error
 		parsed *url.URL
-		info   *ServerInfo
+		ack    *message.ConnAck
 	)
 
 	parsed, err = url.Parse(u)
@@ -82,17 +142,18 @@ func connect(u string, opts []ClientOption) (net.Conn, *ServerInfo, error) {
 		return nil, nil, errors.New("connection protocol must start with mqtt(s)://")
 	}
 
-	if info, err = handshake(conn, opts); err != nil {
+	cn := newConnection(ctx, conn)
+	if ack, err = handshake(cn, c); err != nil {
 		log.Debug("failed to handshake with server: ", err)
-		conn.Close()
+		cn.Close()
+		cn.reader.Release()
 		return nil, nil, errors.Wrap(err, "failed to handshake with server")
 	}
-	return conn, info, nil
+	return cn, ack, nil
 }
 
-func handshake(conn net.Conn, opts []ClientOption) (*ServerInfo, error) {
-	c := makeConnectionMessage(opts)
-	if err := message.WriteFrame(conn, c); err != nil {
+func handshake(conn *connection, c *message.Connect) (*message.ConnAck, error) {
+	if err := conn.WriteFrame(c); err != nil {
 		log.Debug("failed to write CONNECT packet: ", err)
 		return nil, errors.Wrap(err, "failed to write CONNECT packet")
 	}
@@ -103,11 +164,12 @@ func handshake(conn net.Conn, opts []ClientOption) (*ServerInfo, error) {
 	defer conn.SetReadDeadline(time.Time{})
 
 	for {
-		frame, payload, err := message.ReceiveFrame(conn)
+		frame, payload, err := conn.ReadFrame()
 		if err != nil {
 			log.Debug("failed to read CONNACK packet: ", err)
 			return nil, errors.Wrap(err, "failed to read CONNACK packet")
 		}
+		frame.SetVersion(c.ProtocolVersion)
 		switch frame.Type {
 		case message.CONNACK:
 			ack, err := message.ParseConnAck(frame, payload)
@@ -119,7 +181,7 @@ func handshake(conn net.Conn, opts []ClientOption) (*ServerInfo, error) {
 				return nil, errors.New("CONNACK doesn't reply success code")
 			} else {
 				log.Debug("CONNACK received, clientId is ", c.ClientId)
-				return ack.Property, nil
+				return ack, nil
 			}
 		case message.AUTH:
 			auth, err := message.ParseAuth(frame, payload)
@@ -130,8 +192,6 @@ func handshake(conn net.Conn, opts []ClientOption) (*ServerInfo, error) {
 			switch auth.ReasonCode {
 			case message.Success:
 				log.Debug("Authentication success")
-				// Authenticate succeed on broker
-				time.Sleep(10 * time.Millisecond)
 				continue
 			case message.ContinueAuthentication:
 				if err := authenticate(conn, c.Property); err != nil {
@@ -144,7 +204,7 @@ func handshake(conn net.Conn, opts []ClientOption) (*ServerInfo, error) {
 	}
 }
 
-func authenticate(conn net.Conn, prop *message.ConnectProperty) error {
+func authenticate(conn *connection, prop *message.ConnectProperty) error {
 	switch prop.AuthenticationMethod {
 	case "login":
 		auth := message.NewAuth(message.ContinueAuthentication)
@@ -153,7 +213,7 @@ func authenticate(conn net.Conn, prop *message.ConnectProperty) error {
 			AuthenticationMethod: "login",
 			AuthenticationData:   []byte(cd["pass"]),
 		}
-		if err := message.WriteFrame(conn, auth); err != nil {
+		if err := conn.WriteFrame(auth); err != nil {
 			log.Debug("failed to send AUTH packet: ", err)
 			return errors.Wrap(err, "failed to send AUTH packet")
 		}
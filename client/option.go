@@ -12,6 +12,24 @@ const (
 	nameWill      optionName = "will"
 	nameRetain    optionName = "retain"
 	nameQoS       optionName = "qos"
+	nameClientId  optionName = "clientId"
+	nameProperty  optionName = "property"
+	nameNoLocal   optionName = "noLocal"
+	nameRAP       optionName = "retainAsPublished"
+	nameKeepAlive optionName = "keepAlive"
+	nameVersion   optionName = "protocolVersion"
+
+	nameSessionExpiry     optionName = "sessionExpiry"
+	nameReconnect         optionName = "reconnect"
+	nameOnConnectionLost  optionName = "onConnectionLost"
+	nameOnReconnect       optionName = "onReconnect"
+	nameStore             optionName = "store"
+	nameOfflineBuffer     optionName = "offlineBuffer"
+	nameDefaultHandler    optionName = "defaultHandler"
+	nameDispatchMode      optionName = "dispatchMode"
+	nameOnHandlerPanic    optionName = "onHandlerPanic"
+	nameSubscribeProperty optionName = "subscribeProperty"
+	nameRequestResponse   optionName = "requestResponse"
 )
 
 type ClientOption struct {
@@ -65,3 +83,143 @@ func WithQoS(qos message.QoSLevel) ClientOption {
 		value: qos,
 	}
 }
+
+// Connect with fixed client identifier. Otherwise random identifier is used
+func WithClientId(clientId string) ClientOption {
+	return ClientOption{
+		name:  nameClientId,
+		value: clientId,
+	}
+}
+
+// Publish with properties
+func WithProperty(property *message.PublishProperty) ClientOption {
+	return ClientOption{
+		name:  nameProperty,
+		value: property,
+	}
+}
+
+// Subscribe with NoLocal option, the broker won't send back messages which this client published
+func WithNoLocal() ClientOption {
+	return ClientOption{
+		name:  nameNoLocal,
+		value: true,
+	}
+}
+
+// Subscribe with RetainAsPublished option, the broker keeps RETAIN flag as published
+func WithRetainAsPublished() ClientOption {
+	return ClientOption{
+		name:  nameRAP,
+		value: true,
+	}
+}
+
+// Connect with keepalive seconds. Zero disables keepalive, default is 30 seconds
+func WithKeepAlive(seconds uint16) ClientOption {
+	return ClientOption{
+		name:  nameKeepAlive,
+		value: seconds,
+	}
+}
+
+// Connect with protocol version, message.Version311 or message.Version5. Default is v5
+func WithProtocolVersion(version uint8) ClientOption {
+	return ClientOption{
+		name:  nameVersion,
+		value: version,
+	}
+}
+
+// Connect with SessionExpiryInterval seconds, the broker keeps the session for the duration after disconnection.
+// It's meaningful with automatic reconnection, and v3.1.1 broker keeps the session without expiry instead
+func WithSessionExpiry(seconds uint32) ClientOption {
+	return ClientOption{
+		name:  nameSessionExpiry,
+		value: seconds,
+	}
+}
+
+// Ask the broker for ResponseInformation on CONNECT, then Request uses it as the response topic.
+// Without this option, the response topic is made from the client identifier
+func WithRequestResponseInformation() ClientOption {
+	return ClientOption{
+		name:  nameRequestResponse,
+		value: true,
+	}
+}
+
+// Reconnect automatically when the connection is lost. Client connects with CleanStart=0 and fixed client identifier,
+// then resends in-flight messages and restores subscriptions if the broker doesn't have the session
+func WithAutoReconnect(config ReconnectConfig) ClientOption {
+	return ClientOption{
+		name:  nameReconnect,
+		value: config,
+	}
+}
+
+// Called when the connection is lost, but not called for Disconnect()
+func WithOnConnectionLost(fn func(err error)) ClientOption {
+	return ClientOption{
+		name:  nameOnConnectionLost,
+		value: fn,
+	}
+}
+
+// Called when automatic reconnection succeeds
+func WithOnReconnect(fn func()) ClientOption {
+	return ClientOption{
+		name:  nameOnReconnect,
+		value: fn,
+	}
+}
+
+// Persist in-flight messages and incoming QoS2 messages to the store, and replay them on the next connect.
+// Client connects with CleanStart=0 in order to resume the session, and WithClientId is required
+func WithStore(store Store) ClientOption {
+	return ClientOption{
+		name:  nameStore,
+		value: store,
+	}
+}
+
+// Accept publishes while the client is disconnected, and send them in order after reconnection
+func WithOfflineBuffer(config OfflineBufferConfig) ClientOption {
+	return ClientOption{
+		name:  nameOfflineBuffer,
+		value: config,
+	}
+}
+
+// Handle messages which don't match to any subscription handler, instead of Message channel
+func WithDefaultHandler(handler MessageHandler) ClientOption {
+	return ClientOption{
+		name:  nameDefaultHandler,
+		value: handler,
+	}
+}
+
+// Set how the handler of the subscription is called, default is DispatchOrdered
+func WithDispatchMode(mode DispatchMode) ClientOption {
+	return ClientOption{
+		name:  nameDispatchMode,
+		value: mode,
+	}
+}
+
+// Notify panic which is recovered from the message handler
+func WithOnHandlerPanic(fn func(pb *message.Publish, v interface{})) ClientOption {
+	return ClientOption{
+		name:  nameOnHandlerPanic,
+		value: fn,
+	}
+}
+
+// Set properties of SUBSCRIBE e.g. SubscriptionIdentifier and UserProperty, they are available on MQTT 5
+func WithSubscribeProperty(property *message.SubscribeProperty) ClientOption {
+	return ClientOption{
+		name:  nameSubscribeProperty,
+		value: property,
+	}
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+const (
+	defaultReconnectInitialDelay = time.Second
+	defaultReconnectMaxDelay     = 2 * time.Minute
+	defaultReconnectMultiplier   = 2
+	defaultReconnectJitter       = 0.2
+)
+
+// ReconnectConfig is the setting of automatic reconnection.
+// Delay grows exponentially from InitialDelay to MaxDelay, and each delay is randomized by Jitter
+type ReconnectConfig struct {
+	// Delay before the first reconnection, default is 1 second
+	InitialDelay time.Duration
+	// Upper limit of the delay, default is 2 minutes
+	MaxDelay time.Duration
+	// Factor to grow the delay for each failure, default is 2
+	Multiplier float64
+	// Ratio of randomization from 0 to 1, the delay is chosen from delay*(1-Jitter) to delay*(1+Jitter). Default is 0.2
+	Jitter float64
+	// Client is closed after the number of failures, zero means unlimited
+	MaxAttempts int
+}
+
+func (c ReconnectConfig) withDefaults() ReconnectConfig {
+	if c.InitialDelay <= 0 {
+		c.InitialDelay = defaultReconnectInitialDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaultReconnectMaxDelay
+	}
+	if c.Multiplier < 1 {
+		c.Multiplier = defaultReconnectMultiplier
+	}
+	if c.Jitter <= 0 || c.Jitter > 1 {
+		c.Jitter = defaultReconnectJitter
+	}
+	return c
+}
+
+// Delay before the reconnection of attempt which starts from zero
+func (c ReconnectConfig) delay(attempt int) time.Duration {
+	d := float64(c.InitialDelay)
+	for i := 0; i < attempt && d < float64(c.MaxDelay); i++ {
+		d *= c.Multiplier
+	}
+	if d > float64(c.MaxDelay) {
+		d = float64(c.MaxDelay)
+	}
+	// Spread reconnections of many clients which lost connections at the same time
+	d *= 1 + c.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
+
+// Reconnect with the same CONNECT packet until it succeeds or the client is closed
+func (c *Client) reconnectLoop() {
+	for attempt := 0; c.reconnect.MaxAttempts == 0 || attempt < c.reconnect.MaxAttempts; attempt++ {
+		delay := c.reconnect.delay(attempt)
+		log.Debugf("reconnect after %s", delay)
+		select {
+		case <-c.ctx.Done():
+			c.Disconnect()
+			return
+		case <-time.After(delay):
+		}
+
+		conn, ack, err := connect(c.ctx, c.url, c.connectMessage)
+		if err != nil {
+			log.Debug("failed to reconnect: ", err)
+			continue
+		}
+		if !c.start(conn, ack, true) {
+			return
+		}
+		log.Debug("reconnected to ", c.url)
+		if c.onReconnect != nil {
+			c.onReconnect()
+		}
+		return
+	}
+	log.Debug("reconnect attempts exceeded")
+	c.Disconnect()
+}
+
+// Restore the session after reconnection. Subscriptions are sent again when the broker doesn't have the session,
+// then in-flight messages are resent in order
+func (c *Client) resume(sess *session.Session, sessionPresent bool) error {
+	if !sessionPresent {
+		if err := c.resubscribe(sess); err != nil {
+			return errors.Wrap(err, "failed to restore subscriptions")
+		}
+	}
+	for _, id := range sess.Resume() {
+		log.Debug("resend in-flight message: ", id)
+		if err := sess.Send(id); err != nil {
+			if _, ok := err.(*session.ReasonError); ok {
+				log.Debug("resent message is refused by the broker: ", err)
+				continue
+			}
+			return errors.Wrap(err, "failed to resend in-flight message")
+		}
+	}
+	return nil
+}
+
+// Send subscriptions again. SUBSCRIBE has one property block,
+// then subscriptions are grouped by the properties and sent by one packet for each group
+func (c *Client) resubscribe(sess *session.Session) error {
+	type group struct {
+		prop   *message.SubscribeProperty
+		topics []message.SubscribeTopic
+	}
+	groups := []*group{}
+	c.mu.Lock()
+	for _, s := range c.subscriptions {
+		var found *group
+		for _, g := range groups {
+			if reflect.DeepEqual(g.prop, s.prop) {
+				found = g
+				break
+			}
+		}
+		if found == nil {
+			found = &group{prop: s.prop}
+			groups = append(groups, found)
+		}
+		found.topics = append(found.topics, s.topic)
+	}
+	c.mu.Unlock()
+
+	for _, g := range groups {
+		packetId, err := sess.PacketId()
+		if err != nil {
+			return err
+		}
+		ss := message.NewSubscribe()
+		ss.PacketId = packetId
+		ss.Property = g.prop
+		ss.AddTopic(g.topics...)
+		ss.SetVersion(c.version)
+		if _, err := sess.Start(ss.PacketId, message.SUBACK, ss); err != nil {
+			return err
+		}
+		log.Debugf("%d subscriptions are restored", len(g.topics))
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestClientReconnectRestoresSubscriptions(t *testing.T) {
+	first := broker.NewBroker(":21241", broker.WithSysInterval(0))
+	stop := serveBroker(first)
+	time.Sleep(100 * time.Millisecond)
+
+	lost := make(chan error, 1)
+	reconnected := make(chan struct{}, 1)
+	c := client.NewClient("mqtt://localhost:21241")
+	assert.NoError(t, c.Connect(context.Background(),
+		client.WithClientId("reconnect-client"),
+		client.WithAutoReconnect(client.ReconnectConfig{
+			InitialDelay: 100 * time.Millisecond,
+			MaxDelay:     300 * time.Millisecond,
+		}),
+		client.WithOnConnectionLost(func(err error) {
+			lost <- err
+		}),
+		client.WithOnReconnect(func() {
+			reconnected <- struct{}{}
+		}),
+	))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+	assert.NoError(t, c.Subscribe("reconnect/#", nil, client.WithQoS(message.QoS1)))
+
+	// Restart the broker, new broker doesn't have the session
+	stop()
+	select {
+	case <-lost:
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection lost is not notified")
+	}
+	second := broker.NewBroker(":21241", broker.WithSysInterval(0))
+	defer serveBroker(second)()
+	select {
+	case <-reconnected:
+	case <-time.After(3 * time.Second):
+		t.Fatal("client doesn't reconnect")
+	}
+
+	for i := 0; second.Stats().Subscriptions == 0; i++ {
+		if i > 30 {
+			t.Fatal("subscription is not restored")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.NoError(t, second.Publish(context.Background(), "reconnect/foo", []byte("restored"), broker.WithQoS(message.QoS1)))
+	pb := receiveMessage(t, c)
+	assert.Equal(t, []byte("restored"), pb.Body)
+}
+
+// Accept two connections, and report subscription identifiers of SUBSCRIBE packets after the reconnection by topic filter
+func serveResubscribe(t *testing.T, addr string, subscribed chan map[string]uint64) {
+	l, err := net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	accept := func() net.Conn {
+		conn, err := l.Accept()
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		_, _, err = message.ReceiveFrame(conn)
+		assert.NoError(t, err)
+		// Broker doesn't have the session
+		assert.NoError(t, message.WriteFrame(conn, message.NewConnAck(message.Success)))
+		return conn
+	}
+	receive := func(conn net.Conn, ids map[string]uint64) {
+		frame, payload, err := message.ReceiveFrame(conn)
+		if !assert.NoError(t, err) {
+			return
+		}
+		ss, err := message.ParseSubscribe(frame, payload)
+		if !assert.NoError(t, err) {
+			return
+		}
+		rcs := []message.ReasonCode{}
+		for _, st := range ss.Subscriptions {
+			if ss.Property != nil {
+				ids[st.TopicName] = ss.Property.SubscriptionIdentifier
+			} else {
+				ids[st.TopicName] = 0
+			}
+			rcs = append(rcs, message.GrantedQoS0)
+		}
+		assert.NoError(t, message.WriteFrame(conn, message.NewSubAck(ss.PacketId, rcs...)))
+	}
+	go func() {
+		defer l.Close()
+		conn := accept()
+		if conn == nil {
+			return
+		}
+		first := make(map[string]uint64)
+		receive(conn, first)
+		receive(conn, first)
+		subscribed <- first
+		conn.Close()
+
+		if conn = accept(); conn == nil {
+			return
+		}
+		defer conn.Close()
+		restored := make(map[string]uint64)
+		receive(conn, restored)
+		receive(conn, restored)
+		subscribed <- restored
+		// Wait for the client to disconnect
+		message.ReceiveFrame(conn)
+	}()
+}
+
+func TestClientResubscribeKeepsSubscribeProperty(t *testing.T) {
+	subscribed := make(chan map[string]uint64, 2)
+	serveResubscribe(t, ":21242", subscribed)
+
+	c := client.NewClient("mqtt://localhost:21242")
+	assert.NoError(t, c.Connect(context.Background(),
+		client.WithAutoReconnect(client.ReconnectConfig{
+			InitialDelay: 100 * time.Millisecond,
+			MaxDelay:     300 * time.Millisecond,
+		}),
+	))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+	_, err := c.SubscribeMany(context.Background(), []client.Subscription{
+		{Topic: message.SubscribeTopic{TopicName: "identified/#"}},
+	}, client.WithSubscribeProperty(&message.SubscribeProperty{SubscriptionIdentifier: 7}))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Subscribe("plain/#", nil))
+
+	expected := map[string]uint64{"identified/#": 7, "plain/#": 0}
+	for _, name := range []string{"subscribe", "resubscribe"} {
+		select {
+		case ids := <-subscribed:
+			assert.Equal(t, expected, ids, name)
+		case <-time.After(3 * time.Second):
+			t.Fatal(name + " is not received")
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Default prefix of response topic when broker doesn't supply ResponseInformation
+const defaultResponsePrefix = "gqtt/response"
+
+// RequestHandler receives request message and returns response body.
+// If handler returns nil, response is not sent.
+type RequestHandler func(req *message.Publish) []byte
+
+// Send request message and wait for the response which has the same correlation data.
+// Request/response needs MQTT 5 properties, then error is returned on MQTT 3.1.1 connection.
+func (c *Client) Request(ctx context.Context, topic string, body []byte, opts ...ClientOption) (*message.Publish, error) {
+	if c.version == message.Version311 {
+		return nil, errors.New("request/response is not supported on MQTT 3.1.1")
+	}
+	if err := c.subscribeResponse(); err != nil {
+		return nil, errors.Wrap(err, "failed to subscribe response topic")
+	}
+
+	correlation := uuid.NewV4().Bytes()
+	reply := make(chan *message.Publish, 1)
+	c.requests.Store(string(correlation), reply)
+	defer c.requests.Delete(string(correlation))
+
+	pb := makePublishMessage(topic, body, opts)
+	// Copy property in order not to modify caller's one
+	prop := message.PublishProperty{}
+	if pb.Property != nil {
+		prop = *pb.Property
+	}
+	pb.Property = &prop
+	pb.Property.ResponseTopic = c.getResponseTopic()
+	pb.Property.CorrelationData = correlation
+	if err := c.publish(pb); err != nil {
+		return nil, errors.Wrap(err, "failed to send request")
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "request canceled")
+	case resp := <-reply:
+		return resp, nil
+	}
+}
+
+// Register request handler for the topic.
+// Handler's return value is published to the ResponseTopic of request message.
+func (c *Client) Handle(topic string, handler RequestHandler, opts ...ClientOption) error {
+	qos := message.QoS0
+	for _, o := range opts {
+		if o.name == nameQoS {
+			qos = o.value.(message.QoSLevel)
+		}
+	}
+
+	c.mu.Lock()
+	c.handlers[topic] = handler
+	c.mu.Unlock()
+
+	if err := c.subscribe(message.SubscribeTopic{TopicName: topic, QoS: qos}); err != nil {
+		c.mu.Lock()
+		delete(c.handlers, topic)
+		c.mu.Unlock()
+		return errors.Wrap(err, "failed to subscribe request topic")
+	}
+	return nil
+}
+
+func (c *Client) getResponseTopic() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.responseTopic
+}
+
+// Subscribe own response topic at once.
+// Note that we must not hold c.mu while subscribing because main loop also requires it to dispatch messages.
+func (c *Client) subscribeResponse() error {
+	c.responseMu.Lock()
+	defer c.responseMu.Unlock()
+
+	if c.getResponseTopic() != "" {
+		return nil
+	}
+	topic := defaultResponsePrefix + "/" + c.clientId
+	c.connMu.Lock()
+	info := c.ServerInfo
+	c.connMu.Unlock()
+	if info != nil && info.ResponseInformation != "" {
+		topic = info.ResponseInformation
+	}
+	if err := c.subscribe(message.SubscribeTopic{TopicName: topic, QoS: message.QoS1}); err != nil {
+		return err
+	}
+	log.Debug("subscribed response topic: ", topic)
+	c.mu.Lock()
+	c.responseTopic = topic
+	c.mu.Unlock()
+	return nil
+}
+
+// Pass message to waiting request if message is the response
+func (c *Client) receiveResponse(pb *message.Publish) bool {
+	topic := c.getResponseTopic()
+	if topic == "" || pb.TopicName != topic {
+		return false
+	}
+	if pb.Property == nil || len(pb.Property.CorrelationData) == 0 {
+		log.Debug("response message doesn't have correlation data, drop it")
+		return true
+	}
+	v, ok := c.requests.Load(string(pb.Property.CorrelationData))
+	if !ok {
+		log.Debug("response message received, but request has already finished")
+		return true
+	}
+	select {
+	case v.(chan *message.Publish) <- pb:
+	default:
+		log.Debug("duplicate response received, drop it")
+	}
+	return true
+}
+
+// Run request handler if message matches to registered topic
+func (c *Client) receiveRequest(pb *message.Publish) bool {
+	var handler RequestHandler
+	c.mu.Lock()
+	for topic, h := range c.handlers {
+		if message.MatchTopic(routeFilter(topic), pb.TopicName) {
+			handler = h
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if handler == nil {
+		return false
+	}
+	// Run handler in another goroutine because response publishing waits for acknowledgment in main loop
+	go c.respond(handler, pb)
+	return true
+}
+
+func (c *Client) respond(handler RequestHandler, req *message.Publish) {
+	if req.Property == nil || req.Property.ResponseTopic == "" {
+		log.Debug("request message doesn't have response topic, skip to respond")
+		return
+	}
+	body := handler(req)
+	if body == nil {
+		return
+	}
+
+	resp := message.NewPublish(0, message.WithQoS(req.QoS))
+	resp.TopicName = req.Property.ResponseTopic
+	resp.Body = body
+	resp.Property = &message.PublishProperty{
+		CorrelationData: req.Property.CorrelationData,
+	}
+	if err := c.publish(resp); err != nil {
+		log.Debug("failed to send response: ", err)
+	}
+}
@@ -0,0 +1,100 @@
+package client_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestRequestReceivesResponse(t *testing.T) {
+	b := broker.NewBroker(":21301", broker.WithSysInterval(0), broker.WithResponseInformation("rpc/response"))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	responder := client.NewClient("mqtt://localhost:21301")
+	assert.NoError(t, responder.Connect(context.Background()))
+	defer func() {
+		go responder.Disconnect()
+		<-responder.Closed
+	}()
+	assert.NoError(t, responder.Handle("rpc/echo", func(req *message.Publish) []byte {
+		return append([]byte("echo: "), req.Body...)
+	}, client.WithQoS(message.QoS1)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	t.Run("response topic is made from client identifier", func(t *testing.T) {
+		c := client.NewClient("mqtt://localhost:21301")
+		assert.NoError(t, c.Connect(ctx, client.WithClientId("requester")))
+		defer func() {
+			go c.Disconnect()
+			<-c.Closed
+		}()
+		// Response information isn't requested by default
+		if c.ServerInfo != nil {
+			assert.Equal(t, "", c.ServerInfo.ResponseInformation)
+		}
+
+		resp, err := c.Request(ctx, "rpc/echo", []byte("hello"), client.WithQoS(message.QoS1))
+		assert.NoError(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, "gqtt/response/requester", resp.TopicName)
+			assert.Equal(t, "echo: hello", string(resp.Body))
+		}
+	})
+
+	t.Run("response topic is made from response information", func(t *testing.T) {
+		c := client.NewClient("mqtt://localhost:21301")
+		assert.NoError(t, c.Connect(ctx, client.WithClientId("informed"), client.WithRequestResponseInformation()))
+		defer func() {
+			go c.Disconnect()
+			<-c.Closed
+		}()
+		assert.Equal(t, "rpc/response/informed", c.ServerInfo.ResponseInformation)
+
+		// Concurrent requests receive their own responses by correlation data
+		errs := make(chan error, 2)
+		for _, body := range []string{"first", "second"} {
+			body := body
+			go func() {
+				resp, err := c.Request(ctx, "rpc/echo", []byte(body), client.WithQoS(message.QoS1))
+				if err == nil {
+					assert.Equal(t, "rpc/response/informed", resp.TopicName)
+					assert.Equal(t, "echo: "+body, string(resp.Body))
+				}
+				errs <- err
+			}()
+		}
+		assert.NoError(t, <-errs)
+		assert.NoError(t, <-errs)
+	})
+}
+
+func TestRequestIsNotSupportedOnV311(t *testing.T) {
+	b := broker.NewBroker(":21302", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.NewClient("mqtt://localhost:21302")
+	assert.NoError(t, c.Connect(context.Background(), client.WithProtocolVersion(message.Version311)))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+
+	// Error is returned without waiting for the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Request(ctx, "rpc/echo", []byte("hello"))
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	// Response topic isn't subscribed
+	assert.Equal(t, int64(0), b.Stats().Subscriptions)
+}
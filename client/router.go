@@ -0,0 +1,173 @@
+package client
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// MessageHandler receives the message which matches to the subscription
+type MessageHandler func(pb *message.Publish)
+
+// DispatchMode decides how the handler of the subscription is called
+type DispatchMode uint8
+
+const (
+	// Messages are handled one by one in order of arrival on the goroutine of the subscription
+	DispatchOrdered DispatchMode = iota
+	// Each message is handled on its own goroutine, so the handler must be safe for concurrent use
+	DispatchConcurrent
+)
+
+// Prefix of shared subscription, "$share/{ShareName}/{filter}"
+const sharePrefix = "$share/"
+
+// Get topic filter of the subscription. Shared subscription receives messages which match to the filter after the share name
+func routeFilter(filter string) string {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return filter
+	}
+	rest := filter[len(sharePrefix):]
+	if i := strings.Index(rest, "/"); i >= 0 {
+		return rest[i+1:]
+	}
+	return rest
+}
+
+// Queue of messages which are passed to the handler in order.
+// Goroutine runs only while messages remain, so the queue doesn't need to be stopped
+type dispatchQueue struct {
+	messages []*message.Publish
+	running  bool
+	mu       sync.Mutex
+}
+
+func (q *dispatchQueue) push(pb *message.Publish, handle func(*message.Publish)) {
+	q.mu.Lock()
+	q.messages = append(q.messages, pb)
+	if q.running {
+		q.mu.Unlock()
+		return
+	}
+	q.running = true
+	q.mu.Unlock()
+	go q.run(handle)
+}
+
+func (q *dispatchQueue) run(handle func(*message.Publish)) {
+	for {
+		q.mu.Lock()
+		if len(q.messages) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		pb := q.messages[0]
+		q.messages[0] = nil
+		q.messages = q.messages[1:]
+		q.mu.Unlock()
+		handle(pb)
+	}
+}
+
+type route struct {
+	filter  string
+	handler MessageHandler
+	mode    DispatchMode
+	queue   *dispatchQueue
+}
+
+func newRoute(filter string, handler MessageHandler, mode DispatchMode) *route {
+	return &route{
+		filter:  routeFilter(filter),
+		handler: handler,
+		mode:    mode,
+		queue:   &dispatchQueue{},
+	}
+}
+
+// Router passes incoming messages to the handlers of matched subscriptions.
+// Message which doesn't match to any subscription is passed to the default handler
+type router struct {
+	routes   map[string]*route
+	fallback *route
+	onPanic  func(pb *message.Publish, v interface{})
+	mu       sync.RWMutex
+}
+
+func newRouter() *router {
+	return &router{
+		routes: make(map[string]*route),
+	}
+}
+
+// Register the handler for the subscription, it replaces the handler of the same filter
+func (r *router) add(filter string, handler MessageHandler, mode DispatchMode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[filter] = newRoute(filter, handler, mode)
+}
+
+func (r *router) remove(filter string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, filter)
+}
+
+func (r *router) setDefault(handler MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = newRoute("#", handler, DispatchOrdered)
+}
+
+func (r *router) setOnPanic(fn func(pb *message.Publish, v interface{})) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onPanic = fn
+}
+
+// Dispatch the message to all matched handlers, and returns false if no handler receives it
+func (r *router) dispatch(pb *message.Publish) bool {
+	r.mu.RLock()
+	var matched []*route
+	for _, rt := range r.routes {
+		if message.MatchTopic(rt.filter, pb.TopicName) {
+			matched = append(matched, rt)
+		}
+	}
+	if len(matched) == 0 && r.fallback != nil {
+		matched = append(matched, r.fallback)
+	}
+	r.mu.RUnlock()
+
+	for _, rt := range matched {
+		rt := rt
+		switch rt.mode {
+		case DispatchConcurrent:
+			go r.call(rt.handler, pb)
+		default:
+			rt.queue.push(pb, func(pb *message.Publish) {
+				r.call(rt.handler, pb)
+			})
+		}
+	}
+	return len(matched) > 0
+}
+
+// Call the handler, panic in the handler is recovered in order to keep other subscriptions working
+func (r *router) call(handler MessageHandler, pb *message.Publish) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Debugf("handler panicked for topic %s: %v", pb.TopicName, v)
+			r.mu.RLock()
+			onPanic := r.onPanic
+			r.mu.RUnlock()
+			if onPanic != nil {
+				onPanic(pb, v)
+			}
+		}
+	}()
+	handler(pb)
+}
@@ -0,0 +1,77 @@
+package client_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func receiveBody(t *testing.T, ch chan string) string {
+	select {
+	case body := <-ch:
+		return body
+	case <-time.After(3 * time.Second):
+		t.Fatal("message is not handled")
+	}
+	return ""
+}
+
+func TestClientRoutesMessagesToHandlers(t *testing.T) {
+	b := broker.NewBroker(":21271", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	defaults := make(chan string, 10)
+	panics := make(chan string, 10)
+	c := client.NewClient("mqtt://localhost:21271")
+	assert.NoError(t, c.Connect(context.Background(),
+		client.WithDefaultHandler(func(pb *message.Publish) {
+			defaults <- string(pb.Body)
+		}),
+		client.WithOnHandlerPanic(func(pb *message.Publish, v interface{}) {
+			panics <- string(pb.Body)
+		}),
+	))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+
+	release := make(chan struct{})
+	slow := make(chan string, 10)
+	fast := make(chan string, 10)
+	assert.NoError(t, c.Subscribe("router/slow/#", func(pb *message.Publish) {
+		<-release
+		slow <- string(pb.Body)
+	}, client.WithQoS(message.QoS1)))
+	assert.NoError(t, c.Subscribe("router/+/fast", func(pb *message.Publish) {
+		fast <- string(pb.Body)
+	}, client.WithQoS(message.QoS1)))
+	assert.NoError(t, c.Subscribe("router/panic", func(pb *message.Publish) {
+		panic("boom")
+	}, client.WithQoS(message.QoS1)))
+	assert.NoError(t, c.Subscribe("router/other", nil, client.WithQoS(message.QoS1)))
+
+	for _, topic := range []string{"router/slow/1", "router/slow/2", "router/a/fast", "router/panic", "router/other"} {
+		assert.NoError(t, c.Publish(topic, []byte(topic), client.WithQoS(message.QoS1)))
+	}
+
+	// Blocked handler doesn't block other handlers
+	assert.Equal(t, "router/a/fast", receiveBody(t, fast))
+	assert.Equal(t, "router/panic", receiveBody(t, panics))
+	assert.Equal(t, "router/other", receiveBody(t, defaults))
+
+	// Messages are handled in order of arrival
+	close(release)
+	assert.Equal(t, "router/slow/1", receiveBody(t, slow))
+	assert.Equal(t, "router/slow/2", receiveBody(t, slow))
+
+	// Recovered handler keeps receiving messages
+	assert.NoError(t, c.Publish("router/panic", []byte("again"), client.WithQoS(message.QoS1)))
+	assert.Equal(t, "again", receiveBody(t, panics))
+}
@@ -0,0 +1,498 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+// StoredMessage is the message which is saved in the store
+type StoredMessage struct {
+	PacketId uint16
+	// Encoded PUBLISH packet
+	Packet []byte
+	// State of outgoing message, incoming message is always waiting for PUBREL
+	State session.State
+}
+
+// BufferedMessage is the message which is published while the client is disconnected
+type BufferedMessage struct {
+	// Key increases in order of publishing
+	Key uint64
+	// Encoded PUBLISH packet, packet identifier is allocated when it's sent
+	Packet []byte
+}
+
+// Store persists session state of the client over process restarts.
+// Outgoing QoS1/QoS2 messages are saved until the flow completes, and incoming QoS2 messages are saved until PUBREL
+type Store interface {
+	// Save outgoing message, it replaces the message which has the same packet identifier but keeps the order
+	PutOutgoing(clientId string, m StoredMessage) error
+	DeleteOutgoing(clientId string, packetId uint16) error
+	// Save incoming QoS2 message
+	PutIncoming(clientId string, m StoredMessage) error
+	DeleteIncoming(clientId string, packetId uint16) error
+	// Load messages of the client in order of saving
+	Load(clientId string) (outgoing []StoredMessage, incoming []StoredMessage, err error)
+	// Save message of the offline buffer
+	PutBuffered(clientId string, key uint64, packet []byte) error
+	DeleteBuffered(clientId string, key uint64) error
+	// Load buffered messages in order of key
+	LoadBuffered(clientId string) ([]BufferedMessage, error)
+}
+
+type storedEntry struct {
+	message StoredMessage
+	seq     uint64
+}
+
+func sortEntries(entries []storedEntry) []StoredMessage {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	list := make([]StoredMessage, len(entries))
+	for i, e := range entries {
+		list[i] = e.message
+	}
+	return list
+}
+
+func sortBuffered(list []BufferedMessage) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+}
+
+// MemoryStore keeps messages in memory. Session state survives recreating the client, but not process restarts
+type MemoryStore struct {
+	outgoing map[string]map[uint16]storedEntry
+	incoming map[string]map[uint16]storedEntry
+	buffered map[string]map[uint64][]byte
+	seq      uint64
+	mu       sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		outgoing: make(map[string]map[uint16]storedEntry),
+		incoming: make(map[string]map[uint16]storedEntry),
+		buffered: make(map[string]map[uint64][]byte),
+	}
+}
+
+func (s *MemoryStore) put(messages map[string]map[uint16]storedEntry, clientId string, m StoredMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := messages[clientId]; !ok {
+		messages[clientId] = make(map[uint16]storedEntry)
+	}
+	e, ok := messages[clientId][m.PacketId]
+	if !ok {
+		s.seq++
+		e.seq = s.seq
+	}
+	e.message = m
+	messages[clientId][m.PacketId] = e
+}
+
+func (s *MemoryStore) delete(messages map[string]map[uint16]storedEntry, clientId string, packetId uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(messages[clientId], packetId)
+}
+
+func (s *MemoryStore) load(messages map[string]map[uint16]storedEntry, clientId string) []StoredMessage {
+	entries := make([]storedEntry, 0, len(messages[clientId]))
+	for _, e := range messages[clientId] {
+		entries = append(entries, e)
+	}
+	return sortEntries(entries)
+}
+
+func (s *MemoryStore) PutOutgoing(clientId string, m StoredMessage) error {
+	s.put(s.outgoing, clientId, m)
+	return nil
+}
+
+func (s *MemoryStore) DeleteOutgoing(clientId string, packetId uint16) error {
+	s.delete(s.outgoing, clientId, packetId)
+	return nil
+}
+
+func (s *MemoryStore) PutIncoming(clientId string, m StoredMessage) error {
+	s.put(s.incoming, clientId, m)
+	return nil
+}
+
+func (s *MemoryStore) DeleteIncoming(clientId string, packetId uint16) error {
+	s.delete(s.incoming, clientId, packetId)
+	return nil
+}
+
+func (s *MemoryStore) Load(clientId string) ([]StoredMessage, []StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(s.outgoing, clientId), s.load(s.incoming, clientId), nil
+}
+
+func (s *MemoryStore) PutBuffered(clientId string, key uint64, packet []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buffered[clientId]; !ok {
+		s.buffered[clientId] = make(map[uint64][]byte)
+	}
+	s.buffered[clientId][key] = packet
+	return nil
+}
+
+func (s *MemoryStore) DeleteBuffered(clientId string, key uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buffered[clientId], key)
+	return nil
+}
+
+func (s *MemoryStore) LoadBuffered(clientId string) ([]BufferedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]BufferedMessage, 0, len(s.buffered[clientId]))
+	for key, packet := range s.buffered[clientId] {
+		list = append(list, BufferedMessage{Key: key, Packet: packet})
+	}
+	sortBuffered(list)
+	return list, nil
+}
+
+// Remove all messages of the client e.g. when the application abandons the session.
+// Client never calls it because the session is always resumed with the store
+func (s *MemoryStore) Reset(clientId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.outgoing, clientId)
+	delete(s.incoming, clientId)
+	delete(s.buffered, clientId)
+	return nil
+}
+
+const (
+	outgoingPrefix = "out-"
+	incomingPrefix = "in-"
+	bufferedPrefix = "buf-"
+	// Sequence and state are written before the packet
+	fileHeaderSize = 9
+)
+
+// FileStore saves each message as a file under the directory of the client.
+// File is written to the temporary file and renamed, so the message is never broken by crash
+type FileStore struct {
+	dir string
+	seq uint64
+	mu  sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create store directory")
+	}
+	return &FileStore{
+		dir: dir,
+	}, nil
+}
+
+func (s *FileStore) clientDir(clientId string) string {
+	return filepath.Join(s.dir, url.PathEscape(clientId))
+}
+
+// Sequence which increases over process restarts in order to keep the order of messages
+func (s *FileStore) nextSeq() uint64 {
+	seq := uint64(time.Now().UnixNano())
+	if seq <= s.seq {
+		seq = s.seq + 1
+	}
+	s.seq = seq
+	return seq
+}
+
+func (s *FileStore) put(prefix, clientId string, m StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.clientDir(clientId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create client directory")
+	}
+	name := prefix + strconv.Itoa(int(m.PacketId))
+	// Replaced message keeps the sequence
+	var seq uint64
+	if e, err := readStoredFile(filepath.Join(dir, name)); err == nil {
+		seq = e.seq
+	} else {
+		seq = s.nextSeq()
+	}
+
+	buf := make([]byte, fileHeaderSize, fileHeaderSize+len(m.Packet))
+	binary.BigEndian.PutUint64(buf, seq)
+	buf[8] = byte(m.State)
+	buf = append(buf, m.Packet...)
+	return writeFileAtomic(dir, name, buf)
+}
+
+// Write to the temporary file and rename it, then the file is never broken by crash
+func writeFileAtomic(dir, name string, buf []byte) error {
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write message")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to sync message")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to close message file")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), filepath.Join(dir, name)), "failed to save message")
+}
+
+func (s *FileStore) delete(prefix, clientId string, packetId uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file := filepath.Join(s.clientDir(clientId), prefix+strconv.Itoa(int(packetId)))
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to delete message")
+	}
+	return nil
+}
+
+func readStoredFile(file string) (storedEntry, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return storedEntry{}, err
+	} else if len(buf) < fileHeaderSize {
+		return storedEntry{}, errors.New("stored message is too short")
+	}
+	id, err := strconv.Atoi(filepath.Base(file)[strings.Index(filepath.Base(file), "-")+1:])
+	if err != nil {
+		return storedEntry{}, errors.Wrap(err, "invalid file name")
+	}
+	return storedEntry{
+		seq: binary.BigEndian.Uint64(buf),
+		message: StoredMessage{
+			PacketId: uint16(id),
+			State:    session.State(buf[8]),
+			Packet:   buf[fileHeaderSize:],
+		},
+	}, nil
+}
+
+func (s *FileStore) PutOutgoing(clientId string, m StoredMessage) error {
+	return s.put(outgoingPrefix, clientId, m)
+}
+
+func (s *FileStore) DeleteOutgoing(clientId string, packetId uint16) error {
+	return s.delete(outgoingPrefix, clientId, packetId)
+}
+
+func (s *FileStore) PutIncoming(clientId string, m StoredMessage) error {
+	return s.put(incomingPrefix, clientId, m)
+}
+
+func (s *FileStore) DeleteIncoming(clientId string, packetId uint16) error {
+	return s.delete(incomingPrefix, clientId, packetId)
+}
+
+func (s *FileStore) Load(clientId string) ([]StoredMessage, []StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(s.clientDir(clientId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, errors.Wrap(err, "failed to read client directory")
+	}
+	var outgoing, incoming []storedEntry
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, outgoingPrefix) && !strings.HasPrefix(name, incomingPrefix) {
+			continue
+		}
+		e, err := readStoredFile(filepath.Join(s.clientDir(clientId), name))
+		if err != nil {
+			log.Debug("skip broken stored message: ", err)
+			continue
+		}
+		if e.seq > s.seq {
+			s.seq = e.seq
+		}
+		if strings.HasPrefix(name, outgoingPrefix) {
+			outgoing = append(outgoing, e)
+		} else {
+			incoming = append(incoming, e)
+		}
+	}
+	return sortEntries(outgoing), sortEntries(incoming), nil
+}
+
+func (s *FileStore) PutBuffered(clientId string, key uint64, packet []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := s.clientDir(clientId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create client directory")
+	}
+	return writeFileAtomic(dir, bufferedPrefix+strconv.FormatUint(key, 10), packet)
+}
+
+func (s *FileStore) DeleteBuffered(clientId string, key uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file := filepath.Join(s.clientDir(clientId), bufferedPrefix+strconv.FormatUint(key, 10))
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to delete buffered message")
+	}
+	return nil
+}
+
+func (s *FileStore) LoadBuffered(clientId string) ([]BufferedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(s.clientDir(clientId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read client directory")
+	}
+	var list []BufferedMessage
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), bufferedPrefix) {
+			continue
+		}
+		key, err := strconv.ParseUint(strings.TrimPrefix(f.Name(), bufferedPrefix), 10, 64)
+		if err != nil {
+			log.Debug("skip invalid buffered message file: ", f.Name())
+			continue
+		}
+		packet, err := ioutil.ReadFile(filepath.Join(s.clientDir(clientId), f.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read buffered message")
+		}
+		list = append(list, BufferedMessage{Key: key, Packet: packet})
+	}
+	sortBuffered(list)
+	return list, nil
+}
+
+// Remove all messages of the client e.g. when the application abandons the session.
+// Client never calls it because the session is always resumed with the store
+func (s *FileStore) Reset(clientId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Wrap(os.RemoveAll(s.clientDir(clientId)), "failed to reset client directory")
+}
+
+// Save session changes to the store of the client
+type storePersistence struct {
+	store    Store
+	clientId string
+}
+
+func (p storePersistence) SaveInflight(m session.Inflight) {
+	packet, err := m.Message.Encode()
+	if err != nil {
+		log.Debug("failed to encode in-flight message: ", err)
+		return
+	}
+	if err := p.store.PutOutgoing(p.clientId, StoredMessage{
+		PacketId: m.PacketId,
+		Packet:   packet,
+		State:    m.State,
+	}); err != nil {
+		log.Debug("failed to save in-flight message: ", err)
+	}
+}
+
+func (p storePersistence) DeleteInflight(packetId uint16) {
+	if err := p.store.DeleteOutgoing(p.clientId, packetId); err != nil {
+		log.Debug("failed to delete in-flight message: ", err)
+	}
+}
+
+func (p storePersistence) SaveReceived(pb *message.Publish) {
+	packet, err := pb.Encode()
+	if err != nil {
+		log.Debug("failed to encode received message: ", err)
+		return
+	}
+	if err := p.store.PutIncoming(p.clientId, StoredMessage{
+		PacketId: pb.PacketId,
+		Packet:   packet,
+	}); err != nil {
+		log.Debug("failed to save received message: ", err)
+	}
+}
+
+func (p storePersistence) DeleteReceived(packetId uint16) {
+	if err := p.store.DeleteIncoming(p.clientId, packetId); err != nil {
+		log.Debug("failed to delete received message: ", err)
+	}
+}
+
+// Restore the session from the store, it's taken over by the first connection
+func (c *Client) restoreSession(ctx context.Context, clientId string) (*session.Session, error) {
+	outgoing, incoming, err := c.store.Load(clientId)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load stored messages")
+	}
+	// Detached session only holds the state, it never writes packets
+	sess := session.New(nil, ctx)
+	for _, m := range outgoing {
+		pb, err := c.decodeStored(m)
+		if err != nil {
+			log.Debug("skip invalid stored message: ", err)
+			continue
+		}
+		sess.RestoreInflight(pb, m.State)
+	}
+	for _, m := range incoming {
+		pb, err := c.decodeStored(m)
+		if err != nil {
+			log.Debug("skip invalid stored message: ", err)
+			continue
+		}
+		sess.RestoreReceived(pb)
+	}
+	log.Debugf("%d outgoing and %d incoming messages are restored", len(outgoing), len(incoming))
+	return sess, nil
+}
+
+func (c *Client) decodeStored(m StoredMessage) (*message.Publish, error) {
+	frame, payload, err := message.ReceiveFrame(bytes.NewReader(m.Packet))
+	if err != nil {
+		return nil, err
+	}
+	frame.SetVersion(c.version)
+	return message.ParsePublish(frame, payload)
+}
@@ -0,0 +1,126 @@
+package client_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Server which receives the client's messages but never completes the flows, then closes the connection
+func serveIncompleteFlows(t *testing.T, addr string) {
+	l, err := net.Listen("tcp", addr)
+	assert.NoError(t, err)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		frame, payload, err := message.ReceiveFrame(conn)
+		assert.NoError(t, err)
+		cn, err := message.ParseConnect(frame, payload)
+		assert.NoError(t, err)
+		assert.False(t, cn.CleanStart)
+		assert.NoError(t, message.WriteFrame(conn, message.NewConnAck(message.Success)))
+
+		// QoS2 message which is never released
+		pb := message.NewPublish(9, message.WithQoS(message.QoS2))
+		pb.TopicName = "store/in"
+		pb.Body = []byte("incoming")
+		assert.NoError(t, message.WriteFrame(conn, pb))
+
+		// Wait for PUBREC and QoS1 message from the client which is never acknowledged, in any order
+		received := make(map[message.MessageType]bool)
+		for len(received) < 2 {
+			frame, _, err = message.ReceiveFrame(conn)
+			if !assert.NoError(t, err) {
+				return
+			}
+			received[frame.Type] = true
+		}
+		assert.True(t, received[message.PUBREC])
+		assert.True(t, received[message.PUBLISH])
+	}()
+}
+
+func TestClientStoreReplaysAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gqtt-store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	serveIncompleteFlows(t, ":21251")
+	store, err := client.NewFileStore(dir)
+	assert.NoError(t, err)
+	c1 := client.NewClient("mqtt://localhost:21251")
+	assert.NoError(t, c1.Connect(context.Background(),
+		client.WithClientId("stored-client"),
+		client.WithStore(store),
+	))
+	assert.Error(t, c1.Publish("store/out", []byte("replayed"), client.WithQoS(message.QoS1)))
+	<-c1.Closed
+
+	outgoing, incoming, err := store.Load("stored-client")
+	assert.NoError(t, err)
+	assert.Len(t, outgoing, 1)
+	if assert.Len(t, incoming, 1) {
+		assert.Equal(t, uint16(9), incoming[0].PacketId)
+	}
+
+	b := broker.NewBroker(":21252", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	sub := client.NewClient("mqtt://localhost:21252")
+	assert.NoError(t, sub.Connect(context.Background()))
+	defer func() {
+		go sub.Disconnect()
+		<-sub.Closed
+	}()
+	assert.NoError(t, sub.Subscribe("store/#", nil, client.WithQoS(message.QoS1)))
+
+	// New process restores the message from the same directory
+	store, err = client.NewFileStore(dir)
+	assert.NoError(t, err)
+	c2 := client.NewClient("mqtt://localhost:21252")
+	assert.NoError(t, c2.Connect(context.Background(),
+		client.WithClientId("stored-client"),
+		client.WithStore(store),
+	))
+	defer func() {
+		go c2.Disconnect()
+		<-c2.Closed
+	}()
+	pb := receiveMessage(t, sub)
+	assert.Equal(t, "store/out", pb.TopicName)
+	assert.Equal(t, "replayed", string(pb.Body))
+
+	// Completed flow is deleted from the store
+	for i := 0; ; i++ {
+		outgoing, _, err = store.Load("stored-client")
+		assert.NoError(t, err)
+		if len(outgoing) == 0 {
+			break
+		} else if i == 50 {
+			t.Fatal("outgoing message is not deleted")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStoreRequiresClientId(t *testing.T) {
+	// Validated before connecting, then the broker isn't needed
+	c := client.NewClient("mqtt://localhost:21311")
+	err := c.Connect(context.Background(), client.WithStore(client.NewMemoryStore()))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "WithClientId")
+	}
+}
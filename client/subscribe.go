@@ -0,0 +1,253 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/internal/log"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// ReasonError is the error which the broker reported by the reason code of SUBACK or UNSUBACK
+type ReasonError struct {
+	Filter string
+	Code   message.ReasonCode
+}
+
+func (e *ReasonError) Error() string {
+	return fmt.Sprintf("%s is refused by the broker: %s", e.Filter, e.Code)
+}
+
+// Make the error from the reason code, nil is returned for the successful code
+func reasonError(filter string, rc message.ReasonCode) error {
+	if rc.Byte() < 0x80 {
+		return nil
+	}
+	return &ReasonError{Filter: filter, Code: rc}
+}
+
+// Subscription is the topic filter and its handler for SubscribeMany
+type Subscription struct {
+	Topic message.SubscribeTopic
+	// Matched messages are passed to the default handler or Message channel if nil
+	Handler MessageHandler
+	Mode    DispatchMode
+}
+
+// SubscribeResult is the result of the topic filter which is reported by SUBACK
+type SubscribeResult struct {
+	Filter string
+	// Granted QoS on success, or the reason why the broker refused the subscription
+	ReasonCode message.ReasonCode
+	// ReasonError if the subscription is refused
+	Err error
+}
+
+// Granted QoS of the subscription
+func (r SubscribeResult) QoS() message.QoSLevel {
+	return message.QoSLevel(r.ReasonCode)
+}
+
+// UnsubscribeResult is the result of the topic filter which is reported by UNSUBACK.
+// Broker of MQTT 3.1.1 doesn't report reason codes, then all results are Success
+type UnsubscribeResult struct {
+	Filter     string
+	ReasonCode message.ReasonCode
+	Err        error
+}
+
+// Subscribe the topic filter and register the handler which receives matched messages.
+// QoS is set by WithQoS, default is QoS0. If handler is nil, messages are passed to the default handler,
+// or Message channel when the default handler isn't set.
+// ReasonError is returned when the broker refuses the subscription
+func (c *Client) Subscribe(filter string, handler MessageHandler, opts ...ClientOption) error {
+	s := Subscription{
+		Topic: message.SubscribeTopic{
+			TopicName: filter,
+			QoS:       message.QoS0,
+		},
+		Handler: handler,
+		Mode:    DispatchOrdered,
+	}
+	// TODO: enable to set Retain handling
+	for _, o := range opts {
+		switch o.name {
+		case nameQoS:
+			s.Topic.QoS = o.value.(message.QoSLevel)
+		case nameNoLocal:
+			s.Topic.NoLocal = true
+		case nameRAP:
+			s.Topic.RAP = true
+		case nameDispatchMode:
+			s.Mode = o.value.(DispatchMode)
+		}
+	}
+	results, err := c.SubscribeMany(context.Background(), []Subscription{s}, opts...)
+	if err != nil {
+		return err
+	}
+	return results[0].Err
+}
+
+// Subscribe multiple topic filters by one SUBSCRIBE packet, and returns the result of each filter in the same order.
+// Error is returned only when the packet couldn't be exchanged, refused subscriptions are reported by the results.
+// Subscription properties are set by WithSubscribeProperty
+func (c *Client) SubscribeMany(ctx context.Context, subscriptions []Subscription, opts ...ClientOption) ([]SubscribeResult, error) {
+	if len(subscriptions) == 0 {
+		return nil, errors.New("at least one subscription is required")
+	}
+	var prop *message.SubscribeProperty
+	for _, o := range opts {
+		if o.name == nameSubscribeProperty {
+			prop = o.value.(*message.SubscribeProperty)
+		}
+	}
+
+	topics := make([]message.SubscribeTopic, len(subscriptions))
+	// Register handlers before subscribing because retained messages may arrive before SUBACK
+	for i, s := range subscriptions {
+		topics[i] = s.Topic
+		if s.Handler != nil {
+			c.router.add(s.Topic.TopicName, s.Handler, s.Mode)
+		}
+	}
+	rcs, err := c.sendSubscribe(ctx, topics, prop)
+	if err != nil {
+		for _, s := range subscriptions {
+			if s.Handler != nil {
+				c.router.remove(s.Topic.TopicName)
+			}
+		}
+		return nil, err
+	}
+
+	results := make([]SubscribeResult, len(subscriptions))
+	for i, s := range subscriptions {
+		results[i] = SubscribeResult{
+			Filter:     s.Topic.TopicName,
+			ReasonCode: rcs[i],
+			Err:        reasonError(s.Topic.TopicName, rcs[i]),
+		}
+		if results[i].Err != nil && s.Handler != nil {
+			c.router.remove(s.Topic.TopicName)
+		}
+	}
+	return results, nil
+}
+
+// Granted subscription and the properties of SUBSCRIBE, which are sent again on reconnection
+type subscription struct {
+	topic message.SubscribeTopic
+	prop  *message.SubscribeProperty
+}
+
+// Send SUBSCRIBE and returns reason codes in order of topics.
+// Granted subscriptions are kept in order to restore them on reconnection
+func (c *Client) sendSubscribe(ctx context.Context, topics []message.SubscribeTopic, prop *message.SubscribeProperty) ([]message.ReasonCode, error) {
+	_, sess := c.current()
+	packetId, err := sess.PacketId()
+	if err != nil {
+		return nil, err
+	}
+
+	ss := message.NewSubscribe()
+	ss.PacketId = packetId
+	ss.Property = prop
+	ss.AddTopic(topics...)
+
+	log.Debug("send subscribe")
+	ss.SetVersion(c.version)
+	v, err := sess.StartContext(ctx, packetId, message.SUBACK, ss)
+	if err != nil {
+		log.Debug("failed to finish session: ", err)
+		return nil, err
+	}
+	ack, ok := v.(*message.SubAck)
+	if !ok {
+		log.Debug("unexpected ack received")
+		return nil, errors.New("unexpected ack received")
+	} else if len(ack.ReasonCodes) != len(topics) {
+		return nil, errors.Errorf("SUBACK has %d reason codes for %d topics", len(ack.ReasonCodes), len(topics))
+	}
+	log.Debug("sent subscribe")
+
+	c.mu.Lock()
+	for i, st := range topics {
+		if reasonError(st.TopicName, ack.ReasonCodes[i]) == nil {
+			c.subscriptions[st.TopicName] = subscription{topic: st, prop: prop}
+		}
+	}
+	c.mu.Unlock()
+	return ack.ReasonCodes, nil
+}
+
+// Subscribe single topic without handler, and returns error if the broker refuses it
+func (c *Client) subscribe(st message.SubscribeTopic) error {
+	rcs, err := c.sendSubscribe(context.Background(), []message.SubscribeTopic{st}, nil)
+	if err != nil {
+		return err
+	}
+	return reasonError(st.TopicName, rcs[0])
+}
+
+// Unsubscribe topic filters by one UNSUBSCRIBE packet, and returns the result of each filter in the same order.
+// Handlers of unsubscribed filters are removed
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) ([]UnsubscribeResult, error) {
+	return c.UnsubscribeWithProperty(ctx, nil, filters...)
+}
+
+// Unsubscribe with properties e.g. user properties
+func (c *Client) UnsubscribeWithProperty(ctx context.Context, prop *message.UnsubscribeProperty, filters ...string) ([]UnsubscribeResult, error) {
+	if len(filters) == 0 {
+		return nil, errors.New("at least one topic filter is required")
+	}
+	_, sess := c.current()
+	packetId, err := sess.PacketId()
+	if err != nil {
+		return nil, err
+	}
+
+	us := message.NewUnsubscribe()
+	us.PacketId = packetId
+	us.Property = prop
+	us.AddTopic(filters...)
+
+	log.Debug("send unsubscribe")
+	us.SetVersion(c.version)
+	v, err := sess.StartContext(ctx, packetId, message.UNSUBACK, us)
+	if err != nil {
+		log.Debug("failed to finish session: ", err)
+		return nil, err
+	}
+	ack, ok := v.(*message.UnsubAck)
+	if !ok {
+		log.Debug("unexpected ack received")
+		return nil, errors.New("unexpected ack received")
+	} else if len(ack.ReasonCodes) > 0 && len(ack.ReasonCodes) != len(filters) {
+		return nil, errors.Errorf("UNSUBACK has %d reason codes for %d topics", len(ack.ReasonCodes), len(filters))
+	}
+
+	results := make([]UnsubscribeResult, len(filters))
+	for i, filter := range filters {
+		rc := message.Success
+		// v3.1.1 UNSUBACK doesn't have reason codes
+		if len(ack.ReasonCodes) > 0 {
+			rc = ack.ReasonCodes[i]
+		}
+		results[i] = UnsubscribeResult{
+			Filter:     filter,
+			ReasonCode: rc,
+			Err:        reasonError(filter, rc),
+		}
+		if results[i].Err != nil {
+			continue
+		}
+		c.router.remove(filter)
+		c.mu.Lock()
+		delete(c.subscriptions, filter)
+		delete(c.handlers, filter)
+		c.mu.Unlock()
+	}
+	return results, nil
+}
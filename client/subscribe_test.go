@@ -0,0 +1,104 @@
+package client_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/broker"
+	"github.com/ysugimoto/gqtt/client"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+type secretHooks struct {
+	broker.NopHooks
+}
+
+func (secretHooks) OnSubscribe(info broker.ClientInfo, t message.SubscribeTopic) (message.SubscribeTopic, error) {
+	if strings.HasPrefix(t.TopicName, "secret/") {
+		return t, broker.Reject(message.NotAuthorized, "secret topic")
+	}
+	return t, nil
+}
+
+func TestClientReportsSubscribeResults(t *testing.T) {
+	b := broker.NewBroker(":21281", broker.WithSysInterval(0), broker.WithHooks(secretHooks{}))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.NewClient("mqtt://localhost:21281")
+	assert.NoError(t, c.Connect(context.Background()))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+
+	received := make(chan string, 10)
+	handler := func(pb *message.Publish) {
+		received <- string(pb.Body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	results, err := c.SubscribeMany(ctx, []client.Subscription{
+		{Topic: message.SubscribeTopic{TopicName: "sub/a", QoS: message.QoS1}, Handler: handler},
+		{Topic: message.SubscribeTopic{TopicName: "secret/x", QoS: message.QoS1}, Handler: handler},
+		{Topic: message.SubscribeTopic{TopicName: "sub/b/#", QoS: message.QoS2}, Handler: handler},
+	}, client.WithSubscribeProperty(&message.SubscribeProperty{
+		SubscriptionIdentifier: 7,
+		UserProperty:           map[string]string{"component": "test"},
+	}))
+	assert.NoError(t, err)
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, message.QoS1, results[0].QoS())
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, message.NotAuthorized, results[1].ReasonCode)
+		assert.IsType(t, &client.ReasonError{}, results[1].Err)
+		assert.Equal(t, message.QoS2, results[2].QoS())
+	}
+
+	// Single subscription reports the refusal as error
+	err = c.Subscribe("secret/y", nil)
+	if assert.Error(t, err) {
+		assert.Equal(t, message.NotAuthorized, err.(*client.ReasonError).Code)
+	}
+
+	assert.NoError(t, c.Publish("sub/a", []byte("subscribed"), client.WithQoS(message.QoS1)))
+	assert.Equal(t, "subscribed", receiveBody(t, received))
+
+	unsubscribed, err := c.Unsubscribe(ctx, "sub/a", "sub/none")
+	assert.NoError(t, err)
+	if assert.Len(t, unsubscribed, 2) {
+		assert.Equal(t, message.Success, unsubscribed[0].ReasonCode)
+		assert.Equal(t, message.NoSubscriptionExisted, unsubscribed[1].ReasonCode)
+		assert.NoError(t, unsubscribed[1].Err)
+	}
+
+	// Message of the unsubscribed filter isn't delivered any more
+	assert.NoError(t, c.Publish("sub/a", []byte("unsubscribed"), client.WithQoS(message.QoS1)))
+	assert.NoError(t, c.Publish("sub/b/c", []byte("still subscribed"), client.WithQoS(message.QoS1)))
+	assert.Equal(t, "still subscribed", receiveBody(t, received))
+	assert.Len(t, received, 0)
+}
+
+func TestClientUnsubscribeOnMQTT311(t *testing.T) {
+	b := broker.NewBroker(":21282", broker.WithSysInterval(0))
+	defer serveBroker(b)()
+	time.Sleep(100 * time.Millisecond)
+
+	c := client.NewClient("mqtt://localhost:21282")
+	assert.NoError(t, c.Connect(context.Background(), client.WithProtocolVersion(message.Version311)))
+	defer func() {
+		go c.Disconnect()
+		<-c.Closed
+	}()
+	assert.NoError(t, c.Subscribe("v3/#", nil, client.WithQoS(message.QoS1)))
+
+	results, err := c.Unsubscribe(context.Background(), "v3/#")
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, message.Success, results[0].ReasonCode)
+	}
+	assert.Equal(t, int64(0), b.Stats().Subscriptions)
+}
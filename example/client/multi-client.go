@@ -29,7 +29,7 @@ func connect(wg *sync.WaitGroup) {
 	}
 	log.Println("client connected")
 
-	if err := client.Subscribe("some/will", message.QoS2); err != nil {
+	if err := client.Subscribe("some/will", nil, gqtt.WithQoS(message.QoS2)); err != nil {
 		log.Fatal(err)
 	}
 	log.Println("subscribed")
@@ -26,7 +26,7 @@ func main() {
 	}
 	log.Println("client connected")
 
-	if err := client.Subscribe("gqtt/example", message.QoS2); err != nil {
+	if err := client.Subscribe("gqtt/example", nil, gqtt.WithQoS(message.QoS2)); err != nil {
 		log.Fatal(err)
 	}
 	log.Println("subscribed")
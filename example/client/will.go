@@ -18,7 +18,7 @@ func main() {
 	}
 	log.Println("client connected")
 
-	if err := client.Subscribe("some/will", message.QoS2); err != nil {
+	if err := client.Subscribe("some/will", nil, gqtt.WithQoS(message.QoS2)); err != nil {
 		log.Fatal(err)
 	}
 	log.Println("subscribed")
@@ -2,25 +2,40 @@ package main
 
 import (
 	"context"
+	"log"
+
 	"github.com/ysugimoto/gqtt"
+	"github.com/ysugimoto/gqtt/broker"
 	"github.com/ysugimoto/gqtt/message"
-	"log"
 )
 
+type hooks struct {
+	broker.NopHooks
+}
+
+func (h hooks) OnConnect(info broker.ClientInfo, cn *message.Connect) error {
+	log.Println("Client connected: ", info.ClientId, info.RemoteAddr)
+	return nil
+}
+
+func (h hooks) OnSubscribe(info broker.ClientInfo, t message.SubscribeTopic) (message.SubscribeTopic, error) {
+	log.Println("Client subscribed: ", info.ClientId, t.TopicName)
+	return t, nil
+}
+
+func (h hooks) OnPublish(info broker.ClientInfo, pb *message.Publish) (*message.Publish, error) {
+	log.Println("Client published: ", info.ClientId, pb.TopicName)
+	return pb, nil
+}
+
+func (h hooks) OnDisconnect(info broker.ClientInfo, reason message.ReasonCode) {
+	log.Println("Client disconnected: ", info.ClientId, reason)
+}
+
 func main() {
-	server := gqtt.NewBroker(":9999")
+	server := gqtt.NewBroker(":9999", gqtt.WithHooks(hooks{}))
 	ctx := context.Background()
-	go server.ListenAndServe(ctx)
-	for evt := range server.MessageEvent {
-		switch e := evt.(type) {
-		case *message.Subscribe:
-			log.Println("Received SUBSCRIBE event: ", e.GetType())
-		case *message.Connect:
-			log.Println("Received CONNECT event", e.GetType())
-		case *message.Publish:
-			log.Println("Received PUBLISH event", e.GetType())
-		}
+	if err := server.ListenAndServe(ctx); err != nil {
+		log.Fatal(err)
 	}
-	<-ctx.Done()
-
 }
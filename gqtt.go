@@ -1,6 +1,8 @@
 package gqtt
 
 import (
+	"time"
+
 	"github.com/ysugimoto/gqtt/broker"
 	"github.com/ysugimoto/gqtt/client"
 	"github.com/ysugimoto/gqtt/message"
@@ -8,15 +10,42 @@ import (
 
 type Topic = message.SubscribeTopic
 type Option = client.ClientOption
+type BrokerOption = broker.BrokerOption
+type Hooks = broker.Hooks
+type ReconnectConfig = client.ReconnectConfig
+type Store = client.Store
+type OfflineBufferConfig = client.OfflineBufferConfig
+type MessageHandler = client.MessageHandler
+type Subscription = client.Subscription
+
+const (
+	DropOldest = client.DropOldest
+	DropNewest = client.DropNewest
+)
+
+const (
+	DispatchOrdered    = client.DispatchOrdered
+	DispatchConcurrent = client.DispatchConcurrent
+)
+
+var ErrBufferFull = client.ErrBufferFull
 
-func NewBroker(addr string) *broker.Broker {
-	return broker.NewBroker(addr)
+func NewBroker(addr string, opts ...BrokerOption) *broker.Broker {
+	return broker.NewBroker(addr, opts...)
 }
 
 func NewClient(url string) *client.Client {
 	return client.NewClient(url)
 }
 
+func NewMemoryStore() *client.MemoryStore {
+	return client.NewMemoryStore()
+}
+
+func NewFileStore(dir string) (*client.FileStore, error) {
+	return client.NewFileStore(dir)
+}
+
 func WithBasicAuth(user, password string) Option {
 	return client.WithBasicAuth(user, password)
 }
@@ -36,3 +65,103 @@ func WithRetain() Option {
 func WithQoS(qos message.QoSLevel) Option {
 	return client.WithQoS(qos)
 }
+
+func WithResponseInformation(prefix string) BrokerOption {
+	return broker.WithResponseInformation(prefix)
+}
+
+func WithHooks(hooks Hooks) BrokerOption {
+	return broker.WithHooks(hooks)
+}
+
+func WithBridge(config broker.BridgeConfig) BrokerOption {
+	return broker.WithBridge(config)
+}
+
+func WithCluster(config broker.ClusterConfig) BrokerOption {
+	return broker.WithCluster(config)
+}
+
+func WithSysInterval(interval time.Duration) BrokerOption {
+	return broker.WithSysInterval(interval)
+}
+
+func WithRateLimit(config broker.RateLimitConfig) BrokerOption {
+	return broker.WithRateLimit(config)
+}
+
+func WithMaxConnections(n int) BrokerOption {
+	return broker.WithMaxConnections(n)
+}
+
+func WithBans(bans ...broker.Ban) BrokerOption {
+	return broker.WithBans(bans...)
+}
+
+func WithAllowedNetworks(cidrs ...string) BrokerOption {
+	return broker.WithAllowedNetworks(cidrs...)
+}
+
+func WithServerKeepAlive(seconds uint16) BrokerOption {
+	return broker.WithServerKeepAlive(seconds)
+}
+
+func WithKeepAlive(seconds uint16) Option {
+	return client.WithKeepAlive(seconds)
+}
+
+func WithProtocolVersion(version uint8) Option {
+	return client.WithProtocolVersion(version)
+}
+
+func WithSlowConsumer(config broker.SlowConsumerConfig) BrokerOption {
+	return broker.WithSlowConsumer(config)
+}
+
+func WithSessionExpiry(seconds uint32) Option {
+	return client.WithSessionExpiry(seconds)
+}
+
+func WithClientId(clientId string) Option {
+	return client.WithClientId(clientId)
+}
+
+func WithRequestResponseInformation() Option {
+	return client.WithRequestResponseInformation()
+}
+
+func WithAutoReconnect(config ReconnectConfig) Option {
+	return client.WithAutoReconnect(config)
+}
+
+func WithOnConnectionLost(fn func(err error)) Option {
+	return client.WithOnConnectionLost(fn)
+}
+
+func WithOnReconnect(fn func()) Option {
+	return client.WithOnReconnect(fn)
+}
+
+func WithStore(store Store) Option {
+	return client.WithStore(store)
+}
+
+func WithOfflineBuffer(config OfflineBufferConfig) Option {
+	return client.WithOfflineBuffer(config)
+}
+
+func WithDefaultHandler(handler MessageHandler) Option {
+	return client.WithDefaultHandler(handler)
+}
+
+func WithDispatchMode(mode client.DispatchMode) Option {
+	return client.WithDispatchMode(mode)
+}
+
+func WithOnHandlerPanic(fn func(pb *message.Publish, v interface{})) Option {
+	return client.WithOnHandlerPanic(fn)
+}
+
+func WithSubscribeProperty(property *message.SubscribeProperty) Option {
+	return client.WithSubscribeProperty(property)
+}
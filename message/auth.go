@@ -35,6 +35,9 @@ func ParseAuth(f *Frame, p []byte) (a *Auth, err error) {
 		ReasonCode: Success,
 	}
 
+	if err := f.validateReserved(); err != nil {
+		return nil, err
+	}
 	dec := newDecoder(p)
 	if rc, err := dec.Uint(); err != nil {
 		if err != io.EOF {
@@ -47,7 +50,7 @@ func ParseAuth(f *Frame, p []byte) (a *Auth, err error) {
 		a.ReasonCode = ReasonCode(rc)
 	}
 
-	if prop, err := dec.Property(); err != nil {
+	if prop, err := dec.Property(allowedProperties[AUTH]); err != nil {
 		if err != io.EOF {
 			return nil, errors.Wrap(err, "failed to decode property section")
 		}
@@ -1,9 +1,5 @@
 package message
 
-import (
-	"fmt"
-)
-
 func encodeBool(b bool) (i int) {
 	if b {
 		i = 1
@@ -41,35 +37,6 @@ func encodeVariable(size int) []byte {
 	return ret
 }
 
-func decodeString(buffer []byte, start int) (string, int) {
-	size := ((int(buffer[start]) << 8) | int(buffer[start+1]))
-	start += 2
-	data := string(buffer[start:(start + size)])
-	return data, start + size
-}
-func decodeBinary(buffer []byte, start int) ([]byte, int) {
-	size := ((int(buffer[start]) << 8) | int(buffer[start+1]))
-	start += 2
-	data := buffer[start:(start + size)]
-	return data, start + size
-}
-func decodeVariable(buffer []byte, start int) (uint64, int) {
-	var (
-		b    int
-		size uint64
-		mul  uint64 = 1
-	)
-	for {
-		b, start = decodeInt(buffer, start)
-		size += uint64(b&0x7F) * mul
-		mul *= 0x80
-		if b&0x80 == 0 {
-			break
-		}
-	}
-	return size, start
-}
-
 func encodeInt(v int) byte {
 	return byte(v)
 }
@@ -91,109 +58,6 @@ func encodeUint32(v uint32) []byte {
 	return append([]byte{}, byte(iv>>24), byte(iv>>16), byte(iv>>8), byte(iv&0xFF))
 }
 
-func decodeInt(buffer []byte, start int) (int, int) {
-	return int(buffer[start]), start + 1
-}
-func decodeInt16(buffer []byte, start int) (int, int) {
-	return ((int(buffer[start]) << 8) | int(buffer[start+1])), start + 2
-}
-func decodeInt32(buffer []byte, start int) (int, int) {
-	return ((int(buffer[start]) << 24) | (int(buffer[start+1]) << 16) | (int(buffer[start+2]) << 8) | int(buffer[start+3])), start + 4
-}
-func decodeUint(buffer []byte, start int) (uint8, int) {
-	return uint8(buffer[start]), start + 1
-}
-func decodeUint16(buffer []byte, start int) (uint16, int) {
-	return uint16((int(buffer[start]) << 8) | int(buffer[start+1])), start + 2
-}
-func decodeUint32(buffer []byte, start int) (uint32, int) {
-	return uint32((int(buffer[start]) << 24) | (int(buffer[start+1]) << 16) | (int(buffer[start+2]) << 8) | int(buffer[start+3])), start + 4
-}
-
-func decodeProperty(p []byte) (*Property, error) {
-	var (
-		i, b       int
-		key, value string
-		sig        uint8
-	)
-	prop := &Property{}
-
-	for i < len(p) {
-		sig, i = decodeUint(p, i)
-		if !isPropertyTypeAvailable(sig) {
-			return nil, fmt.Errorf("undefiend property byte found: %x", sig)
-		}
-		switch PropertyType(sig) {
-		case PayloadFormatIndicator:
-			prop.PayloadFormatIndicator, i = decodeUint(p, i)
-		case MessageExpiryInterval:
-			prop.MessageExpiryInterval, i = decodeUint32(p, i)
-		case ContentType:
-			prop.ContentType, i = decodeString(p, i)
-		case ResponseTopic:
-			prop.ResponseTopic, i = decodeString(p, i)
-		case CorrelationData:
-			prop.CorrelationData, i = decodeBinary(p, i)
-		case SubscriptionIdentifier:
-			prop.SubscriptionIdentifier, i = decodeVariable(p, i)
-		case SessionExpiryInterval:
-			prop.SessionExpiryInterval, i = decodeUint32(p, i)
-		case AssignedClientIdentifier:
-			prop.AssignedClientIdentifier, i = decodeString(p, i)
-		case ServerKeepAlive:
-			prop.ServerKeepAlive, i = decodeUint16(p, i)
-		case AuthenticationMethod:
-			prop.AuthenticationMethod, i = decodeString(p, i)
-		case AuthenticationData:
-			prop.AuthenticationData, i = decodeBinary(p, i)
-		case RequestProblemInformation:
-			b, i = decodeInt(p, i)
-			prop.RequestProblemInformation = decodeBool(b)
-		case WillDelayInterval:
-			prop.WillDelayInterval, i = decodeUint32(p, i)
-		case RequestResponseInformation:
-			b, i = decodeInt(p, i)
-			prop.RequestResponseInformation = decodeBool(b)
-		case ResponseInformation:
-			prop.ResponseInformation, i = decodeString(p, i)
-		case ServerReference:
-			prop.ServerReference, i = decodeString(p, i)
-		case ReasonString:
-			prop.ReasonString, i = decodeString(p, i)
-		case ReceiveMaximum:
-			prop.ReceiveMaximum, i = decodeUint16(p, i)
-		case TopicAliasMaximum:
-			prop.TopicAliasMaximum, i = decodeUint16(p, i)
-		case TopicAlias:
-			prop.TopicAlias, i = decodeUint16(p, i)
-		case MaximumQoS:
-			prop.MaximumQoS, i = decodeUint(p, i)
-		case RetainAvalilable:
-			b, i = decodeInt(p, i)
-			prop.RetainAvalilable = decodeBool(b)
-		case UserProperty:
-			if prop.UserProperty == nil {
-				prop.UserProperty = make(map[string]string)
-			}
-			key, i = decodeString(p, i)
-			value, i = decodeString(p, i)
-			prop.UserProperty[key] = value
-		case MaximumPacketSize:
-			prop.MaximumPacketSize, i = decodeUint32(p, i)
-		case WildcardSubscriptionAvailable:
-			b, i = decodeInt(p, i)
-			prop.WildcardSubscriptionAvailable = decodeBool(b)
-		case SubscrptionIdentifierAvailable:
-			b, i = decodeInt(p, i)
-			prop.SubscrptionIdentifierAvailable = decodeBool(b)
-		case SharedSubscriptionsAvaliable:
-			b, i = decodeInt(p, i)
-			prop.SharedSubscriptionsAvaliable = decodeBool(b)
-		}
-	}
-	return prop, nil
-}
-
 func encodeProperty(p *Property) []byte {
 	buf := make([]byte, 0)
 	if p.PayloadFormatIndicator > 0 {
@@ -60,6 +60,9 @@ func ParseConnAck(f *Frame, p []byte) (c *ConnAck, err error) {
 	c = &ConnAck{
 		Frame: f,
 	}
+	if err := f.validateReserved(); err != nil {
+		return nil, err
+	}
 	dec := newDecoder(p)
 	if i, err := dec.Int(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as int")
@@ -68,13 +71,20 @@ func ParseConnAck(f *Frame, p []byte) (c *ConnAck, err error) {
 	}
 	if rc, err := dec.Uint(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as uint")
+	} else if c.isV311() {
+		// v3.1.1 has return code instead of reason code, and doesn't have properties
+		var ok bool
+		if c.ReasonCode, ok = connAckReasonCode(rc); !ok {
+			return nil, errors.New("unexpected return code supplied")
+		}
+		return c, nil
 	} else if !IsReasonCodeAvailable(rc) {
 		return nil, errors.New("unexpected reason code supplied")
 	} else {
 		c.ReasonCode = ReasonCode(rc)
 	}
 
-	if prop, err := dec.Property(); err != nil {
+	if prop, err := dec.Property(allowedProperties[CONNACK]); err != nil {
 		if err != io.EOF {
 			return nil, errors.Wrap(err, "failed to decode property")
 		}
@@ -109,6 +119,10 @@ func (c *ConnAck) Encode() ([]byte, error) {
 	} else {
 		enc.Int(0)
 	}
+	if c.isV311() {
+		enc.Uint(connAckReturnCode(c.ReasonCode))
+		return c.Frame.Encode(enc.Get()), nil
+	}
 	enc.Byte(c.ReasonCode.Byte())
 	if c.Property != nil {
 		enc.Property(c.Property.ToProp())
@@ -98,6 +98,9 @@ func ParseConnect(f *Frame, p []byte) (c *Connect, err error) {
 	c = &Connect{
 		Frame: f,
 	}
+	if err := f.validateReserved(); err != nil {
+		return nil, err
+	}
 
 	var b int
 	dec := newDecoder(p)
@@ -110,37 +113,58 @@ func ParseConnect(f *Frame, p []byte) (c *Connect, err error) {
 	if b, err = dec.Int(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as int")
 	}
+	if b&0x01 != 0 {
+		return nil, newPacketError(MalformedPacket, "reserved flag of CONNECT must be zero")
+	}
 	c.FlagUsername = ((b >> 7) & 0x01) > 0
 	c.FlagPassword = ((b >> 6) & 0x01) > 0
 	c.WillRetain = ((b >> 5) & 0x01) > 0
 	c.WillQoS = QoSLevel(((b >> 3) & 0x03))
 	c.FlagWill = ((b >> 2) & 0x01) > 0
 	c.CleanStart = ((b >> 1) & 0x01) > 0
+	if c.WillQoS > QoS2 {
+		return nil, newPacketError(MalformedPacket, "invalid will QoS level")
+	}
+	if !c.FlagWill && (c.WillQoS != QoS0 || c.WillRetain) {
+		return nil, newPacketError(MalformedPacket, "will QoS and will retain must be zero without will flag")
+	}
+	if c.ProtocolVersion == Version311 && c.FlagPassword && !c.FlagUsername {
+		return nil, newPacketError(MalformedPacket, "password flag requires username flag on v3.1.1")
+	}
 
 	if c.KeepAlive, err = dec.Uint16(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as uint16")
 	}
+	// CONNECT packet itself tells the protocol version
+	c.SetVersion(c.ProtocolVersion)
 	// Connection variable properties enables on v5
-	if prop, err := dec.Property(); err != nil {
-		return nil, errors.Wrap(err, "failed to decode property")
-	} else if prop != nil {
-		c.Property = prop.ToConnect()
+	if !c.isV311() {
+		if prop, err := dec.Property(allowedProperties[CONNECT]); err != nil {
+			return nil, errors.Wrap(err, "failed to decode property")
+		} else if prop != nil {
+			c.Property = prop.ToConnect()
+		}
 	}
 	if c.ClientId, err = dec.String(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as string")
 	}
 	// Will properties enables on v5
-	if prop, err := dec.Property(); err != nil {
-		return nil, errors.Wrap(err, "failed to decode will property")
-	} else if prop != nil {
-		c.WillProperty = prop.ToWill()
+	if !c.isV311() {
+		if prop, err := dec.Property(willProperties); err != nil {
+			return nil, errors.Wrap(err, "failed to decode will property")
+		} else if prop != nil {
+			c.WillProperty = prop.ToWill()
+		}
 	}
 	if c.FlagWill {
 		if c.WillTopic, err = dec.String(); err != nil {
 			return nil, errors.Wrap(err, "failed to decode will topic")
 		}
-		if c.WillPayload, err = dec.String(); err != nil {
+		// Will payload is binary data, so it isn't validated as UTF-8 string
+		if payload, err := dec.Binary(); err != nil {
 			return nil, errors.Wrap(err, "failed to decode will payload")
+		} else {
+			c.WillPayload = string(payload)
 		}
 	}
 	if c.FlagUsername {
@@ -188,16 +212,21 @@ func (c *Connect) Encode() ([]byte, error) {
 	flag := (eb(c.FlagUsername)<<7 | eb(c.FlagPassword)<<6 | eb(c.WillRetain)<<5 | int(c.WillQoS)<<3 | eb(c.FlagWill)<<2 | eb(c.CleanStart)<<1)
 	enc.Int(flag)
 	enc.Uint16(c.KeepAlive)
-	if c.Property != nil {
-		enc.Property(c.Property.ToProp())
-	} else {
-		enc.Uint(0)
+	c.SetVersion(c.ProtocolVersion)
+	if !c.isV311() {
+		if c.Property != nil {
+			enc.Property(c.Property.ToProp())
+		} else {
+			enc.Uint(0)
+		}
 	}
 	enc.String(c.ClientId)
-	if c.WillProperty != nil {
-		enc.Property(c.WillProperty.ToProp())
-	} else {
-		enc.Uint(0)
+	if !c.isV311() {
+		if c.WillProperty != nil {
+			enc.Property(c.WillProperty.ToProp())
+		} else {
+			enc.Uint(0)
+		}
 	}
 	if c.WillTopic != "" {
 		enc.String(c.WillTopic)
@@ -2,7 +2,6 @@ package message
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"sync"
 )
@@ -35,15 +34,27 @@ func newDecoder(p []byte) *decoder {
 	}
 }
 
+// Read exact bytes of the buffer length, returns io.EOF if there are no remaining bytes
+// and MalformedPacket if the remaining bytes are fewer than the buffer
+func (d *decoder) read(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	} else if d.r.Len() == 0 {
+		return io.EOF
+	} else if len(b) > d.r.Len() {
+		return newPacketError(MalformedPacket, "decoder couldn't read expect bytes %d of %d", d.r.Len(), len(b))
+	}
+	_, err := io.ReadFull(d.r, b)
+	return err
+}
+
 func (d *decoder) Int() (int, error) {
 	b := decOne.Get().([]byte)
 	defer func() {
 		decOne.Put(b)
 	}()
-	if n, err := d.r.Read(b); err != nil {
+	if err := d.read(b); err != nil {
 		return 0, err
-	} else if n != 1 {
-		return 0, fmt.Errorf("decoder couldn't read expect bytes %d of 1", n)
 	}
 	return int(b[0]), nil
 }
@@ -61,10 +72,8 @@ func (d *decoder) Int16() (int, error) {
 	defer func() {
 		decTwo.Put(b)
 	}()
-	if n, err := d.r.Read(b); err != nil {
+	if err := d.read(b); err != nil {
 		return 0, err
-	} else if n != 2 {
-		return 0, fmt.Errorf("decoder couldn't read expect bytes %d of 2", n)
 	}
 	return ((int(b[0]) << 8) | int(b[1])), nil
 }
@@ -82,10 +91,8 @@ func (d *decoder) Int32() (int, error) {
 	defer func() {
 		decFour.Put(b)
 	}()
-	if n, err := d.r.Read(b); err != nil {
+	if err := d.read(b); err != nil {
 		return 0, err
-	} else if n != 4 {
-		return 0, fmt.Errorf("decoder couldn't read expect bytes %d of 4", n)
 	}
 	return ((int(b[0]) << 24) | (int(b[1]) << 16) | (int(b[2]) << 8) | int(b[3])), nil
 }
@@ -101,6 +108,8 @@ func (d *decoder) Uint32() (uint32, error) {
 func (d *decoder) String() (string, error) {
 	if buf, err := d.Binary(); err != nil {
 		return "", err
+	} else if err := validateString(string(buf)); err != nil {
+		return "", err
 	} else {
 		return string(buf), nil
 	}
@@ -120,24 +129,16 @@ func (d *decoder) Binary() ([]byte, error) {
 		return nil, err
 	}
 	buf := make([]byte, size)
-	if n, err := d.r.Read(buf); err != nil {
+	if err := d.read(buf); err != nil {
 		return nil, err
-	} else if n != size {
-		return nil, fmt.Errorf("decoder couldn't read expect bytes %d of %d", n, size)
 	}
 	return buf, nil
 }
 
 func (d *decoder) BinaryAll() ([]byte, error) {
-	remains := d.r.Len()
-	if remains == 0 {
-		return []byte{}, nil
-	}
-	buf := make([]byte, remains)
-	if n, err := d.r.Read(buf); err != nil {
+	buf := make([]byte, d.r.Len())
+	if err := d.read(buf); err != nil {
 		return nil, err
-	} else if n != remains {
-		return nil, fmt.Errorf("decoder couldn't read expect bytes %d of %d", n, remains)
 	}
 	return buf, nil
 }
@@ -161,21 +162,46 @@ func (d *decoder) Variable() (uint64, error) {
 	return size, nil
 }
 
-func (d *decoder) Property() (*Property, error) {
-	size, err := d.Int()
+// Decode length field which is encoded as Variable Byte Integer in 4 bytes at most
+func (d *decoder) Length() (int, error) {
+	var (
+		size int
+		mul  = 1
+	)
+	for i := 0; ; i++ {
+		if i == maxLengthBytes {
+			return 0, newPacketError(MalformedPacket, "length exceeds %d bytes", maxLengthBytes)
+		}
+		b, err := d.Int()
+		if err != nil {
+			return 0, err
+		}
+		size += (b & 0x7F) * mul
+		mul *= 0x80
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return size, nil
+}
+
+// Decode properties, and returns error if the property isn't in allowed set
+func (d *decoder) Property(allowed propertySet) (*Property, error) {
+	size, err := d.Length()
 	if err != nil {
 		return nil, err
 	} else if size == 0 {
 		return nil, nil
+	} else if size > d.r.Len() {
+		return nil, newPacketError(MalformedPacket, "property length %d exceeds remaining %d bytes", size, d.r.Len())
 	}
 	prop := &Property{}
 	p := make([]byte, size)
-	if n, err := d.r.Read(p); err != nil {
+	if err := d.read(p); err != nil {
 		return nil, err
-	} else if n != size {
-		return nil, fmt.Errorf("decoder couldn't read expect bytes %d of %d", n, size)
 	}
 
+	seen := propertySet{}
 	dd := newDecoder(p)
 	for {
 		sig, err := dd.Uint()
@@ -185,6 +211,12 @@ func (d *decoder) Property() (*Property, error) {
 			}
 			return nil, err
 		}
+		if err := allowed.allow(PropertyType(sig)); err != nil {
+			return nil, err
+		}
+		if err := seen.once(PropertyType(sig)); err != nil {
+			return nil, err
+		}
 		switch PropertyType(sig) {
 		case PayloadFormatIndicator:
 			if prop.PayloadFormatIndicator, err = dd.Uint(); err != nil {
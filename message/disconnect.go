@@ -35,6 +35,13 @@ func ParseDisconnect(f *Frame, p []byte) (d *Disconnect, err error) {
 		ReasonCode: NormalDisconnection,
 	}
 
+	if err := f.validateReserved(); err != nil {
+		return nil, err
+	}
+	// v3.1.1 doesn't have any payload
+	if d.isV311() {
+		return d, nil
+	}
 	dec := newDecoder(p)
 	if rc, err := dec.Uint(); err != nil {
 		if err != io.EOF {
@@ -47,7 +54,7 @@ func ParseDisconnect(f *Frame, p []byte) (d *Disconnect, err error) {
 		d.ReasonCode = ReasonCode(rc)
 	}
 
-	if prop, err := dec.Property(); err != nil {
+	if prop, err := dec.Property(allowedProperties[DISCONNECT]); err != nil {
 		if err != io.EOF {
 			return nil, errors.Wrap(err, "failed to decode property")
 		}
@@ -67,6 +74,9 @@ func NewDisconnect(code ReasonCode, opts ...option) *Disconnect {
 
 func (d *Disconnect) Encode() ([]byte, error) {
 	enc := newEncoder()
+	if d.isV311() {
+		return d.Frame.Encode(enc.Get()), nil
+	}
 	enc.Byte(d.ReasonCode.Byte())
 	if d.Property != nil {
 		enc.Property(d.Property.ToProp())
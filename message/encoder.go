@@ -69,6 +69,10 @@ func (e *encoder) BinaryAll(b []byte) {
 }
 
 func (e *encoder) Variable(v int) {
+	if v == 0 {
+		e.w.WriteByte(0)
+		return
+	}
 	b := []byte{}
 	for v > 0 {
 		digit := v % 0x80
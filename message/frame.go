@@ -1,17 +1,12 @@
 package message
 
 import (
-	"bufio"
-	"fmt"
 	"io"
-	"time"
 
 	"github.com/pkg/errors"
 	"github.com/ysugimoto/gqtt/internal/log"
 )
 
-var socketWait = time.Millisecond
-
 type Packet struct {
 	Frame   *Frame
 	Payload []byte
@@ -30,6 +25,8 @@ type Frame struct {
 	QoS    QoSLevel
 	RETAIN bool
 	Size   uint64
+	// Protocol version of the connection, it isn't encoded in fixed header
+	Version uint8
 }
 
 func newFrame(mt MessageType, options ...option) *Frame {
@@ -62,6 +59,10 @@ func (f *Frame) GetType() MessageType {
 
 func (f *Frame) Encode(payload []byte) []byte {
 	header := []byte{byte(int(f.Type<<4) | encodeBool(f.DUP)<<3 | int(f.QoS)<<1 | encodeBool(f.RETAIN))}
+	// Reserved flags of PUBREL, SUBSCRIBE and UNSUBSCRIBE are fixed to 0010
+	if hasFixedFlags(f.Type) {
+		header[0] = byte(f.Type<<4) | fixedFlags
+	}
 	varHeader := []byte{0}
 	if len(payload) > 0 {
 		varHeader = encodeVariable(len(payload))
@@ -71,13 +72,42 @@ func (f *Frame) Encode(payload []byte) []byte {
 	return append(header, payload...)
 }
 
+// Remaining length and property length are encoded in 4 bytes at most
+const maxLengthBytes = 4
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Read byte by byte from the stream which isn't io.ByteReader, in order not to consume bytes of the next packet
+type singleByteReader struct {
+	io.Reader
+	b [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(s.Reader, s.b[:]); err != nil {
+		return 0, err
+	}
+	return s.b[0], nil
+}
+
+// Receive single packet from the reader.
+// Use PacketReader for the connection which receives packets continuously
 func ReceiveFrame(r io.Reader) (*Frame, []byte, error) {
+	reader, ok := r.(byteReader)
+	if !ok {
+		reader = &singleByteReader{Reader: r}
+	}
+	return readFrame(reader)
+}
+
+func readFrame(reader byteReader) (*Frame, []byte, error) {
 	var packet byte
 	var err error
 	var size uint64
 
-	reader := bufio.NewReader(r)
-
 	// Read and extract first byte
 	packet, err = reader.ReadByte()
 	if err != nil {
@@ -85,18 +115,30 @@ func ReceiveFrame(r io.Reader) (*Frame, []byte, error) {
 	}
 	b := int(packet)
 	f := &Frame{
-		Type:   MessageType((b >> 4) & 0x0F),
-		DUP:    decodeBool(((b >> 3) & 0x01)),
-		QoS:    QoSLevel(((b >> 1) & 0x03)),
-		RETAIN: decodeBool((b & 0x01)),
+		Type: MessageType((b >> 4) & 0x0F),
 	}
-	if !IsQoSAvaliable(uint8(f.QoS)) {
-		return nil, nil, errors.New(fmt.Sprintf("invalid QoS level specified: %x", f.QoS))
+	if f.Type < CONNECT || f.Type > AUTH {
+		return nil, nil, newPacketError(MalformedPacket, "invalid packet type: %d", f.Type)
+	}
+	if hasFixedFlags(f.Type) {
+		if packet&0x0F != fixedFlags {
+			return nil, nil, newPacketError(MalformedPacket, "reserved flags of %s must be 0010", f.Type)
+		}
+	} else {
+		f.DUP = decodeBool(((b >> 3) & 0x01))
+		f.QoS = QoSLevel(((b >> 1) & 0x03))
+		f.RETAIN = decodeBool((b & 0x01))
+		if !IsQoSAvaliable(uint8(f.QoS)) {
+			return nil, nil, newPacketError(MalformedPacket, "invalid QoS level specified: %x", f.QoS)
+		}
 	}
 
 	// Read variable remain length
 	var mul uint64 = 1
-	for {
+	for i := 0; ; i++ {
+		if i == maxLengthBytes {
+			return nil, nil, newPacketError(MalformedPacket, "remaining length exceeds %d bytes", maxLengthBytes)
+		}
 		if packet, err = reader.ReadByte(); err != nil {
 			return nil, nil, errors.Wrap(err, "failed to read remain length byte")
 		}
@@ -109,10 +151,9 @@ func ReceiveFrame(r io.Reader) (*Frame, []byte, error) {
 	f.Size = size
 	payload := make([]byte, size)
 	// There are case that length is zero on PINGREQ, PINGRESP
-	if _, err = reader.Read(payload); err != nil {
+	if _, err = io.ReadFull(reader, payload); err != nil {
 		return f, nil, errors.Wrap(err, "failed to read payload")
 	}
-	time.Sleep(socketWait)
 	log.Debug("<<----------------- ", f.Type)
 	return f, payload, nil
 }
@@ -129,7 +170,6 @@ func WriteFrame(w io.Writer, m Encoder) error {
 		return errors.New("could not write enough packet")
 	}
 
-	time.Sleep(socketWait)
 	log.Debug("----------------->> ", m.GetType())
 	return nil
 }
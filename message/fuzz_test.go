@@ -0,0 +1,201 @@
+//go:build go1.18
+// +build go1.18
+
+package message_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Add encoded messages as seed corpus of fuzzing
+func addSeeds(f *testing.F, messages ...message.Encoder) {
+	for _, m := range messages {
+		buf, err := m.Encode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf, false)
+		f.Add(buf, true)
+	}
+	f.Add([]byte{}, false)
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, false)
+}
+
+// Receive frame from arbitrary bytes and parse it, both must not panic
+func fuzzParse(f *testing.F, parse func(*message.Frame, []byte) error) {
+	f.Fuzz(func(t *testing.T, data []byte, v311 bool) {
+		frame, payload, err := message.ReceiveFrame(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if v311 {
+			frame.SetVersion(message.Version311)
+		}
+		parse(frame, payload) // nolint:errcheck
+	})
+}
+
+func FuzzParseConnect(f *testing.F) {
+	cn := message.NewConnect()
+	cn.ClientId = "gqtt-fuzz"
+	cn.Property = &message.ConnectProperty{
+		SessionExpiryInterval: 60,
+		AuthenticationMethod:  "BASIC",
+		UserProperty:          map[string]string{"foo": "bar"},
+	}
+	cn.FlagWill = true
+	cn.WillTopic = "will/topic"
+	cn.WillPayload = "bye"
+	addSeeds(f, cn)
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParseConnect(fr, p)
+		return err
+	})
+}
+
+func FuzzParseConnAck(f *testing.F) {
+	ca := message.NewConnAck(message.Success)
+	ca.Property = &message.ConnAckProperty{
+		AssignedClientIdentifier: "gqtt-fuzz",
+		ServerKeepAlive:          30,
+	}
+	addSeeds(f, ca)
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParseConnAck(fr, p)
+		return err
+	})
+}
+
+func FuzzParsePublish(f *testing.F) {
+	pb := message.NewPublish(1, message.WithQoS(message.QoS1))
+	pb.TopicName = "foo/bar"
+	pb.Body = []byte("payload")
+	pb.Property = &message.PublishProperty{
+		ContentType:     "text/plain",
+		ResponseTopic:   "response/topic",
+		CorrelationData: []byte("id"),
+		UserProperty:    map[string]string{"foo": "bar"},
+	}
+	addSeeds(f, pb)
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParsePublish(fr, p)
+		return err
+	})
+}
+
+func FuzzParsePubAck(f *testing.F) {
+	addSeeds(f, message.NewPubAck(1))
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParsePubAck(fr, p)
+		return err
+	})
+}
+
+func FuzzParsePubRec(f *testing.F) {
+	addSeeds(f, message.NewPubRec(1))
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParsePubRec(fr, p)
+		return err
+	})
+}
+
+func FuzzParsePubRel(f *testing.F) {
+	addSeeds(f, message.NewPubRel(1))
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParsePubRel(fr, p)
+		return err
+	})
+}
+
+func FuzzParsePubComp(f *testing.F) {
+	addSeeds(f, message.NewPubComp(1))
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParsePubComp(fr, p)
+		return err
+	})
+}
+
+func FuzzParseSubscribe(f *testing.F) {
+	s := message.NewSubscribe()
+	s.PacketId = 1
+	s.AddTopic(
+		message.SubscribeTopic{TopicName: "foo/+", QoS: message.QoS1},
+		message.SubscribeTopic{TopicName: "bar/#", NoLocal: true, RetainHandling: 2},
+	)
+	addSeeds(f, s)
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParseSubscribe(fr, p)
+		return err
+	})
+}
+
+func FuzzParseSubAck(f *testing.F) {
+	addSeeds(f, message.NewSubAck(1, message.GrantedQoS0, message.GrantedQoS1))
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParseSubAck(fr, p)
+		return err
+	})
+}
+
+func FuzzParseUnsubscribe(f *testing.F) {
+	u := message.NewUnsubscribe()
+	u.PacketId = 1
+	u.AddTopic("foo/+", "bar/#")
+	addSeeds(f, u)
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParseUnsubscribe(fr, p)
+		return err
+	})
+}
+
+func FuzzParseUnsubAck(f *testing.F) {
+	u := message.NewUnsubAck(message.Success)
+	u.PacketId = 1
+	addSeeds(f, u)
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParseUnsubAck(fr, p)
+		return err
+	})
+}
+
+func FuzzParsePingReq(f *testing.F) {
+	addSeeds(f, message.NewPingReq())
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParsePingReq(fr, p)
+		return err
+	})
+}
+
+func FuzzParsePingResp(f *testing.F) {
+	addSeeds(f, message.NewPingResp())
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParsePingResp(fr, p)
+		return err
+	})
+}
+
+func FuzzParseDisconnect(f *testing.F) {
+	dc := message.NewDisconnect(message.NormalDisconnection)
+	dc.Property = &message.DisconnectProperty{ReasonString: "bye"}
+	addSeeds(f, dc)
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParseDisconnect(fr, p)
+		return err
+	})
+}
+
+func FuzzParseAuth(f *testing.F) {
+	a := message.NewAuth(message.ContinueAuthentication)
+	a.Property = &message.AuthProperty{
+		AuthenticationMethod: "BASIC",
+		AuthenticationData:   []byte("foo:bar"),
+	}
+	addSeeds(f, a)
+	fuzzParse(f, func(fr *message.Frame, p []byte) error {
+		_, err := message.ParseAuth(fr, p)
+		return err
+	})
+}
@@ -11,6 +11,7 @@ type (
 	QoSLevel     uint8
 	Encoder      interface {
 		Duplicate()
+		SetVersion(v uint8)
 		GetType() MessageType
 		Encode() ([]byte, error)
 	}
@@ -5,6 +5,9 @@ type PingReq struct {
 }
 
 func ParsePingReq(f *Frame, p []byte) (*PingReq, error) {
+	if err := f.validateReserved(); err != nil {
+		return nil, err
+	}
 	return &PingReq{
 		Frame: f,
 	}, nil
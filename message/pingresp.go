@@ -5,6 +5,9 @@ type PingResp struct {
 }
 
 func ParsePingResp(f *Frame, p []byte) (*PingResp, error) {
+	if err := f.validateReserved(); err != nil {
+		return nil, err
+	}
 	return &PingResp{
 		Frame: f,
 	}, nil
@@ -31,6 +31,9 @@ func ParsePubAck(f *Frame, p []byte) (pa *PubAck, err error) {
 		Frame:      f,
 		ReasonCode: Success,
 	}
+	if err := f.validateReserved(); err != nil {
+		return nil, err
+	}
 	dec := newDecoder(p)
 	if pa.PacketId, err = dec.Uint16(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as uint16")
@@ -46,7 +49,7 @@ func ParsePubAck(f *Frame, p []byte) (pa *PubAck, err error) {
 		pa.ReasonCode = ReasonCode(rc)
 	}
 
-	if prop, err := dec.Property(); err != nil {
+	if prop, err := dec.Property(allowedProperties[PUBACK]); err != nil {
 		if err != io.EOF {
 			return nil, errors.Wrap(err, "failed to decode property")
 		}
@@ -76,9 +79,12 @@ func (p *PubAck) Encode() ([]byte, error) {
 	}
 	enc := newEncoder()
 	enc.Uint16(p.PacketId)
-	enc.Byte(p.ReasonCode.Byte())
-	if p.Property != nil {
-		enc.Property(p.Property.ToProp())
+	// v3.1.1 has only packet identifier
+	if !p.isV311() {
+		enc.Byte(p.ReasonCode.Byte())
+		if p.Property != nil {
+			enc.Property(p.Property.ToProp())
+		}
 	}
 
 	return p.Frame.Encode(enc.Get()), nil
@@ -14,6 +14,16 @@ type Publish struct {
 	Property *PublishProperty
 }
 
+// Copy the message with fixed header flags and protocol version.
+// Modifying the copy e.g. PacketId or DUP flag doesn't affect the original message which other subscribers share
+func (p *Publish) Copy() *Publish {
+	copied := p.Downgrade(p.QoS)
+	copied.DUP = p.DUP
+	copied.SetRetain(p.RETAIN)
+	copied.SetVersion(p.Version)
+	return copied
+}
+
 // Downgrade QoS.
 // Create new pointer in order to avoid unpexected copy data
 func (p *Publish) Downgrade(qos QoSLevel) *Publish {
@@ -41,6 +51,22 @@ func (p *Publish) Downgrade(qos QoSLevel) *Publish {
 	return downgraded
 }
 
+// Get the message which is encoded by the protocol version.
+// The message is copied if the version differs, because the message is shared between subscribers.
+func (p *Publish) ForVersion(v uint8) *Publish {
+	if p.isV311() == isLegacyVersion(v) {
+		return p
+	}
+	translated := p.Downgrade(p.QoS)
+	translated.SetRetain(p.RETAIN)
+	translated.SetVersion(v)
+	// v3.1.1 subscriber can't receive any properties
+	if translated.isV311() {
+		translated.Property = nil
+	}
+	return translated
+}
+
 type PublishProperty struct {
 	PayloadFormatIndicator uint8
 	MessageExpiryInterval  uint32
@@ -69,6 +95,9 @@ func ParsePublish(f *Frame, p []byte) (pb *Publish, err error) {
 	pb = &Publish{
 		Frame: f,
 	}
+	if f.QoS == QoS0 && f.DUP {
+		return nil, newPacketError(MalformedPacket, "DUP flag must be zero on QoS0")
+	}
 	dec := newDecoder(p)
 	if pb.TopicName, err = dec.String(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as string")
@@ -77,12 +106,23 @@ func ParsePublish(f *Frame, p []byte) (pb *Publish, err error) {
 	if f.QoS > 0 {
 		if pb.PacketId, err = dec.Uint16(); err != nil {
 			return nil, errors.Wrap(err, "failed to decode as uint16")
+		} else if pb.PacketId == 0 {
+			return nil, newPacketError(MalformedPacket, "PacketId must not be zero")
+		}
+	}
+	if !pb.isV311() {
+		if prop, err := dec.Property(allowedProperties[PUBLISH]); err != nil {
+			return nil, errors.Wrap(err, "failed to decode property")
+		} else if prop != nil {
+			pb.Property = prop.ToPublish()
 		}
 	}
-	if prop, err := dec.Property(); err != nil {
-		return nil, errors.Wrap(err, "failed to decode property")
-	} else if prop != nil {
-		pb.Property = prop.ToPublish()
+	// Topic name is validated after properties, because empty topic name is allowed with Topic Alias.
+	// The receiver resolves the topic name from the alias
+	if pb.TopicName != "" || pb.Property == nil || pb.Property.TopicAlias == 0 {
+		if err := ValidateTopicName(pb.TopicName); err != nil {
+			return nil, err
+		}
 	}
 	if pb.Body, err = dec.BinaryAll(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as binary slice")
@@ -116,10 +156,12 @@ func (p *Publish) Encode() ([]byte, error) {
 	if p.Frame.QoS > 0 {
 		enc.Uint16(p.PacketId)
 	}
-	if p.Property != nil {
-		enc.Property(p.Property.ToProp())
-	} else {
-		enc.Uint(0)
+	if !p.isV311() {
+		if p.Property != nil {
+			enc.Property(p.Property.ToProp())
+		} else {
+			enc.Uint(0)
+		}
 	}
 	enc.BinaryAll(p.Body)
 
@@ -86,3 +86,19 @@ func TestDecodePublishFromRawBytes(t *testing.T) {
 	_, err = message.ParsePublish(f, p)
 	assert.NoError(t, err)
 }
+
+func TestCopyPublishDoesNotShareState(t *testing.T) {
+	pb := message.NewPublish(10, message.WithQoS(message.QoS1))
+	pb.TopicName = "gqtt/example"
+	pb.Body = []byte("gqtt-body")
+	pb.SetRetain(true)
+
+	copied := pb.Copy()
+	copied.PacketId = 20
+	copied.SetRetain(false)
+	assert.Equal(t, uint16(10), pb.PacketId)
+	assert.True(t, pb.RETAIN)
+	assert.Equal(t, pb.TopicName, copied.TopicName)
+	assert.Equal(t, pb.Body, copied.Body)
+	assert.Equal(t, message.QoS1, copied.QoS)
+}
@@ -46,7 +46,7 @@ func ParsePubRel(f *Frame, p []byte) (pr *PubRel, err error) {
 		pr.ReasonCode = ReasonCode(rc)
 	}
 
-	if prop, err := dec.Property(); err != nil {
+	if prop, err := dec.Property(allowedProperties[PUBREL]); err != nil {
 		if err != io.EOF {
 			return nil, errors.Wrap(err, "failed to decode property")
 		}
@@ -77,9 +77,12 @@ func (p *PubRel) Encode() ([]byte, error) {
 
 	enc := newEncoder()
 	enc.Uint16(p.PacketId)
-	enc.Byte(p.ReasonCode.Byte())
-	if p.Property != nil {
-		enc.Property(p.Property.ToProp())
+	// v3.1.1 has only packet identifier
+	if !p.isV311() {
+		enc.Byte(p.ReasonCode.Byte())
+		if p.Property != nil {
+			enc.Property(p.Property.ToProp())
+		}
 	}
 
 	return p.Frame.Encode(enc.Get()), nil
@@ -0,0 +1,194 @@
+package message
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/internal/log"
+)
+
+const streamBufferSize = 4096
+
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, streamBufferSize)
+	},
+}
+
+// PacketReader reads packets from the connection continuously.
+// Bytes which have been buffered beyond the current packet are kept for the next read,
+// so create one reader for the connection and use it until the connection is closed.
+type PacketReader struct {
+	r *bufio.Reader
+}
+
+func NewPacketReader(r io.Reader) *PacketReader {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return &PacketReader{
+		r: br,
+	}
+}
+
+// Read next packet, the payload is read fully or returns error
+func (r *PacketReader) ReadFrame() (*Frame, []byte, error) {
+	if r.r == nil {
+		return nil, nil, errors.New("packet reader has been released")
+	}
+	return readFrame(r.r)
+}
+
+// Return the buffer to the pool. The reader must not be used after release
+func (r *PacketReader) Release() {
+	if r.r == nil {
+		return
+	}
+	r.r.Reset(nil)
+	readerPool.Put(r.r)
+	r.r = nil
+}
+
+// Connection which can write multiple buffers at once like writev(2), e.g. wrapper of net.Conn
+type BuffersWriter interface {
+	WriteBuffers(bufs net.Buffers) (int64, error)
+}
+
+const (
+	// Number of packets which can be queued before WriteFrame blocks
+	DefaultWriteQueueSize = 64
+	// Deadline of writing a batch of packets to the connection
+	DefaultWriteTimeout = 10 * time.Second
+	// Maximum number of packets which are coalesced into one write
+	maxWriteBatch = 32
+)
+
+var errWriterClosed = errors.New("packet writer has been closed")
+
+type outbound struct {
+	buf    []byte
+	result chan error
+}
+
+var outboundPool = sync.Pool{
+	New: func() interface{} {
+		return &outbound{
+			result: make(chan error, 1),
+		}
+	},
+}
+
+// PacketWriter writes packets to the connection from the single goroutine.
+// WriteFrame is safe for concurrent use, packets are queued to the bounded channel and written without interleaving.
+// Queued packets are coalesced into one write, and WriteFrame blocks while the queue is full.
+type PacketWriter struct {
+	w       io.Writer
+	queue   chan *outbound
+	done    chan struct{}
+	once    sync.Once
+	timeout time.Duration
+}
+
+func NewPacketWriter(w io.Writer) *PacketWriter {
+	return NewPacketWriterSize(w, DefaultWriteQueueSize, DefaultWriteTimeout)
+}
+
+// Create writer with queue size and write timeout. Zero timeout disables write deadline
+func NewPacketWriterSize(w io.Writer, size int, timeout time.Duration) *PacketWriter {
+	pw := &PacketWriter{
+		w:       w,
+		queue:   make(chan *outbound, size),
+		done:    make(chan struct{}),
+		timeout: timeout,
+	}
+	go pw.run()
+	return pw
+}
+
+// Queue the packet and wait until it is written to the connection
+func (w *PacketWriter) WriteFrame(m Encoder) error {
+	buf, err := m.Encode()
+	if err != nil {
+		return errors.Wrap(err, "failed to encode message")
+	}
+
+	ob := outboundPool.Get().(*outbound)
+	ob.buf = buf
+	select {
+	case <-w.done:
+		outboundPool.Put(ob)
+		return errWriterClosed
+	case w.queue <- ob:
+	}
+	select {
+	case <-w.done:
+		// Writer goroutine may still hold the outbound, so don't return it to the pool
+		return errWriterClosed
+	case err := <-ob.result:
+		ob.buf = nil
+		outboundPool.Put(ob)
+		if err != nil {
+			return errors.Wrap(err, "failed to write encoded message")
+		}
+		log.Debug("----------------->> ", m.GetType())
+		return nil
+	}
+}
+
+// Stop writer goroutine. Queued packets which haven't been written fail
+func (w *PacketWriter) Close() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+func (w *PacketWriter) run() {
+	batch := make([]*outbound, 0, maxWriteBatch)
+	for {
+		select {
+		case <-w.done:
+			return
+		case ob := <-w.queue:
+			batch = append(batch[:0], ob)
+		}
+		// Coalesce packets which have been queued while writing the previous batch
+	coalesce:
+		for len(batch) < maxWriteBatch {
+			select {
+			case ob := <-w.queue:
+				batch = append(batch, ob)
+			default:
+				break coalesce
+			}
+		}
+
+		err := w.write(batch)
+		for _, ob := range batch {
+			ob.result <- err
+		}
+		// Connection is broken, following packets can't be written
+		if err != nil {
+			w.Close()
+			return
+		}
+	}
+}
+
+func (w *PacketWriter) write(batch []*outbound) error {
+	if d, ok := w.w.(interface{ SetWriteDeadline(time.Time) error }); ok && w.timeout > 0 {
+		d.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	bufs := make(net.Buffers, len(batch))
+	for i := range batch {
+		bufs[i] = batch[i].buf
+	}
+	if bw, ok := w.w.(BuffersWriter); ok {
+		_, err := bw.WriteBuffers(bufs)
+		return err
+	}
+	_, err := bufs.WriteTo(w.w)
+	return err
+}
@@ -0,0 +1,178 @@
+package message_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func encodePackets(t *testing.T, messages ...message.Encoder) []byte {
+	buf := new(bytes.Buffer)
+	for _, m := range messages {
+		assert.NoError(t, message.WriteFrame(buf, m))
+	}
+	return buf.Bytes()
+}
+
+func TestPacketReader(t *testing.T) {
+	large := message.NewPublish(1, message.WithQoS(message.QoS1))
+	large.TopicName = "foo/large"
+	large.Body = bytes.Repeat([]byte("x"), 100000)
+	small := message.NewPublish(0)
+	small.TopicName = "foo/small"
+	small.Body = []byte("small")
+	packets := encodePackets(t, small, large, message.NewPingReq(), small)
+
+	t.Run("Pipelined packets are read in order", func(t *testing.T) {
+		r := message.NewPacketReader(bytes.NewReader(packets))
+		defer r.Release()
+		for _, expect := range []message.MessageType{message.PUBLISH, message.PUBLISH, message.PINGREQ, message.PUBLISH} {
+			f, p, err := r.ReadFrame()
+			assert.NoError(t, err)
+			assert.Equal(t, expect, f.Type)
+			assert.Equal(t, f.Size, uint64(len(p)))
+		}
+	})
+
+	t.Run("Payload is read fully from short reads", func(t *testing.T) {
+		r := message.NewPacketReader(iotest.OneByteReader(bytes.NewReader(packets)))
+		defer r.Release()
+		_, _, err := r.ReadFrame()
+		assert.NoError(t, err)
+		f, p, err := r.ReadFrame()
+		assert.NoError(t, err)
+		pb, err := message.ParsePublish(f, p)
+		assert.NoError(t, err)
+		assert.Equal(t, large.Body, pb.Body)
+	})
+
+	t.Run("ReceiveFrame doesn't consume next packet", func(t *testing.T) {
+		r := iotest.OneByteReader(bytes.NewReader(packets))
+		for i := 0; i < 4; i++ {
+			_, _, err := message.ReceiveFrame(r)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("Released reader returns error", func(t *testing.T) {
+		r := message.NewPacketReader(bytes.NewReader(packets))
+		r.Release()
+		_, _, err := r.ReadFrame()
+		assert.Error(t, err)
+	})
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func TestPacketWriter(t *testing.T) {
+	out := &lockedBuffer{}
+	w := message.NewPacketWriter(out)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			pb := message.NewPublish(id, message.WithQoS(message.QoS1))
+			pb.TopicName = "foo/bar"
+			pb.Body = bytes.Repeat([]byte("y"), 5000)
+			assert.NoError(t, w.WriteFrame(pb))
+		}(uint16(i))
+	}
+	wg.Wait()
+	w.Close()
+	assert.Error(t, w.WriteFrame(message.NewPingReq()))
+
+	// Concurrent writes must not be interleaved
+	r := message.NewPacketReader(bytes.NewReader(out.buf.Bytes()))
+	defer r.Release()
+	for i := 0; i < 50; i++ {
+		f, p, err := r.ReadFrame()
+		assert.NoError(t, err)
+		_, err = message.ParsePublish(f, p)
+		assert.NoError(t, err)
+	}
+}
+
+// Writer which blocks until unblocked, and records number of packets in each write
+type blockingWriter struct {
+	unblock chan struct{}
+	mu      sync.Mutex
+	batches []int
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (b *blockingWriter) WriteBuffers(bufs net.Buffers) (int64, error) {
+	<-b.unblock
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches = append(b.batches, len(bufs))
+	var n int64
+	for _, buf := range bufs {
+		n += int64(len(buf))
+	}
+	return n, nil
+}
+
+func TestPacketWriterCoalesce(t *testing.T) {
+	bw := &blockingWriter{unblock: make(chan struct{})}
+	w := message.NewPacketWriterSize(bw, 2, 0)
+	defer w.Close()
+
+	results := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			results <- w.WriteFrame(message.NewPingReq())
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	// Packets are being written or queued, and the rest is blocked by backpressure
+	select {
+	case <-results:
+		t.Fatal("WriteFrame must wait until the packet is written")
+	default:
+	}
+	close(bw.unblock)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, <-results)
+	}
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	var total int
+	for _, n := range bw.batches {
+		total += n
+	}
+	assert.Equal(t, 4, total)
+	assert.True(t, len(bw.batches) < 4, "queued packets must be coalesced")
+}
+
+func TestPacketWriterDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Nobody reads from pipe, so write must be timed out
+	w := message.NewPacketWriterSize(client, 1, 100*time.Millisecond)
+	defer w.Close()
+	assert.Error(t, w.WriteFrame(message.NewPingReq()))
+	// Writer is closed after write error
+	assert.Error(t, w.WriteFrame(message.NewPingReq()))
+}
@@ -32,14 +32,19 @@ func ParseSubAck(f *Frame, p []byte) (s *SubAck, err error) {
 		ReasonCodes: make([]ReasonCode, 0),
 	}
 
+	if err := f.validateReserved(); err != nil {
+		return nil, err
+	}
 	dec := newDecoder(p)
 	if s.PacketId, err = dec.Uint16(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as uint16")
 	}
-	if prop, err := dec.Property(); err != nil {
-		return nil, errors.Wrap(err, "failed to decode property")
-	} else if prop != nil {
-		s.Property = prop.ToSubAck()
+	if !s.isV311() {
+		if prop, err := dec.Property(allowedProperties[SUBACK]); err != nil {
+			return nil, errors.Wrap(err, "failed to decode property")
+		} else if prop != nil {
+			s.Property = prop.ToSubAck()
+		}
 	}
 	for {
 		if rc, err := dec.Uint(); err != nil {
@@ -47,6 +52,8 @@ func ParseSubAck(f *Frame, p []byte) (s *SubAck, err error) {
 				break
 			}
 			return nil, errors.Wrap(err, "failed to decode uint")
+		} else if s.isV311() && rc == subAckFailure {
+			s.ReasonCodes = append(s.ReasonCodes, UnspecifiedError)
 		} else if !IsReasonCodeAvailable(rc) {
 			return nil, errors.New("invalid reason code supplied")
 		} else {
@@ -86,6 +93,17 @@ func (s *SubAck) Encode() ([]byte, error) {
 	}
 	enc := newEncoder()
 	enc.Uint16(s.PacketId)
+	if s.isV311() {
+		// v3.1.1 has only granted QoS or failure return code
+		for _, v := range s.ReasonCodes {
+			if v > GrantedQoS2 {
+				enc.Uint(subAckFailure)
+			} else {
+				enc.Uint(v.Byte())
+			}
+		}
+		return s.Frame.Encode(enc.Get()), nil
+	}
 	if s.Property != nil {
 		enc.Property(s.Property.ToProp())
 	} else {
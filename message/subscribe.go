@@ -43,11 +43,15 @@ func ParseSubscribe(f *Frame, p []byte) (s *Subscribe, err error) {
 	dec := newDecoder(p)
 	if s.PacketId, err = dec.Uint16(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as uint16")
+	} else if s.PacketId == 0 {
+		return nil, newPacketError(MalformedPacket, "PacketId must not be zero")
 	}
-	if prop, err := dec.Property(); err != nil {
-		return nil, errors.Wrap(err, "failed to decode property")
-	} else if prop != nil {
-		s.Property = prop.ToSubscribe()
+	if !s.isV311() {
+		if prop, err := dec.Property(allowedProperties[SUBSCRIBE]); err != nil {
+			return nil, errors.Wrap(err, "failed to decode property")
+		} else if prop != nil {
+			s.Property = prop.ToSubscribe()
+		}
 	}
 	// payload for Topic filter + subscription options, ...
 	for {
@@ -62,15 +66,24 @@ func ParseSubscribe(f *Frame, p []byte) (s *Subscribe, err error) {
 		if b, err = dec.Int(); err != nil {
 			return nil, errors.Wrap(err, "failed to decode as int")
 		}
+		if err := validateSubscriptionOptions(b, s.isV311()); err != nil {
+			return nil, err
+		}
 		st := SubscribeTopic{
-			RetainHandling: uint8((b >> 4) & 0x03),
-			RAP:            ((b >> 3) & 0x01) > 0,
-			NoLocal:        (b >> 2 & 0x01) > 0,
-			QoS:            QoSLevel((b & 0x03)),
-			TopicName:      t,
+			QoS:       QoSLevel((b & 0x03)),
+			TopicName: t,
+		}
+		// Subscription options except QoS are available on v5
+		if !s.isV311() {
+			st.RetainHandling = uint8((b >> 4) & 0x03)
+			st.RAP = ((b >> 3) & 0x01) > 0
+			st.NoLocal = (b >> 2 & 0x01) > 0
 		}
 		s.Subscriptions = append(s.Subscriptions, st)
 	}
+	if len(s.Subscriptions) == 0 {
+		return nil, newPacketError(ProtocolError, "SUBSCRIBE must contain at least one topic filter")
+	}
 	return s, nil
 }
 
@@ -104,10 +117,12 @@ func (s *Subscribe) Encode() ([]byte, error) {
 
 	enc := newEncoder()
 	enc.Uint16(s.PacketId)
-	if s.Property != nil {
-		enc.Property(s.Property.ToProp())
-	} else {
-		enc.Uint(0)
+	if !s.isV311() {
+		if s.Property != nil {
+			enc.Property(s.Property.ToProp())
+		} else {
+			enc.Uint(0)
+		}
 	}
 
 	eb := func(b bool) int {
@@ -118,6 +133,10 @@ func (s *Subscribe) Encode() ([]byte, error) {
 	}
 	for _, v := range s.Subscriptions {
 		enc.String(v.TopicName)
+		if s.isV311() {
+			enc.Uint(uint8(v.QoS))
+			continue
+		}
 		enc.Uint(uint8(int(v.RetainHandling)<<4 | eb(v.RAP)<<3 | eb(v.NoLocal)<<2 | int(v.QoS)))
 	}
 
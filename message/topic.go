@@ -0,0 +1,35 @@
+package message
+
+import (
+	"strings"
+)
+
+// Check topic name matches to topic filter which may contain wildcards
+func MatchTopic(filter, topic string) bool {
+	if filter == topic {
+		return true
+	}
+	// Topics which start with "$" don't match to filter which starts with wildcard
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		switch f {
+		case "#":
+			// Multi-level wildcard also matches to parent level
+			return i == len(fs)-1
+		case "+":
+			if i >= len(ts) {
+				return false
+			}
+		default:
+			if i >= len(ts) || f != ts[i] {
+				return false
+			}
+		}
+	}
+	return len(fs) == len(ts)
+}
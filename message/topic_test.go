@@ -0,0 +1,22 @@
+package message_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestMatchTopic(t *testing.T) {
+	assert.True(t, message.MatchTopic("foo/bar", "foo/bar"))
+	assert.False(t, message.MatchTopic("foo/bar", "foo/baz"))
+	assert.True(t, message.MatchTopic("foo/+", "foo/bar"))
+	assert.False(t, message.MatchTopic("foo/+", "foo/bar/baz"))
+	assert.True(t, message.MatchTopic("foo/+/baz", "foo/bar/baz"))
+	assert.True(t, message.MatchTopic("foo/#", "foo"))
+	assert.True(t, message.MatchTopic("foo/#", "foo/bar/baz"))
+	assert.True(t, message.MatchTopic("#", "foo/bar"))
+	assert.False(t, message.MatchTopic("#", "$SYS/broker"))
+	assert.False(t, message.MatchTopic("+/broker", "$SYS/broker"))
+	assert.True(t, message.MatchTopic("$SYS/#", "$SYS/broker"))
+}
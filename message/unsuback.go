@@ -32,11 +32,18 @@ func ParseUnsubAck(f *Frame, p []byte) (u *UnsubAck, err error) {
 		ReasonCodes: make([]ReasonCode, 0),
 	}
 
+	if err := f.validateReserved(); err != nil {
+		return nil, err
+	}
 	dec := newDecoder(p)
 	if u.PacketId, err = dec.Uint16(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as uint16")
 	}
-	if prop, err := dec.Property(); err != nil {
+	// v3.1.1 has only packet identifier
+	if u.isV311() {
+		return u, nil
+	}
+	if prop, err := dec.Property(allowedProperties[UNSUBACK]); err != nil {
 		return nil, errors.Wrap(err, "failed to decode property")
 	} else if prop != nil {
 		u.Property = prop.ToUnsubAck()
@@ -85,6 +92,9 @@ func (u *UnsubAck) Encode() ([]byte, error) {
 	}
 	enc := newEncoder()
 	enc.Uint16(u.PacketId)
+	if u.isV311() {
+		return u.Frame.Encode(enc.Get()), nil
+	}
 	if u.Property != nil {
 		enc.Property(u.Property.ToProp())
 	} else {
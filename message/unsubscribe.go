@@ -34,10 +34,12 @@ func ParseUnsubscribe(f *Frame, p []byte) (u *Unsubscribe, err error) {
 	if u.PacketId, err = dec.Uint16(); err != nil {
 		return nil, errors.Wrap(err, "failed to decode as uint16")
 	}
-	if prop, err := dec.Property(); err != nil {
-		return nil, errors.Wrap(err, "failed to decode property")
-	} else if prop != nil {
-		u.Property = prop.ToUnsubscribe()
+	if !u.isV311() {
+		if prop, err := dec.Property(allowedProperties[UNSUBSCRIBE]); err != nil {
+			return nil, errors.Wrap(err, "failed to decode property")
+		} else if prop != nil {
+			u.Property = prop.ToUnsubscribe()
+		}
 	}
 
 	for {
@@ -50,6 +52,9 @@ func ParseUnsubscribe(f *Frame, p []byte) (u *Unsubscribe, err error) {
 		}
 		u.Topics = append(u.Topics, str)
 	}
+	if len(u.Topics) == 0 {
+		return nil, newPacketError(ProtocolError, "UNSUBSCRIBE must contain at least one topic filter")
+	}
 
 	return u, nil
 }
@@ -84,10 +89,12 @@ func (u *Unsubscribe) Encode() ([]byte, error) {
 
 	enc := newEncoder()
 	enc.Uint16(u.PacketId)
-	if u.Property != nil {
-		enc.Property(u.Property.ToProp())
-	} else {
-		enc.Uint(0)
+	if !u.isV311() {
+		if u.Property != nil {
+			enc.Property(u.Property.ToProp())
+		} else {
+			enc.Uint(0)
+		}
 	}
 
 	for _, v := range u.Topics {
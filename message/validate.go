@@ -0,0 +1,189 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// PacketError is the error of the packet which violates the spec.
+// Code is the reason code which receiver should respond with CONNACK or DISCONNECT.
+type PacketError struct {
+	Code   ReasonCode
+	Reason string
+}
+
+func (e *PacketError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+func newPacketError(code ReasonCode, format string, args ...interface{}) error {
+	return &PacketError{
+		Code:   code,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// Find reason code from the error which is returned on parsing packet.
+// fallback is returned if the error isn't PacketError, e.g. the packet is truncated.
+func ReasonCodeOf(err error, fallback ReasonCode) ReasonCode {
+	if e, ok := errors.Cause(err).(*PacketError); ok {
+		return e.Code
+	}
+	return fallback
+}
+
+type propertySet map[PropertyType]struct{}
+
+func newPropertySet(types ...PropertyType) propertySet {
+	s := propertySet{
+		// User Property is allowed for all packets which have properties
+		UserProperty: {},
+	}
+	for _, t := range types {
+		s[t] = struct{}{}
+	}
+	return s
+}
+
+var (
+	// Properties which are allowed for each packet type
+	allowedProperties = map[MessageType]propertySet{
+		CONNECT: newPropertySet(
+			SessionExpiryInterval, AuthenticationMethod, AuthenticationData, RequestProblemInformation,
+			RequestResponseInformation, ReceiveMaximum, TopicAliasMaximum, MaximumPacketSize,
+		),
+		CONNACK: newPropertySet(
+			SessionExpiryInterval, AssignedClientIdentifier, ServerKeepAlive, AuthenticationMethod,
+			AuthenticationData, ResponseInformation, ServerReference, ReasonString, ReceiveMaximum,
+			TopicAliasMaximum, MaximumQoS, RetainAvalilable, MaximumPacketSize,
+			WildcardSubscriptionAvailable, SubscrptionIdentifierAvailable, SharedSubscriptionsAvaliable,
+		),
+		PUBLISH: newPropertySet(
+			PayloadFormatIndicator, MessageExpiryInterval, ContentType, ResponseTopic, CorrelationData,
+			SubscriptionIdentifier, TopicAlias,
+		),
+		PUBACK:      newPropertySet(ReasonString),
+		PUBREC:      newPropertySet(ReasonString),
+		PUBREL:      newPropertySet(ReasonString),
+		PUBCOMP:     newPropertySet(ReasonString),
+		SUBSCRIBE:   newPropertySet(SubscriptionIdentifier),
+		SUBACK:      newPropertySet(ReasonString),
+		UNSUBSCRIBE: newPropertySet(),
+		UNSUBACK:    newPropertySet(ReasonString),
+		DISCONNECT:  newPropertySet(SessionExpiryInterval, ServerReference, ReasonString),
+		AUTH:        newPropertySet(AuthenticationMethod, AuthenticationData, ReasonString),
+	}
+
+	// Properties which are allowed for will message in CONNECT
+	willProperties = newPropertySet(
+		PayloadFormatIndicator, MessageExpiryInterval, ContentType, ResponseTopic, CorrelationData,
+		WillDelayInterval,
+	)
+)
+
+func (s propertySet) allow(t PropertyType) error {
+	if _, ok := s[t]; !ok {
+		return newPacketError(MalformedPacket, "property 0x%02X is not allowed", byte(t))
+	}
+	return nil
+}
+
+// Record the property and returns ProtocolError if it has already appeared.
+// User Property and Subscription Identifier may appear multiple times
+func (s propertySet) once(t PropertyType) error {
+	if t == UserProperty || t == SubscriptionIdentifier {
+		return nil
+	}
+	if _, ok := s[t]; ok {
+		return newPacketError(ProtocolError, "property 0x%02X is included more than once", byte(t))
+	}
+	s[t] = struct{}{}
+	return nil
+}
+
+// Reserved flags of fixed header on PUBREL, SUBSCRIBE and UNSUBSCRIBE
+const fixedFlags byte = 0x02
+
+func hasFixedFlags(t MessageType) bool {
+	return t == PUBREL || t == SUBSCRIBE || t == UNSUBSCRIBE
+}
+
+// Check reserved flags of fixed header, they must be 0000 except PUBLISH
+func (f *Frame) validateReserved() error {
+	if f.DUP || f.QoS != QoS0 || f.RETAIN {
+		return newPacketError(MalformedPacket, "reserved flags of %s must be 0000", f.Type)
+	}
+	return nil
+}
+
+// Check UTF-8 encoded string. It must be valid UTF-8 and must not contain U+0000
+func validateString(s string) error {
+	if !utf8.ValidString(s) {
+		return newPacketError(MalformedPacket, "string is not valid UTF-8")
+	}
+	if strings.ContainsRune(s, 0) {
+		return newPacketError(MalformedPacket, "string must not contain U+0000")
+	}
+	return nil
+}
+
+// Check subscription options byte of SUBSCRIBE
+func validateSubscriptionOptions(b int, legacy bool) error {
+	if legacy && b&0xFC != 0 {
+		return newPacketError(MalformedPacket, "reserved bits of subscription options must be zero")
+	}
+	if b&0xC0 != 0 {
+		return newPacketError(MalformedPacket, "reserved bits of subscription options must be zero")
+	}
+	if b&0x03 == 0x03 {
+		return newPacketError(MalformedPacket, "invalid QoS level in subscription options")
+	}
+	if (b>>4)&0x03 == 0x03 {
+		return newPacketError(ProtocolError, "invalid retain handling in subscription options")
+	}
+	return nil
+}
+
+// Check protocol name and version of CONNECT packet
+func (c *Connect) ValidateProtocol() error {
+	if c.ProtocolName != "MQTT" || !IsVersionAvailable(c.ProtocolVersion) {
+		return newPacketError(UnsupportedProtocolVersion, "unsupported protocol %s version %d", c.ProtocolName, c.ProtocolVersion)
+	}
+	return nil
+}
+
+// Check topic name of PUBLISH, it must not be empty and must not contain wildcards
+func ValidateTopicName(topic string) error {
+	if topic == "" {
+		return newPacketError(ProtocolError, "topic name must not be empty")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return newPacketError(TopicNameInvalid, "topic name must not contain wildcards: %s", topic)
+	}
+	return nil
+}
+
+// Check topic filter of SUBSCRIBE.
+// Single-level wildcard must occupy entire level, and multi-level wildcard must be the last level.
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return newPacketError(TopicFilterInvalid, "topic filter must not be empty")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return newPacketError(TopicFilterInvalid, "multi-level wildcard must be the last level: %s", filter)
+			}
+		case level == "+":
+			continue
+		case strings.ContainsAny(level, "+#"):
+			return newPacketError(TopicFilterInvalid, "wildcard must occupy entire level: %s", filter)
+		}
+	}
+	return nil
+}
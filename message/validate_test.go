@@ -0,0 +1,165 @@
+package message_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func parsePacket(t *testing.T, buf []byte) (*message.Frame, []byte) {
+	f, p, err := message.ReceiveFrame(bytes.NewReader(buf))
+	assert.NoError(t, err)
+	return f, p
+}
+
+func TestReservedFlags(t *testing.T) {
+	t.Run("SUBSCRIBE must have 0010 flags", func(t *testing.T) {
+		_, _, err := message.ReceiveFrame(bytes.NewReader([]byte{0x80, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x00}))
+		assert.Equal(t, message.MalformedPacket, message.ReasonCodeOf(err, message.Success))
+	})
+
+	t.Run("PINGREQ must have 0000 flags", func(t *testing.T) {
+		f, p := parsePacket(t, []byte{0xC8, 0x00})
+		_, err := message.ParsePingReq(f, p)
+		assert.Equal(t, message.MalformedPacket, message.ReasonCodeOf(err, message.Success))
+	})
+
+	t.Run("PUBREL is encoded with 0010 flags", func(t *testing.T) {
+		buf, err := message.NewPubRel(1).Encode()
+		assert.NoError(t, err)
+		assert.Equal(t, byte(0x62), buf[0])
+	})
+}
+
+func TestPublishValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		code   message.ReasonCode
+	}{
+		{name: "wildcard topic", packet: []byte{0x30, 0x06, 0x00, 0x03, 'a', '/', '#', 0x00}, code: message.TopicNameInvalid},
+		{name: "empty topic", packet: []byte{0x30, 0x03, 0x00, 0x00, 0x00}, code: message.ProtocolError},
+		{name: "DUP on QoS0", packet: []byte{0x38, 0x04, 0x00, 0x01, 'a', 0x00}, code: message.MalformedPacket},
+		{name: "zero packet identifier", packet: []byte{0x32, 0x06, 0x00, 0x01, 'a', 0x00, 0x00, 0x00}, code: message.MalformedPacket},
+		{name: "invalid UTF-8", packet: []byte{0x30, 0x05, 0x00, 0x02, 0xC3, 0x28, 0x00}, code: message.MalformedPacket},
+		{name: "null character", packet: []byte{0x30, 0x05, 0x00, 0x02, 'a', 0x00, 0x00}, code: message.MalformedPacket},
+		{name: "disallowed property", packet: []byte{0x30, 0x07, 0x00, 0x01, 'a', 0x03, 0x13, 0x00, 0x0A}, code: message.MalformedPacket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, p := parsePacket(t, tt.packet)
+			_, err := message.ParsePublish(f, p)
+			assert.Error(t, err)
+			assert.Equal(t, tt.code, message.ReasonCodeOf(err, message.Success))
+		})
+	}
+}
+
+func TestPublishTopicAlias(t *testing.T) {
+	t.Run("empty topic with Topic Alias", func(t *testing.T) {
+		f, p := parsePacket(t, []byte{0x30, 0x07, 0x00, 0x00, 0x03, 0x23, 0x00, 0x01, 'x'})
+		pb, err := message.ParsePublish(f, p)
+		assert.NoError(t, err)
+		assert.Equal(t, "", pb.TopicName)
+		assert.Equal(t, uint16(1), pb.Property.TopicAlias)
+		assert.Equal(t, []byte("x"), pb.Body)
+	})
+
+	t.Run("topic name is validated with Topic Alias", func(t *testing.T) {
+		f, p := parsePacket(t, []byte{0x30, 0x09, 0x00, 0x02, 'a', '#', 0x03, 0x23, 0x00, 0x01, 'x'})
+		_, err := message.ParsePublish(f, p)
+		assert.Equal(t, message.TopicNameInvalid, message.ReasonCodeOf(err, message.Success))
+	})
+}
+
+func TestSubscribeValidation(t *testing.T) {
+	t.Run("retain handling 3", func(t *testing.T) {
+		f, p := parsePacket(t, []byte{0x82, 0x07, 0x00, 0x01, 0x00, 0x00, 0x01, 'a', 0x30})
+		_, err := message.ParseSubscribe(f, p)
+		assert.Equal(t, message.ProtocolError, message.ReasonCodeOf(err, message.Success))
+	})
+
+	t.Run("no topic filters", func(t *testing.T) {
+		f, p := parsePacket(t, []byte{0x82, 0x03, 0x00, 0x01, 0x00})
+		_, err := message.ParseSubscribe(f, p)
+		assert.Equal(t, message.ProtocolError, message.ReasonCodeOf(err, message.Success))
+	})
+
+	t.Run("reserved bits of v3.1.1", func(t *testing.T) {
+		f, p := parsePacket(t, []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x04})
+		f.SetVersion(message.Version311)
+		_, err := message.ParseSubscribe(f, p)
+		assert.Equal(t, message.MalformedPacket, message.ReasonCodeOf(err, message.Success))
+	})
+}
+
+func TestConnectValidation(t *testing.T) {
+	c := message.NewConnect()
+	c.ClientId = "gqtt-example"
+	c.ProtocolName = "MQIsdp"
+	c.ProtocolVersion = 3
+	buf, err := c.Encode()
+	assert.NoError(t, err)
+
+	f, p := parsePacket(t, buf)
+	c, err = message.ParseConnect(f, p)
+	assert.NoError(t, err)
+	err = c.ValidateProtocol()
+	assert.Equal(t, message.UnsupportedProtocolVersion, message.ReasonCodeOf(err, message.Success))
+
+	// Will QoS without will flag, connect flags follow "MQIsdp" and version
+	buf[11] = 0x08
+	f, p = parsePacket(t, buf)
+	_, err = message.ParseConnect(f, p)
+	assert.Equal(t, message.MalformedPacket, message.ReasonCodeOf(err, message.Success))
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	for _, filter := range []string{"#", "+", "a/+/b", "a/#", "+/+/#", "$SYS/#"} {
+		assert.NoError(t, message.ValidateTopicFilter(filter), filter)
+	}
+	for _, filter := range []string{"", "a/#/b", "a+", "a/b#", "#/a"} {
+		err := message.ValidateTopicFilter(filter)
+		assert.Equal(t, message.TopicFilterInvalid, message.ReasonCodeOf(err, message.Success), filter)
+	}
+}
+
+func TestMalformedEncoding(t *testing.T) {
+	t.Run("remaining length exceeds 4 bytes", func(t *testing.T) {
+		_, _, err := message.ReceiveFrame(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}))
+		assert.Equal(t, message.MalformedPacket, message.ReasonCodeOf(err, message.Success))
+	})
+
+	t.Run("truncated payload", func(t *testing.T) {
+		_, _, err := message.ReceiveFrame(bytes.NewReader([]byte{0x30, 0x0A, 0x00, 0x01, 'a'}))
+		assert.Error(t, err)
+	})
+
+	tests := []struct {
+		name   string
+		packet []byte
+		code   message.ReasonCode
+	}{
+		{name: "property length exceeds packet", packet: []byte{0x40, 0x05, 0x00, 0x01, 0x00, 0x10, 0x1F}, code: message.MalformedPacket},
+		{name: "truncated property", packet: []byte{0x40, 0x06, 0x00, 0x01, 0x00, 0x02, 0x1F, 0x00}, code: message.MalformedPacket},
+		{name: "truncated string", packet: []byte{0x40, 0x08, 0x00, 0x01, 0x00, 0x04, 0x1F, 0x00, 0x05, 'a'}, code: message.MalformedPacket},
+		{name: "duplicate property", packet: []byte{0x40, 0x0C, 0x00, 0x01, 0x00, 0x08, 0x1F, 0x00, 0x01, 'a', 0x1F, 0x00, 0x01, 'b'}, code: message.ProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, p := parsePacket(t, tt.packet)
+			_, err := message.ParsePubAck(f, p)
+			assert.Error(t, err)
+			assert.Equal(t, tt.code, message.ReasonCodeOf(err, message.Success))
+		})
+	}
+
+	t.Run("multiple user properties", func(t *testing.T) {
+		f, p := parsePacket(t, []byte{0x40, 0x10, 0x00, 0x01, 0x00, 0x0C, 0x26, 0x00, 0x01, 'a', 0x00, 0x00, 0x26, 0x00, 0x01, 'b', 0x00, 0x00})
+		pa, err := message.ParsePubAck(f, p)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"a": "", "b": ""}, pa.Property.UserProperty)
+	})
+}
@@ -0,0 +1,77 @@
+package message
+
+// Protocol versions which this package can encode and decode
+const (
+	Version311 uint8 = 4
+	Version5   uint8 = 5
+)
+
+// MQTT v3.1.1 CONNACK return codes
+const (
+	connAccepted                   uint8 = 0x00
+	connRefusedProtocolVersion     uint8 = 0x01
+	connRefusedIdentifierRejected  uint8 = 0x02
+	connRefusedServerUnavailable   uint8 = 0x03
+	connRefusedBadUsernamePassword uint8 = 0x04
+	connRefusedNotAuthorized       uint8 = 0x05
+)
+
+// MQTT v3.1.1 SUBACK failure return code
+const subAckFailure uint8 = 0x80
+
+func IsVersionAvailable(v uint8) bool {
+	return v == Version311 || v == Version5
+}
+
+// Versions before v5 don't have properties and reason codes
+func isLegacyVersion(v uint8) bool {
+	return v > 0 && v < Version5
+}
+
+// Set protocol version to encode/decode the packet. Zero means v5
+func (f *Frame) SetVersion(v uint8) {
+	f.Version = v
+}
+
+// Report the packet is encoded/decoded as v3.1.1 (or older), which doesn't have any properties and reason codes
+func (f *Frame) isV311() bool {
+	return isLegacyVersion(f.Version)
+}
+
+// Convert v5 reason code to v3.1.1 CONNACK return code
+func connAckReturnCode(rc ReasonCode) uint8 {
+	switch rc {
+	case Success:
+		return connAccepted
+	case UnsupportedProtocolVersion:
+		return connRefusedProtocolVersion
+	case ClientIdentifierNotValid:
+		return connRefusedIdentifierRejected
+	case BadUsernameOrPassword:
+		return connRefusedBadUsernamePassword
+	case NotAuthorized, Banned, BadAuthenticationMethod:
+		return connRefusedNotAuthorized
+	default:
+		return connRefusedServerUnavailable
+	}
+}
+
+// Convert v3.1.1 CONNACK return code to v5 reason code
+func connAckReasonCode(rc uint8) (ReasonCode, bool) {
+	switch rc {
+	case connAccepted:
+		return Success, true
+	case connRefusedProtocolVersion:
+		return UnsupportedProtocolVersion, true
+	case connRefusedIdentifierRejected:
+		return ClientIdentifierNotValid, true
+	case connRefusedServerUnavailable:
+		return ServerUnavailable, true
+	case connRefusedBadUsernamePassword:
+		return BadUsernameOrPassword, true
+	case connRefusedNotAuthorized:
+		return NotAuthorized, true
+	default:
+		return UnspecifiedError, false
+	}
+}
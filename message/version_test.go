@@ -0,0 +1,138 @@
+package message_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestConnectV311EncodeDecode(t *testing.T) {
+	c := message.NewConnect()
+	c.ClientId = "gqtt-example"
+	c.ProtocolName = "MQTT"
+	c.ProtocolVersion = message.Version311
+	c.CleanStart = true
+	c.KeepAlive = 30
+	c.FlagWill = true
+	c.WillTopic = "will/topic"
+	c.WillPayload = "bye"
+	c.Property = &message.ConnectProperty{RequestResponseInformation: true}
+	buf, err := c.Encode()
+	assert.NoError(t, err)
+	// fixed header(2) + protocol name(6) + version(1) + flags(1) + keepalive(2) + client id(14) + will topic(12) + will payload(5)
+	assert.Equal(t, 43, len(buf))
+
+	f, p, err := message.ReceiveFrame(bytes.NewReader(buf))
+	assert.NoError(t, err)
+	c, err = message.ParseConnect(f, p)
+	assert.NoError(t, err)
+	assert.Equal(t, message.Version311, c.ProtocolVersion)
+	assert.Equal(t, "gqtt-example", c.ClientId)
+	assert.Equal(t, "will/topic", c.WillTopic)
+	assert.Equal(t, "bye", c.WillPayload)
+	assert.Nil(t, c.Property)
+	assert.Nil(t, c.WillProperty)
+}
+
+func TestConnAckV311ReturnCode(t *testing.T) {
+	tests := []struct {
+		reason  message.ReasonCode
+		code    byte
+		decoded message.ReasonCode
+	}{
+		{reason: message.Success, code: 0x00, decoded: message.Success},
+		{reason: message.UnsupportedProtocolVersion, code: 0x01, decoded: message.UnsupportedProtocolVersion},
+		{reason: message.ClientIdentifierNotValid, code: 0x02, decoded: message.ClientIdentifierNotValid},
+		{reason: message.ServerBusy, code: 0x03, decoded: message.ServerUnavailable},
+		{reason: message.BadUsernameOrPassword, code: 0x04, decoded: message.BadUsernameOrPassword},
+		{reason: message.Banned, code: 0x05, decoded: message.NotAuthorized},
+	}
+	for _, tt := range tests {
+		c := message.NewConnAck(tt.reason)
+		c.Property = &message.ConnAckProperty{ReasonString: "ignored"}
+		c.SetVersion(message.Version311)
+		buf, err := c.Encode()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x20, 0x02, 0x00, tt.code}, buf)
+
+		f, p, err := message.ReceiveFrame(bytes.NewReader(buf))
+		assert.NoError(t, err)
+		f.SetVersion(message.Version311)
+		ack, err := message.ParseConnAck(f, p)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.decoded, ack.ReasonCode)
+		assert.Nil(t, ack.Property)
+	}
+}
+
+func TestAcknowledgementsV311(t *testing.T) {
+	ack := message.NewPubAck(10)
+	ack.ReasonCode = message.QuotaExceeded
+	ack.SetVersion(message.Version311)
+	buf, err := ack.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x40, 0x02, 0x00, 0x0A}, buf)
+
+	sa := message.NewSubAck(10, message.GrantedQoS1, message.TopicFilterInvalid)
+	sa.SetVersion(message.Version311)
+	buf, err = sa.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x90, 0x04, 0x00, 0x0A, 0x01, 0x80}, buf)
+
+	ua := message.NewUnsubAck(message.Success)
+	ua.PacketId = 10
+	ua.SetVersion(message.Version311)
+	buf, err = ua.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xB0, 0x02, 0x00, 0x0A}, buf)
+
+	dc := message.NewDisconnect(message.NormalDisconnection)
+	dc.SetVersion(message.Version311)
+	buf, err = dc.Encode()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xE0, 0x00}, buf)
+}
+
+func TestSubscribeV311EncodeDecode(t *testing.T) {
+	s := message.NewSubscribe()
+	s.PacketId = 1
+	s.AddTopic(message.SubscribeTopic{TopicName: "foo/#", QoS: message.QoS1, NoLocal: true})
+	s.SetVersion(message.Version311)
+	buf, err := s.Encode()
+	assert.NoError(t, err)
+
+	f, p, err := message.ReceiveFrame(bytes.NewReader(buf))
+	assert.NoError(t, err)
+	f.SetVersion(message.Version311)
+	s, err = message.ParseSubscribe(f, p)
+	assert.NoError(t, err)
+	assert.Equal(t, []message.SubscribeTopic{{TopicName: "foo/#", QoS: message.QoS1}}, s.Subscriptions)
+}
+
+func TestPublishForVersion(t *testing.T) {
+	pb := message.NewPublish(1, message.WithQoS(message.QoS1), message.WithRetain())
+	pb.TopicName = "foo/bar"
+	pb.Body = []byte("body")
+	pb.Property = &message.PublishProperty{ContentType: "text/plain"}
+
+	assert.True(t, pb == pb.ForVersion(message.Version5))
+
+	v3 := pb.ForVersion(message.Version311)
+	assert.False(t, pb == v3)
+	assert.Nil(t, v3.Property)
+	assert.True(t, v3.RETAIN)
+	assert.NotNil(t, pb.Property)
+	buf, err := v3.Encode()
+	assert.NoError(t, err)
+
+	f, p, err := message.ReceiveFrame(bytes.NewReader(buf))
+	assert.NoError(t, err)
+	f.SetVersion(message.Version311)
+	decoded, err := message.ParsePublish(f, p)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo/bar", decoded.TopicName)
+	assert.Equal(t, []byte("body"), decoded.Body)
+	assert.Equal(t, uint16(1), decoded.PacketId)
+}
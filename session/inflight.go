@@ -0,0 +1,271 @@
+package session
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// State of outgoing QoS1/QoS2 message which is waiting for acknowledgment
+type State uint8
+
+const (
+	AwaitPubAck State = iota + 1
+	AwaitPubRec
+	AwaitPubComp
+)
+
+func (s State) String() string {
+	switch s {
+	case AwaitPubAck:
+		return "AwaitPubAck"
+	case AwaitPubRec:
+		return "AwaitPubRec"
+	case AwaitPubComp:
+		return "AwaitPubComp"
+	}
+	return "Unknown"
+}
+
+// ReasonError is the error which the receiver reported by the reason code of PUBACK or PUBREC.
+// The flow has completed, so the message isn't resent
+type ReasonError struct {
+	PacketId uint16
+	Code     message.ReasonCode
+}
+
+func (e *ReasonError) Error() string {
+	return fmt.Sprintf("message of packet identifier %d is refused by the receiver: %s", e.PacketId, e.Code)
+}
+
+// Inflight is the outgoing message which hasn't been acknowledged yet
+type Inflight struct {
+	PacketId uint16
+	Message  *message.Publish
+	State    State
+
+	// Order of allocation in order to resend messages as they were sent
+	seq uint64
+}
+
+// In-flight table keyed by packet identifier
+type inflightTable struct {
+	messages map[uint16]*Inflight
+	next     uint16
+	seq      uint64
+	mu       sync.Mutex
+}
+
+func newInflightTable() *inflightTable {
+	return &inflightTable{
+		messages: make(map[uint16]*Inflight),
+	}
+}
+
+// Allocate packet identifier which isn't in use, and register the copy of message as in-flight.
+// The original message isn't modified because it's shared with other subscribers
+func (s *Session) Allocate(pb *message.Publish) (*message.Publish, error) {
+	t := s.inflight
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id, ok := s.nextPacketId()
+	if !ok {
+		return nil, errors.New("all packet identifiers are in use")
+	}
+	out := pb.Copy()
+	out.PacketId = id
+	state := AwaitPubAck
+	if out.QoS == message.QoS2 {
+		state = AwaitPubRec
+	}
+	t.seq++
+	m := &Inflight{
+		PacketId: out.PacketId,
+		Message:  out,
+		State:    state,
+		seq:      t.seq,
+	}
+	t.messages[out.PacketId] = m
+	if s.persist != nil {
+		s.persist.SaveInflight(*m)
+	}
+	return out, nil
+}
+
+// Allocate packet identifier for the packet which isn't kept as in-flight e.g. SUBSCRIBE and UNSUBSCRIBE.
+// Identifiers of all packet types come from the same counter, so they never collide while waiting for acknowledgment
+func (s *Session) PacketId() (uint16, error) {
+	t := s.inflight
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id, ok := s.nextPacketId()
+	if !ok {
+		return 0, errors.New("all packet identifiers are in use")
+	}
+	return id, nil
+}
+
+// Find packet identifier which is used by neither in-flight messages nor packets waiting for acknowledgment.
+// Must be called with lock of in-flight table
+func (s *Session) nextPacketId() (uint16, bool) {
+	t := s.inflight
+	// 0xFFFF identifiers are available because zero isn't a valid packet identifier
+	for i := 0; i < 0xFFFF; i++ {
+		t.next++
+		if t.next == 0 {
+			t.next = 1
+		}
+		if _, ok := t.messages[t.next]; ok {
+			continue
+		}
+		if _, ok := s.stack.Load(t.next); ok {
+			continue
+		}
+		return t.next, true
+	}
+	return 0, false
+}
+
+// Update the state of in-flight message e.g. PUBREC is received and waiting for PUBCOMP
+func (s *Session) Transit(packetId uint16, state State) error {
+	t := s.inflight
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.messages[packetId]
+	if !ok {
+		return errors.Errorf("in-flight message not found for packet identifier: %d", packetId)
+	}
+	m.State = state
+	if s.persist != nil {
+		s.persist.SaveInflight(*m)
+	}
+	return nil
+}
+
+// Remove the message which has been acknowledged, then the packet identifier can be reused
+func (s *Session) Complete(packetId uint16) {
+	t := s.inflight
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.messages[packetId]; !ok {
+		return
+	}
+	delete(t.messages, packetId)
+	if s.persist != nil {
+		s.persist.DeleteInflight(packetId)
+	}
+}
+
+// Get in-flight message for the packet identifier
+func (s *Session) Inflight(packetId uint16) (Inflight, bool) {
+	t := s.inflight
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.messages[packetId]
+	if !ok {
+		return Inflight{}, false
+	}
+	return *m, true
+}
+
+// List in-flight messages in order of allocation
+func (s *Session) Inflights() []Inflight {
+	t := s.inflight
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]Inflight, 0, len(t.messages))
+	for _, m := range t.messages {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].seq < list[j].seq
+	})
+	return list
+}
+
+// Mark in-flight messages as duplicated on session resumption, and returns packet identifiers in order of allocation.
+// PUBLISH is resent with DUP flag, and PUBREL is resent for the message which has received PUBREC
+func (s *Session) Resume() []uint16 {
+	t := s.inflight
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]*Inflight, 0, len(t.messages))
+	for _, m := range t.messages {
+		// Replace with the copy because the message may be encoded by the sender at the same time
+		if m.State != AwaitPubComp && !m.Message.DUP {
+			pb := m.Message.Copy()
+			pb.DUP = true
+			m.Message = pb
+		}
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].seq < list[j].seq
+	})
+	ids := make([]uint16, len(list))
+	for i, m := range list {
+		ids[i] = m.PacketId
+	}
+	return ids
+}
+
+// Send in-flight message and wait until the flow of the QoS completes.
+// When the connection is closed before completion, the message is kept and resent on session resumption.
+// ReasonError is returned when the receiver refuses the message by PUBACK or PUBREC
+func (s *Session) Send(packetId uint16) error {
+	m, ok := s.Inflight(packetId)
+	if !ok {
+		return errors.Errorf("in-flight message not found for packet identifier: %d", packetId)
+	}
+
+	switch m.State {
+	case AwaitPubAck:
+		ack, err := s.Start(packetId, message.PUBACK, m.Message)
+		if err != nil {
+			return errors.Wrap(err, "failed to publish session for QoS1")
+		}
+		pa, ok := ack.(*message.PubAck)
+		if !ok {
+			return errors.New("failed to type conversion to PUBACK for QoS1")
+		}
+		s.Complete(packetId)
+		if pa.ReasonCode.Byte() >= 0x80 {
+			return &ReasonError{PacketId: packetId, Code: pa.ReasonCode}
+		}
+		return nil
+	case AwaitPubRec:
+		ack, err := s.Start(packetId, message.PUBREC, m.Message)
+		if err != nil {
+			return errors.Wrap(err, "failed to publish session for QoS2")
+		}
+		pr, ok := ack.(*message.PubRec)
+		if !ok {
+			return errors.New("failed to type conversion to PUBREC for QoS2")
+		}
+		// Receiver rejected the message, then the flow ends without PUBREL
+		if pr.ReasonCode.Byte() >= 0x80 {
+			s.Complete(packetId)
+			return &ReasonError{PacketId: packetId, Code: pr.ReasonCode}
+		}
+		if err := s.Transit(packetId, AwaitPubComp); err != nil {
+			return errors.Wrap(err, "failed to update in-flight state")
+		}
+	}
+
+	// On QoS2, need to send more packet for PUBREL
+	pl := message.NewPubRel(packetId)
+	pl.SetVersion(m.Message.Version)
+	ack, err := s.Start(packetId, message.PUBCOMP, pl)
+	if err != nil {
+		return errors.Wrap(err, "failed to pubrel session for QoS2")
+	} else if _, ok := ack.(*message.PubComp); !ok {
+		return errors.New("failed to type conversion to PUBCOMP for QoS2")
+	}
+	s.Complete(packetId)
+	return nil
+}
@@ -0,0 +1,206 @@
+package session_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+func newSession(ctx context.Context) *session.Session {
+	return session.New(message.NewPacketWriter(ioutil.Discard), ctx)
+}
+
+func newPublish(qos message.QoSLevel) *message.Publish {
+	pb := message.NewPublish(0, message.WithQoS(qos))
+	pb.TopicName = "foo/bar"
+	pb.Body = []byte("inflight")
+	return pb
+}
+
+func TestPacketIdSkipsPendingAcknowledgment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSession(ctx)
+
+	id, err := s.PacketId()
+	assert.NoError(t, err)
+	ss := message.NewSubscribe()
+	ss.PacketId = id
+	ss.AddTopic(message.SubscribeTopic{TopicName: "foo/#"})
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Start(id, message.SUBACK, ss)
+		done <- err
+	}()
+	for s.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// All other identifiers are allocated, then SUBSCRIBE's identifier is never reused while waiting for SUBACK
+	for i := 0; i < 0xFFFE; i++ {
+		out, err := s.Allocate(newPublish(message.QoS1))
+		assert.NoError(t, err)
+		assert.NotEqual(t, id, out.PacketId)
+	}
+	_, err = s.Allocate(newPublish(message.QoS1))
+	assert.Error(t, err)
+	_, err = s.PacketId()
+	assert.Error(t, err)
+
+	assert.NoError(t, s.Meet(id, message.SUBACK, message.NewSubAck(id, message.GrantedQoS0)))
+	assert.NoError(t, <-done)
+	out, err := s.Allocate(newPublish(message.QoS1))
+	assert.NoError(t, err)
+	assert.Equal(t, id, out.PacketId)
+}
+
+func TestSendReportsRefusedMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSession(ctx)
+
+	for _, qos := range []message.QoSLevel{message.QoS1, message.QoS2} {
+		out, err := s.Allocate(newPublish(qos))
+		assert.NoError(t, err)
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Send(out.PacketId)
+		}()
+		for s.Pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if qos == message.QoS1 {
+			ack := message.NewPubAck(out.PacketId)
+			ack.ReasonCode = message.QuotaExceeded
+			assert.NoError(t, s.Meet(out.PacketId, message.PUBACK, ack))
+		} else {
+			ack := message.NewPubRec(out.PacketId)
+			ack.ReasonCode = message.QuotaExceeded
+			assert.NoError(t, s.Meet(out.PacketId, message.PUBREC, ack))
+		}
+
+		// Refused message completes the flow, then it isn't resent
+		err = <-done
+		if assert.IsType(t, &session.ReasonError{}, err) {
+			assert.Equal(t, message.QuotaExceeded, err.(*session.ReasonError).Code)
+			assert.Equal(t, out.PacketId, err.(*session.ReasonError).PacketId)
+		}
+		_, ok := s.Inflight(out.PacketId)
+		assert.False(t, ok)
+	}
+}
+
+// Wait until the session starts waiting for the acknowledgment
+func waitPending(s *session.Session) {
+	for s.Pending() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAllocateWrapsAround(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSession(ctx)
+
+	pb := newPublish(message.QoS1)
+	kept, err := s.Allocate(pb)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1), kept.PacketId)
+	// Original message is shared with other subscribers, then it isn't modified
+	assert.Equal(t, uint16(0), pb.PacketId)
+
+	for id := uint16(2); id != 0; id++ {
+		out, err := s.Allocate(newPublish(message.QoS1))
+		assert.NoError(t, err)
+		assert.Equal(t, id, out.PacketId)
+		s.Complete(out.PacketId)
+	}
+	// Identifier wraps around to 1, but it's still in use
+	out, err := s.Allocate(newPublish(message.QoS1))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(2), out.PacketId)
+}
+
+func TestResumeMarksDuplicateInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSession(ctx)
+
+	shared := newPublish(message.QoS2)
+	ids := []uint16{}
+	for _, pb := range []*message.Publish{newPublish(message.QoS2), newPublish(message.QoS1), shared} {
+		out, err := s.Allocate(pb)
+		assert.NoError(t, err)
+		ids = append(ids, out.PacketId)
+	}
+	assert.NoError(t, s.Transit(ids[0], session.AwaitPubComp))
+	before, _ := s.Inflight(ids[2])
+
+	assert.Equal(t, ids, s.Resume())
+	// PUBREL is resent for the message which has received PUBREC, then PUBLISH isn't marked
+	m, _ := s.Inflight(ids[0])
+	assert.Equal(t, session.AwaitPubComp, m.State)
+	assert.False(t, m.Message.DUP)
+	m, _ = s.Inflight(ids[1])
+	assert.True(t, m.Message.DUP)
+	m, _ = s.Inflight(ids[2])
+	assert.True(t, m.Message.DUP)
+	// Message is replaced with the copy, then the message which may be encoded at the same time isn't modified
+	assert.False(t, before.Message.DUP)
+	assert.False(t, shared.DUP)
+
+	// Resuming again keeps the order
+	assert.Equal(t, ids, s.Resume())
+}
+
+func TestSendCompletesQoS2Flow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSession(ctx)
+
+	out, err := s.Allocate(newPublish(message.QoS2))
+	assert.NoError(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Send(out.PacketId)
+	}()
+
+	waitPending(s)
+	assert.NoError(t, s.Meet(out.PacketId, message.PUBREC, message.NewPubRec(out.PacketId)))
+	// PUBREL is sent with the same identifier, and the message waits for PUBCOMP
+	waitPending(s)
+	m, ok := s.Inflight(out.PacketId)
+	assert.True(t, ok)
+	assert.Equal(t, session.AwaitPubComp, m.State)
+	assert.Error(t, s.Meet(out.PacketId, message.PUBREC, message.NewPubRec(out.PacketId)))
+
+	assert.NoError(t, s.Meet(out.PacketId, message.PUBCOMP, message.NewPubComp(out.PacketId)))
+	assert.NoError(t, <-done)
+	_, ok = s.Inflight(out.PacketId)
+	assert.False(t, ok)
+}
+
+func TestSendKeepsMessageOnConnectionClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newSession(ctx)
+
+	out, err := s.Allocate(newPublish(message.QoS1))
+	assert.NoError(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Send(out.PacketId)
+	}()
+	waitPending(s)
+	cancel()
+	assert.Error(t, <-done)
+
+	// Message is resent by the next connection which takes over the session
+	next := newSession(context.Background())
+	next.Takeover(s)
+	assert.Equal(t, []uint16{out.PacketId}, next.Resume())
+}
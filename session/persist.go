@@ -0,0 +1,46 @@
+package session
+
+import (
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Persistence is notified of changes of in-flight messages and incoming QoS2 messages,
+// in order to keep them in the storage over process restarts.
+// Methods are called while the session state is locked, then changes are notified in order
+type Persistence interface {
+	// Outgoing message is allocated, or its state is updated
+	SaveInflight(m Inflight)
+	// Outgoing message completes
+	DeleteInflight(packetId uint16)
+	// Incoming QoS2 message is stored until PUBREL
+	SaveReceived(pb *message.Publish)
+	// Incoming QoS2 message is released
+	DeleteReceived(packetId uint16)
+}
+
+// Set persistence of the session, it must be called before the session is used
+func (s *Session) Persist(p Persistence) {
+	s.persist = p
+}
+
+// Restore in-flight message which was saved by the persistence, packet identifier of the message is kept
+func (s *Session) RestoreInflight(pb *message.Publish, state State) {
+	t := s.inflight
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	t.messages[pb.PacketId] = &Inflight{
+		PacketId: pb.PacketId,
+		Message:  pb,
+		State:    state,
+		seq:      t.seq,
+	}
+}
+
+// Restore incoming QoS2 message which was saved by the persistence
+func (s *Session) RestoreReceived(pb *message.Publish) {
+	t := s.receive
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages[pb.PacketId] = &incoming{pb: pb}
+}
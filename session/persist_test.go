@@ -0,0 +1,122 @@
+package session_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/message"
+	"github.com/ysugimoto/gqtt/session"
+)
+
+// Persistence which records notified changes in order
+type recordPersistence struct {
+	calls []string
+	mu    sync.Mutex
+}
+
+func (p *recordPersistence) record(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, fmt.Sprintf(format, args...))
+}
+
+func (p *recordPersistence) SaveInflight(m session.Inflight) {
+	p.record("SaveInflight %d %s", m.PacketId, m.State)
+}
+func (p *recordPersistence) DeleteInflight(packetId uint16) {
+	p.record("DeleteInflight %d", packetId)
+}
+func (p *recordPersistence) SaveReceived(pb *message.Publish) {
+	p.record("SaveReceived %d", pb.PacketId)
+}
+func (p *recordPersistence) DeleteReceived(packetId uint16) {
+	p.record("DeleteReceived %d", packetId)
+}
+
+func (p *recordPersistence) recorded() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.calls...)
+}
+
+func TestPersistenceIsNotified(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSession(ctx)
+	p := &recordPersistence{}
+	s.Persist(p)
+
+	out, err := s.Allocate(newPublish(message.QoS2))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Transit(out.PacketId, session.AwaitPubComp))
+	s.Complete(out.PacketId)
+	// Unknown identifier isn't notified
+	s.Complete(out.PacketId)
+
+	pb := newPublish(message.QoS2)
+	pb.PacketId = 7
+	s.Receive(pb)
+	// Retransmitted message isn't saved again
+	pb.DUP = true
+	s.Receive(pb)
+	s.Release(7)
+	s.Release(7)
+
+	assert.Equal(t, []string{
+		"SaveInflight 1 AwaitPubRec",
+		"SaveInflight 1 AwaitPubComp",
+		"DeleteInflight 1",
+		"SaveReceived 7",
+		"DeleteReceived 7",
+	}, p.recorded())
+}
+
+func TestRestoreSavedMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSession(ctx)
+	p := &recordPersistence{}
+	s.Persist(p)
+
+	// Messages are restored in order of saving with their packet identifiers
+	released := newPublish(message.QoS2)
+	released.PacketId = 10
+	s.RestoreInflight(released, session.AwaitPubComp)
+	acked := newPublish(message.QoS1)
+	acked.PacketId = 3
+	s.RestoreInflight(acked, session.AwaitPubAck)
+	received := newPublish(message.QoS2)
+	received.PacketId = 7
+	s.RestoreReceived(received)
+
+	inflights := s.Inflights()
+	if assert.Len(t, inflights, 2) {
+		assert.Equal(t, uint16(10), inflights[0].PacketId)
+		assert.Equal(t, session.AwaitPubComp, inflights[0].State)
+		assert.Equal(t, uint16(3), inflights[1].PacketId)
+		assert.Equal(t, session.AwaitPubAck, inflights[1].State)
+	}
+	assert.Equal(t, []uint16{10, 3}, s.Resume())
+	// Restoring doesn't notify the persistence because the messages have been saved
+	assert.Empty(t, p.recorded())
+
+	// Restored identifiers aren't allocated again
+	for i := 0; i < 20; i++ {
+		out, err := s.Allocate(newPublish(message.QoS1))
+		assert.NoError(t, err)
+		assert.NotEqual(t, uint16(10), out.PacketId)
+		assert.NotEqual(t, uint16(3), out.PacketId)
+	}
+
+	// Retransmitted PUBLISH of the restored message is acknowledged, and PUBREL releases it
+	dup := newPublish(message.QoS2)
+	dup.PacketId = 7
+	dup.DUP = true
+	assert.Equal(t, message.Success, s.Receive(dup))
+	pb, ok := s.Release(7)
+	assert.True(t, ok)
+	assert.True(t, pb == received)
+}
@@ -0,0 +1,102 @@
+package session
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ysugimoto/gqtt/message"
+)
+
+// Incoming QoS2 message which is identified by packet identifier until PUBREL.
+// After PUBREL, only the identifier is kept as released in order to respond PUBCOMP for retransmitted PUBREL
+// without delivering the message twice
+type incoming struct {
+	pb       *message.Publish
+	released bool
+}
+
+type receiveTable struct {
+	messages map[uint16]*incoming
+	mu       sync.Mutex
+}
+
+func newReceiveTable() *receiveTable {
+	return &receiveTable{
+		messages: make(map[uint16]*incoming),
+	}
+}
+
+// Store incoming QoS2 message until PUBREL, and returns reason code for PUBREC.
+// Retransmitted PUBLISH which has DUP flag doesn't replace the stored message,
+// but PUBLISH which reuses the identifier before PUBREL is rejected with PacketIdentifierInUse
+func (s *Session) Receive(pb *message.Publish) message.ReasonCode {
+	t := s.receive
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if m, ok := t.messages[pb.PacketId]; ok && !m.released {
+		if pb.DUP {
+			return message.Success
+		}
+		return message.PacketIdentifierInUse
+	}
+	t.messages[pb.PacketId] = &incoming{pb: pb}
+	if s.persist != nil {
+		s.persist.SaveReceived(pb)
+	}
+	return message.Success
+}
+
+// Release the message on PUBREL. The message is returned only for the first PUBREL,
+// and false is returned when the packet identifier is unknown
+func (s *Session) Release(packetId uint16) (*message.Publish, bool) {
+	t := s.receive
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, ok := t.messages[packetId]
+	if !ok {
+		return nil, false
+	}
+	if m.released {
+		return nil, true
+	}
+	pb := m.pb
+	m.pb = nil
+	m.released = true
+	if s.persist != nil {
+		s.persist.DeleteReceived(packetId)
+	}
+	return pb, true
+}
+
+// Count stored messages which are waiting for PUBREL
+func (s *Session) Stored() int {
+	t := s.receive
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var n int
+	for _, m := range t.messages {
+		if !m.released {
+			n++
+		}
+	}
+	return n
+}
+
+// Get incoming QoS2 messages which are waiting for PUBREL, in order of packet identifier
+func (s *Session) Received() []*message.Publish {
+	t := s.receive
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := []*message.Publish{}
+	for _, m := range t.messages {
+		if !m.released {
+			list = append(list, m.pb)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].PacketId < list[j].PacketId
+	})
+	return list
+}
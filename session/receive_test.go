@@ -0,0 +1,69 @@
+package session_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysugimoto/gqtt/message"
+)
+
+func TestReceiveAndRelease(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSession(ctx)
+
+	pb := newPublish(message.QoS2)
+	pb.PacketId = 1
+	assert.Equal(t, message.Success, s.Receive(pb))
+
+	// Retransmitted PUBLISH doesn't replace the stored message
+	dup := newPublish(message.QoS2)
+	dup.PacketId = 1
+	dup.DUP = true
+	dup.Body = []byte("retransmitted")
+	assert.Equal(t, message.Success, s.Receive(dup))
+	assert.Equal(t, 1, s.Stored())
+
+	// Identifier can't be reused by another message until PUBREL
+	other := newPublish(message.QoS2)
+	other.PacketId = 1
+	assert.Equal(t, message.PacketIdentifierInUse, s.Receive(other))
+
+	released, ok := s.Release(1)
+	assert.True(t, ok)
+	assert.True(t, released == pb)
+	assert.Equal(t, 0, s.Stored())
+
+	// Retransmitted PUBREL is acknowledged without delivering the message twice
+	released, ok = s.Release(1)
+	assert.True(t, ok)
+	assert.Nil(t, released)
+	_, ok = s.Release(2)
+	assert.False(t, ok)
+
+	// Released identifier can be used for the next message
+	assert.Equal(t, message.Success, s.Receive(other))
+	released, ok = s.Release(1)
+	assert.True(t, ok)
+	assert.True(t, released == other)
+}
+
+func TestReceivedListsUnreleasedMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newSession(ctx)
+
+	for _, id := range []uint16{3, 1, 2} {
+		pb := newPublish(message.QoS2)
+		pb.PacketId = id
+		assert.Equal(t, message.Success, s.Receive(pb))
+	}
+	s.Release(2)
+
+	received := s.Received()
+	if assert.Equal(t, 2, len(received)) {
+		assert.Equal(t, uint16(1), received[0].PacketId)
+		assert.Equal(t, uint16(3), received[1].PacketId)
+	}
+}
@@ -0,0 +1,67 @@
+package session
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ysugimoto/gqtt/message"
+)
+
+type spilledMessage struct {
+	pb *message.Publish
+	at time.Time
+}
+
+// Spilled messages are kept in the session, then they are delivered on session resumption
+// even if the connection is closed before delivery
+type spillTable struct {
+	messages []spilledMessage
+	// Notified when the message is spilled, in order to wake up the delivery which is waiting for the queue
+	ready chan struct{}
+	mu    sync.Mutex
+}
+
+func newSpillTable() *spillTable {
+	return &spillTable{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Keep the message which couldn't be queued for delivery, with the time when it was published
+func (s *Session) Spill(pb *message.Publish, at time.Time) {
+	t := s.spill
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = append(t.messages, spilledMessage{pb: pb, at: at})
+	select {
+	case t.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Take the oldest spilled message
+func (s *Session) Unspill() (*message.Publish, time.Time, bool) {
+	t := s.spill
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.messages) == 0 {
+		return nil, time.Time{}, false
+	}
+	m := t.messages[0]
+	t.messages[0] = spilledMessage{}
+	t.messages = t.messages[1:]
+	return m.pb, m.at, true
+}
+
+// Count spilled messages which are waiting for delivery
+func (s *Session) Spilled() int {
+	t := s.spill
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.messages)
+}
+
+// Channel which is notified when the message is spilled
+func (s *Session) SpillReady() <-chan struct{} {
+	return s.spill.ready
+}